@@ -19,10 +19,13 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"os/user"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/minio/cli"
 	minfs "github.com/minio/minfs/fs"
@@ -82,6 +85,16 @@ func NewApp() *cli.App {
 	}
 	app.Action = func(c *cli.Context) error {
 		opts := []func(*minfs.Config){}
+		routes := map[string]string{}
+		headers := map[string]string{}
+		var stsEndpoint, roleARN, tokenFile string
+
+		// Headers holding secrets are taken from the environment or a file,
+		// they'd show in the process list on the command line.
+		if err := addHeaders(headers, os.Getenv("MINFS_HEADERS")); err != nil {
+			return err
+		}
+
 		for _, option := range strings.Split(c.String("o"), ",") {
 			vals := strings.Split(option, "=")
 			switch vals[0] {
@@ -94,11 +107,451 @@ func NewApp() *cli.App {
 				if len(vals) == 1 {
 					return errors.New("Cache quota has no value")
 				}
-				quota, err := strconv.Atoi(vals[1])
+				quota, err := strconv.ParseFloat(vals[1], 64)
+				if err != nil {
+					return errors.New("Cache quota invalid, pass a value in GB")
+				}
+				opts = append(opts, minfs.CacheQuotaBytes(int64(quota*(1<<30))))
+			case "highwatermark", "lowwatermark":
+				if len(vals) == 1 {
+					return errors.New("Cache watermark has no value")
+				}
+				fraction, err := strconv.ParseFloat(vals[1], 64)
+				if err != nil {
+					return errors.New("Cache watermark invalid, pass a fraction of the quota")
+				}
+				if vals[0] == "highwatermark" {
+					opts = append(opts, minfs.CacheHighWatermark(fraction))
+				} else {
+					opts = append(opts, minfs.CacheLowWatermark(fraction))
+				}
+			case "route":
+				if len(vals) == 1 {
+					return errors.New("Route has no value")
+				}
+				route := strings.SplitN(vals[1], "@", 2)
+				if len(route) != 2 {
+					return errors.New("Route invalid, pass as bucket@endpoint")
+				}
+				routes[route[0]] = route[1]
+			case "bucketcache":
+				if len(vals) == 1 {
+					return errors.New("Bucket cache has no value")
+				}
+				cache := strings.SplitN(vals[1], "@", 2)
+				if len(cache) != 2 {
+					return errors.New("Bucket cache invalid, pass as bucket@dir or bucket@dir:quota")
+				}
+				dir, quota := cache[1], float64(0)
+				if i := strings.LastIndex(dir, ":"); i >= 0 {
+					q, err := strconv.ParseFloat(dir[i+1:], 64)
+					if err != nil {
+						return errors.New("Bucket cache quota invalid, pass a value in GB")
+					}
+					dir, quota = dir[:i], q
+				}
+				opts = append(opts, minfs.BucketCacheDirBytes(cache[0], dir, int64(quota*(1<<30))))
+			case "bucketquota":
+				if len(vals) == 1 {
+					return errors.New("Bucket quota has no value")
+				}
+				bq := strings.SplitN(vals[1], "@", 2)
+				if len(bq) != 2 {
+					return errors.New("Bucket quota invalid, pass as bucket@quota")
+				}
+				quota, err := strconv.ParseFloat(bq[1], 64)
+				if err != nil {
+					return errors.New("Bucket quota invalid, pass a value in GB")
+				}
+				opts = append(opts, minfs.BucketCacheQuota(bq[0], int64(quota*(1<<30))))
+			case "ssec", "ssekms":
+				if len(vals) == 1 {
+					return errors.New("Server side encryption has no value")
+				}
+				sse := strings.SplitN(vals[1], "@", 2)
+				if len(sse) != 2 {
+					return errors.New("Server side encryption invalid, pass as bucket@keyfile or bucket@keyid")
+				}
+				if vals[0] == "ssec" {
+					opts = append(opts, minfs.BucketSSECKeyFile(sse[0], sse[1]))
+				} else {
+					opts = append(opts, minfs.BucketSSEKMS(sse[0], sse[1]))
+				}
+			case "retries":
+				if len(vals) == 1 {
+					return errors.New("Cache retries has no value")
+				}
+				retries, err := strconv.Atoi(vals[1])
 				if err != nil {
-					return errors.New("Cache quota invalid, pass only integer value in GB")
+					return errors.New("Cache retries invalid, pass only integer value")
+				}
+				opts = append(opts, minfs.LocalRetries(retries))
+			case "buckets":
+				if len(vals) == 1 {
+					return errors.New("Static buckets has no value")
+				}
+				opts = append(opts, minfs.StaticBuckets(strings.Split(vals[1], ":")))
+			case "compress":
+				if len(vals) == 1 {
+					return errors.New("Cache compression has no value")
+				}
+				opts = append(opts, minfs.CacheCompression(vals[1]))
+			case "root":
+				if len(vals) == 1 {
+					return errors.New("Root has no value")
+				}
+				opts = append(opts, minfs.Root(vals[1]))
+			case "allowbuckets":
+				if len(vals) == 1 {
+					return errors.New("Allowed buckets has no value")
+				}
+				opts = append(opts, minfs.Buckets(strings.Split(vals[1], ":")...))
+			case "archives":
+				if len(vals) == 1 {
+					return errors.New("Archive extensions has no value")
+				}
+				opts = append(opts, minfs.ArchiveMount(strings.Split(vals[1], ":")))
+			case "windowsnames":
+				opts = append(opts, minfs.WindowsSafeNames())
+			case "rangereads":
+				opts = append(opts, minfs.RangeReads())
+			case "readahead":
+				if len(vals) == 1 {
+					return errors.New("Readahead has no value")
+				}
+				n, err := strconv.ParseInt(vals[1], 10, 64)
+				if err != nil {
+					return errors.New("Readahead invalid, pass only integer value in bytes")
+				}
+				opts = append(opts, minfs.ReadaheadBytes(n))
+			case "hashnames":
+				opts = append(opts, minfs.HashedCacheNames())
+			case "dedup":
+				opts = append(opts, minfs.CacheDedup())
+			case "symlinks":
+				if len(vals) == 1 {
+					return errors.New("Symlink content type has no value")
+				}
+				opts = append(opts, minfs.SymlinkObjects(vals[1]))
+			case "posixmeta":
+				opts = append(opts, minfs.PreservePOSIXMeta())
+			case "strictlist":
+				opts = append(opts, minfs.StrictListing())
+			case "rps":
+				if len(vals) == 1 {
+					return errors.New("Requests per second has no value")
 				}
-				opts = append(opts, minfs.CacheQuota(quota))
+				rps, err := strconv.Atoi(vals[1])
+				if err != nil {
+					return errors.New("Requests per second invalid, pass only integer value")
+				}
+				opts = append(opts, minfs.MaxRequestsPerSecond(rps))
+			case "retrybudget":
+				if len(vals) == 1 {
+					return errors.New("Retry budget has no value")
+				}
+				budget, err := strconv.Atoi(vals[1])
+				if err != nil {
+					return errors.New("Retry budget invalid, pass only integer value")
+				}
+				opts = append(opts, minfs.RetryBudget(budget))
+			case "maxretries":
+				if len(vals) == 1 {
+					return errors.New("Max retries has no value")
+				}
+				retries, err := strconv.Atoi(vals[1])
+				if err != nil {
+					return errors.New("Max retries invalid, pass only integer value")
+				}
+				opts = append(opts, minfs.MaxRetries(retries))
+			case "retrybackoff":
+				if len(vals) == 1 {
+					return errors.New("Retry backoff has no value")
+				}
+				backoff, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return errors.New("Retry backoff invalid, pass a duration as 2s")
+				}
+				opts = append(opts, minfs.RetryBackoff(backoff))
+			case "maxfilesize":
+				if len(vals) == 1 {
+					return errors.New("Max cache file size has no value")
+				}
+				size, err := strconv.ParseInt(vals[1], 10, 64)
+				if err != nil {
+					return errors.New("Max cache file size invalid, pass only integer value in bytes")
+				}
+				opts = append(opts, minfs.MaxCacheFileSize(size))
+			case "streamupload":
+				if len(vals) == 1 {
+					return errors.New("Streaming upload has no value")
+				}
+				sizes := strings.SplitN(vals[1], ":", 2)
+				partSize, err := strconv.ParseInt(sizes[0], 10, 64)
+				if err != nil {
+					return errors.New("Streaming upload part size invalid, pass only integer value in bytes")
+				}
+				threshold := partSize
+				if len(sizes) == 2 {
+					if threshold, err = strconv.ParseInt(sizes[1], 10, 64); err != nil {
+						return errors.New("Streaming upload threshold invalid, pass only integer value in bytes")
+					}
+				}
+				opts = append(opts, minfs.StreamingUploads(partSize, threshold))
+			case "parallel":
+				if len(vals) == 1 {
+					return errors.New("Parallel download has no value")
+				}
+				parts := strings.SplitN(vals[1], ":", 2)
+				n, err := strconv.Atoi(parts[0])
+				if err != nil {
+					return errors.New("Parallel download concurrency invalid, pass only integer value")
+				}
+				opts = append(opts, minfs.DownloadConcurrency(n))
+				if len(parts) == 2 {
+					threshold, err := strconv.ParseInt(parts[1], 10, 64)
+					if err != nil {
+						return errors.New("Parallel download threshold invalid, pass only integer value in bytes")
+					}
+					opts = append(opts, minfs.ParallelDownloadThreshold(threshold))
+				}
+			case "nomarkers":
+				opts = append(opts, minfs.DirMarkers(false))
+			case "listingttl":
+				if len(vals) == 1 {
+					return errors.New("Listing cache ttl has no value")
+				}
+				ttl, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return errors.New("Listing cache ttl invalid, pass a duration as 5s")
+				}
+				opts = append(opts, minfs.ListingCacheTTL(ttl))
+			case "bucketttl":
+				if len(vals) == 1 {
+					return errors.New("Bucket list ttl has no value")
+				}
+				ttl, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return errors.New("Bucket list ttl invalid, pass a duration as 5m")
+				}
+				opts = append(opts, minfs.BucketListTTL(ttl))
+			case "statttl":
+				if len(vals) == 1 {
+					return errors.New("Stat cache ttl has no value")
+				}
+				ttl, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return errors.New("Stat cache ttl invalid, pass a duration as 5s")
+				}
+				opts = append(opts, minfs.StatCacheTTL(ttl))
+			case "tagttl":
+				if len(vals) == 1 {
+					return errors.New("Tag cache ttl has no value")
+				}
+				ttl, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return errors.New("Tag cache ttl invalid, pass a duration as 1m")
+				}
+				opts = append(opts, minfs.TagCacheTTL(ttl))
+			case "optimeout":
+				if len(vals) == 1 {
+					return errors.New("Operation timeout has no value")
+				}
+				timeout, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return errors.New("Operation timeout invalid, pass a duration as 1m")
+				}
+				opts = append(opts, minfs.OpTimeout(timeout))
+			case "downloadtimeout":
+				if len(vals) == 1 {
+					return errors.New("Download timeout has no value")
+				}
+				timeout, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return errors.New("Download timeout invalid, pass a duration as 1h")
+				}
+				opts = append(opts, minfs.DownloadTimeout(timeout))
+			case "slowdownload":
+				if len(vals) == 1 {
+					return errors.New("Slow download threshold has no value")
+				}
+				threshold, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return errors.New("Slow download threshold invalid, pass a duration as 30s")
+				}
+				opts = append(opts, minfs.SlowDownload(threshold))
+			case "reconcile":
+				if len(vals) == 1 {
+					return errors.New("Cache reconcile interval has no value")
+				}
+				interval, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return errors.New("Cache reconcile interval invalid, pass a duration as 10m")
+				}
+				opts = append(opts, minfs.CacheReconcile(interval))
+			case "sweeporphans":
+				opts = append(opts, minfs.SweepOrphans())
+			case "presignexpiry":
+				if len(vals) == 1 {
+					return errors.New("Presign expiry has no value")
+				}
+				expiry, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return errors.New("Presign expiry invalid, pass a duration as 12h")
+				}
+				opts = append(opts, minfs.PresignExpiry(expiry))
+			case "nodecache":
+				if len(vals) == 1 {
+					return errors.New("Node cache size has no value")
+				}
+				size, err := strconv.Atoi(vals[1])
+				if err != nil {
+					return errors.New("Node cache size invalid, pass only integer value")
+				}
+				opts = append(opts, minfs.NodeCacheSize(size))
+			case "maxdepth":
+				if len(vals) == 1 {
+					return errors.New("Max path depth has no value")
+				}
+				depth, err := strconv.Atoi(vals[1])
+				if err != nil {
+					return errors.New("Max path depth invalid, pass only integer value")
+				}
+				opts = append(opts, minfs.MaxPathDepth(depth))
+			case "delimiter":
+				if len(vals) == 1 {
+					return errors.New("Delimiter has no value")
+				}
+				opts = append(opts, minfs.Delimiter(vals[1]))
+			case "header":
+				if len(vals) == 1 {
+					return errors.New("Header has no value")
+				}
+				header := strings.SplitN(strings.Join(vals[1:], "="), ":", 2)
+				if len(header) != 2 {
+					return errors.New("Header invalid, pass as name:value")
+				}
+				headers[header[0]] = header[1]
+			case "headerfile":
+				if len(vals) == 1 {
+					return errors.New("Header file has no value")
+				}
+				data, err := ioutil.ReadFile(vals[1])
+				if err != nil {
+					return fmt.Errorf("Unable to read header file %s", err)
+				}
+				if err = addHeaders(headers, string(data)); err != nil {
+					return err
+				}
+			case "union":
+				if len(vals) == 1 {
+					return errors.New("Union has no value")
+				}
+				union := strings.SplitN(vals[1], "@", 2)
+				if len(union) != 2 {
+					return errors.New("Union invalid, pass as name@prefix:prefix")
+				}
+				opts = append(opts, minfs.UnionPrefix(union[0], strings.Split(union[1], ":")))
+			case "health":
+				if len(vals) == 1 {
+					return errors.New("Health address has no value")
+				}
+				opts = append(opts, minfs.HealthAddr(vals[1]))
+			case "metrics":
+				if len(vals) == 1 {
+					return errors.New("Metrics address has no value")
+				}
+				opts = append(opts, minfs.MetricsAddr(vals[1]))
+			case "canary":
+				if len(vals) == 1 {
+					return errors.New("Canary has no value")
+				}
+				canary := strings.SplitN(vals[1], "@", 2)
+				object := strings.SplitN(canary[0], "/", 2)
+				if len(canary) != 2 || len(object) != 2 {
+					return errors.New("Canary invalid, pass as bucket/key@interval")
+				}
+				interval, err := time.ParseDuration(canary[1])
+				if err != nil {
+					return errors.New("Canary interval invalid, pass a duration such as 1m")
+				}
+				opts = append(opts, minfs.Canary(object[0], object[1], interval))
+			case "peeraddr":
+				if len(vals) == 1 {
+					return errors.New("Cache peer address has no value")
+				}
+				opts = append(opts, minfs.CachePeerAddr(vals[1]))
+			case "peers":
+				if len(vals) == 1 {
+					return errors.New("Cache peers has no value")
+				}
+				opts = append(opts, minfs.CachePeers(strings.Split(vals[1], "|")))
+			case "lookup":
+				if len(vals) == 1 {
+					return errors.New("Bucket lookup has no value")
+				}
+				opts = append(opts, minfs.BucketLookup(vals[1]))
+			case "region":
+				if len(vals) == 1 {
+					return errors.New("Region has no value")
+				}
+				opts = append(opts, minfs.Region(vals[1]))
+			case "sts":
+				if len(vals) == 1 {
+					return errors.New("STS endpoint has no value")
+				}
+				stsEndpoint = vals[1]
+			case "rolearn":
+				if len(vals) == 1 {
+					return errors.New("Role ARN has no value")
+				}
+				roleARN = vals[1]
+			case "webidentity":
+				if len(vals) == 1 {
+					return errors.New("Web identity token file has no value")
+				}
+				tokenFile = vals[1]
+			case "iam":
+				// The endpoint is optional, the platform's is asked by default.
+				var endpoint string
+				if len(vals) > 1 {
+					endpoint = vals[1]
+				}
+				opts = append(opts, minfs.IAMRole(endpoint))
+			case "users":
+				if len(vals) == 1 {
+					return errors.New("User credentials have no value")
+				}
+				opts = append(opts, minfs.UserCredentials(vals[1]))
+			case "denyunknown":
+				opts = append(opts, minfs.DenyUnknownUsers())
+			case "anonymous":
+				opts = append(opts, minfs.Anonymous())
+			case "filemode", "dirmode":
+				if len(vals) == 1 {
+					return errors.New("Mode has no value")
+				}
+				mode, err := strconv.ParseUint(vals[1], 8, 32)
+				if err != nil {
+					return errors.New("Mode invalid, pass permissions in octal as 0644")
+				}
+				if vals[0] == "filemode" {
+					opts = append(opts, minfs.FileMode(os.FileMode(mode)))
+				} else {
+					opts = append(opts, minfs.DirMode(os.FileMode(mode)))
+				}
+			case "ro":
+				opts = append(opts, minfs.ReadOnly())
+			case "cacert":
+				if len(vals) == 1 {
+					return errors.New("CA certificate has no value")
+				}
+				opts = append(opts, minfs.CACert(vals[1]))
+			case "proxy":
+				if len(vals) == 1 {
+					return errors.New("Proxy has no value")
+				}
+				opts = append(opts, minfs.Proxy(vals[1]))
 			case "insecure":
 				opts = append(opts, minfs.Insecure())
 			case "debug":
@@ -106,6 +559,33 @@ func NewApp() *cli.App {
 			}
 		}
 
+		if len(headers) > 0 {
+			opts = append(opts, minfs.CustomHeaders(headers))
+		}
+
+		if len(routes) > 0 {
+			opts = append(opts, minfs.EndpointRouting(routes))
+		}
+
+		// The keys are taken from the environment, never from the command line.
+		if key := os.Getenv("MINFS_CACHE_KEY"); key != "" {
+			opts = append(opts, minfs.CacheEncryptionKey(key))
+		}
+		if secret := os.Getenv("MINFS_PEER_SECRET"); secret != "" {
+			opts = append(opts, minfs.CachePeerSecret(secret))
+		}
+
+		switch {
+		case stsEndpoint == "" && (roleARN != "" || tokenFile != ""):
+			return errors.New("STS endpoint not set, pass it as sts=endpoint")
+		case roleARN != "" && tokenFile != "":
+			return errors.New("Role ARN is only used to assume a role, not with a web identity")
+		case tokenFile != "":
+			opts = append(opts, minfs.WebIdentity(stsEndpoint, tokenFile))
+		case stsEndpoint != "":
+			opts = append(opts, minfs.AssumeRole(stsEndpoint, roleARN))
+		}
+
 		target := c.Args().Get(1)
 		mountpoint := c.Args().Get(0)
 
@@ -129,7 +609,11 @@ func NewApp() *cli.App {
 		}
 		opts = append(opts, minfs.SetGID(uint32(gidval)))
 
-		opts = append(opts, minfs.Mountpoint(mountpoint), minfs.Target(target))
+		// Without a target on the command line, it's taken from MINFS_ENDPOINT.
+		opts = append(opts, minfs.Mountpoint(mountpoint))
+		if target != "" {
+			opts = append(opts, minfs.Target(target))
+		}
 
 		fs, err := minfs.New(opts...)
 		if err != nil {
@@ -147,6 +631,22 @@ func NewApp() *cli.App {
 	return app
 }
 
+// addHeaders adds the headers in s, one name:value per line, to headers.
+// Values are taken as they are, commas included.
+func addHeaders(headers map[string]string, s string) error {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		header := strings.SplitN(line, ":", 2)
+		if len(header) != 2 {
+			return errors.New("Header invalid, pass as name:value")
+		}
+		headers[strings.TrimSpace(header[0])] = strings.TrimSpace(header[1])
+	}
+	return nil
+}
+
 // Main is the actual run function
 func Main(app *cli.App, args []string) {
 	// Enable profiling supported modes are [cpu, mem, block].
@@ -0,0 +1,607 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// maxArchiveIndexes is the number of archive indexes kept in memory, the
+// ones used last.
+const maxArchiveIndexes = 64
+
+// archiveReadahead is the least an archive is read by, with a request.
+const archiveReadahead = 1 << 20
+
+// archiveFormat returns the format of the archive named name, "" when it
+// isn't presented as an archive. Extensions ending in tar are read as
+// uncompressed tar, any other as zip.
+func (mfs *MinFS) archiveFormat(name string) string {
+	for _, ext := range mfs.config.archiveExts {
+		if !strings.HasSuffix(name, ext) || name == ext {
+			continue
+		}
+		if strings.HasSuffix(ext, "tar") {
+			return "tar"
+		}
+		return "zip"
+	}
+	return ""
+}
+
+// archiveObject is the object version an archive is read from.
+type archiveObject struct {
+	bucket string
+	key    string
+	etag   string
+	size   int64
+	format string
+
+	// full path of the archive on the mount
+	fullPath string
+}
+
+// objectReaderAt reads an archive object by range, every range from the
+// version that was listed. Reads get at least archiveReadahead bytes, the
+// headers and small members read after are served from them.
+type objectReaderAt struct {
+	ctx context.Context
+	api *minio.Client
+	sse encrypt.ServerSide
+
+	object *archiveObject
+
+	// bounds every request, unbounded when 0
+	timeout time.Duration
+
+	// the range read last, from bufOff
+	mu     sync.Mutex
+	buf    []byte
+	bufOff int64
+}
+
+// ReadAt reads len(p) bytes of the object at off.
+func (r *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.readAt(r.ctx, p, off)
+}
+
+// readAt reads len(p) bytes of the object at off, with the request of ctx.
+func (r *objectReaderAt) readAt(ctx context.Context, p []byte, off int64) (int, error) {
+	if off >= r.object.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bufEnd := r.bufOff + int64(len(r.buf))
+	if off < r.bufOff || off >= bufEnd || (off+int64(len(p)) > bufEnd && bufEnd < r.object.size) {
+		size := int64(len(p))
+		if size < archiveReadahead {
+			size = archiveReadahead
+		}
+		if err := r.fetch(ctx, off, size); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf[off-r.bufOff:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch reads size bytes of the object at off into the buffer, fewer at the
+// end of the object. Callers hold mu.
+func (r *objectReaderAt) fetch(ctx context.Context, off, size int64) error {
+	end := off + size - 1
+	if end >= r.object.size {
+		end = r.object.size - 1
+	}
+
+	opts := minio.GetObjectOptions{ServerSideEncryption: r.sse}
+	if err := opts.SetRange(off, end); err != nil {
+		return err
+	}
+	if err := opts.SetMatchETag(r.object.etag); err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	object, err := r.api.GetObject(ctx, r.object.bucket, r.object.key, opts)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	buf := make([]byte, end-off+1)
+	if _, err = io.ReadFull(object, buf); err != nil {
+		return err
+	}
+	r.buf, r.bufOff = buf, off
+	return nil
+}
+
+// archiveMember is a file or directory in an archive.
+type archiveMember struct {
+	name  string
+	dir   bool
+	size  int64
+	mtime time.Time
+
+	// offset of the data of a tar member, zip members have zf and find
+	// their data when opened
+	offset int64
+	zf     *zip.File
+}
+
+// archiveIndex lists the members of an archive, by path in the archive.
+type archiveIndex struct {
+	members  map[string]*archiveMember
+	children map[string][]string
+
+	// the key of the index in the indexes by last use
+	used *list.Element
+}
+
+// add adds a member, and its parent directories when not in the archive.
+func (idx *archiveIndex) add(m *archiveMember) {
+	if _, ok := idx.members[m.name]; ok {
+		return
+	}
+	idx.members[m.name] = m
+
+	parent := path.Dir(m.name)
+	if parent == "." {
+		parent = ""
+	}
+	idx.children[parent] = append(idx.children[parent], path.Base(m.name))
+
+	if parent != "" {
+		idx.add(&archiveMember{name: parent, dir: true, mtime: m.mtime, offset: -1})
+	}
+}
+
+// memberName returns the cleaned path of a member, false for members
+// pointing outside of the archive.
+func memberName(name string) (string, bool) {
+	name = path.Clean("/" + strings.TrimPrefix(name, "./"))[1:]
+	return name, name != ""
+}
+
+// archiveIndex returns the index of archive, reading it on first use. A zip
+// archive is indexed from its central directory, a tar archive by reading
+// the header of every member.
+func (mfs *MinFS) archiveIndex(ctx context.Context, uid uint32, archive *archiveObject) (*archiveIndex, error) {
+	key := archive.bucket + "/" + archive.key + "@" + archive.etag
+
+	mfs.m.Lock()
+	idx, ok := mfs.archives[key]
+	if ok {
+		mfs.archiveUse.MoveToFront(idx.used)
+	}
+	mfs.m.Unlock()
+
+	if ok {
+		return idx, nil
+	}
+
+	api, err := mfs.getBucketApi(ctx, uid, archive.bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	octx, cancel := withTimeout(ctx, mfs.config.opTimeout)
+	defer cancel()
+
+	r := &objectReaderAt{ctx: octx, api: api, sse: mfs.sse(archive.bucket), object: archive}
+	idx = &archiveIndex{members: map[string]*archiveMember{}, children: map[string][]string{}}
+	if err = mfs.indexArchive(r, idx); err != nil {
+		if timedOut(ctx, octx) {
+			mfs.log.Errorln("Indexing of archive", archive.fullPath, "timed out after", mfs.config.opTimeout)
+			return nil, fuse.EIO
+		}
+		return nil, err
+	}
+
+	// Zip members find their data through the index, after the request
+	// indexing the archive is done. Each read is bounded by the timeout.
+	r.ctx, r.timeout = context.Background(), mfs.config.opTimeout
+
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	// Indexed meanwhile by another request.
+	if other, ok := mfs.archives[key]; ok {
+		mfs.archiveUse.MoveToFront(other.used)
+		return other, nil
+	}
+
+	idx.used = mfs.archiveUse.PushFront(key)
+	mfs.archives[key] = idx
+	if mfs.archiveUse.Len() > maxArchiveIndexes {
+		delete(mfs.archives, mfs.archiveUse.Remove(mfs.archiveUse.Back()).(string))
+	}
+	return idx, nil
+}
+
+// indexArchive adds the members of the archive r reads to idx.
+func (mfs *MinFS) indexArchive(r *objectReaderAt, idx *archiveIndex) error {
+	archive := r.object
+
+	switch archive.format {
+	case "zip":
+		zr, err := zip.NewReader(r, archive.size)
+		if err != nil {
+			return err
+		}
+
+		for _, zf := range zr.File {
+			name, ok := memberName(zf.Name)
+			if !ok {
+				continue
+			}
+
+			idx.add(&archiveMember{
+				name:   name,
+				dir:    strings.HasSuffix(zf.Name, "/"),
+				size:   int64(zf.UncompressedSize64),
+				mtime:  zf.Modified,
+				offset: -1,
+				zf:     zf,
+			})
+		}
+	case "tar":
+		// A section reader seeks, so the data of members is skipped.
+		sr := io.NewSectionReader(r, 0, archive.size)
+		tr := tar.NewReader(sr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			name, ok := memberName(hdr.Name)
+			if !ok {
+				continue
+			}
+
+			switch hdr.Typeflag {
+			case tar.TypeDir:
+				idx.add(&archiveMember{name: name, dir: true, mtime: hdr.ModTime, offset: -1})
+			case tar.TypeReg, tar.TypeRegA:
+				offset, err := sr.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return err
+				}
+				idx.add(&archiveMember{name: name, size: hdr.Size, mtime: hdr.ModTime, offset: offset})
+			}
+		}
+	}
+
+	return nil
+}
+
+// ArchiveDir presents an archive, or a directory in it, as a directory.
+type ArchiveDir struct {
+	mfs *MinFS
+
+	archive *archiveObject
+
+	// path of the directory in the archive, "" for the archive itself
+	prefix string
+
+	Path  string
+	Inode uint64
+	Mtime time.Time
+
+	UID uint32
+	GID uint32
+}
+
+// Attr returns the attributes of the directory, members are read only.
+func (ad *ArchiveDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	*a = fuse.Attr{
+		Inode: ad.Inode,
+		Atime: ad.Mtime,
+		Mtime: ad.Mtime,
+		Ctime: ad.Mtime,
+		Mode:  ad.mfs.config.dirMode&^0222 | os.ModeDir,
+		Uid:   ad.UID,
+		Gid:   ad.GID,
+	}
+	return nil
+}
+
+// Dirent returns the fuse Dirent of the directory.
+func (ad ArchiveDir) Dirent() fuse.Dirent {
+	return fuse.Dirent{
+		Inode: ad.Inode, Name: ad.Path, Type: fuse.DT_Dir,
+	}
+}
+
+// Dirpath returns the name of the directory.
+func (ad ArchiveDir) Dirpath() string {
+	return ad.Path
+}
+
+// member returns the node of the member named name in the directory.
+func (ad *ArchiveDir) member(idx *archiveIndex, name string) (fs.Node, bool) {
+	m, ok := idx.members[path.Join(ad.prefix, name)]
+	if !ok {
+		return nil, false
+	}
+
+	fullPath := path.Join(ad.archive.fullPath, m.name)
+	if m.dir {
+		return &ArchiveDir{
+			mfs:     ad.mfs,
+			archive: ad.archive,
+			prefix:  m.name,
+			Path:    name,
+			Inode:   ad.mfs.inodes.inode(fullPath),
+			Mtime:   m.mtime,
+			UID:     ad.UID,
+			GID:     ad.GID,
+		}, true
+	}
+
+	return &ArchiveFile{
+		mfs:     ad.mfs,
+		archive: ad.archive,
+		member:  m,
+		Path:    name,
+		Inode:   ad.mfs.inodes.inode(fullPath),
+		UID:     ad.UID,
+		GID:     ad.GID,
+	}, true
+}
+
+// ReadDirAll returns the members of the directory.
+func (ad *ArchiveDir) ReadDirAll(ctx context.Context, uid uint32) (entries []fuse.Dirent, err error) {
+	idx, err := ad.mfs.archiveIndex(ctx, uid, ad.archive)
+	if err != nil {
+		ad.mfs.log.Errorln("Unable to index archive", ad.archive.fullPath, err)
+		return nil, fuse.EIO
+	}
+
+	for _, name := range idx.children[ad.prefix] {
+		m := idx.members[path.Join(ad.prefix, name)]
+
+		dirent := fuse.Dirent{
+			Inode: ad.mfs.inodes.inode(path.Join(ad.archive.fullPath, m.name)),
+			Name:  name,
+			Type:  fuse.DT_File,
+		}
+		if m.dir {
+			dirent.Type = fuse.DT_Dir
+		}
+		entries = append(entries, dirent)
+	}
+	return entries, nil
+}
+
+// Lookup returns the member named name in the directory.
+func (ad *ArchiveDir) Lookup(ctx context.Context, name string, uid uint32) (fs.Node, error) {
+	idx, err := ad.mfs.archiveIndex(ctx, uid, ad.archive)
+	if err != nil {
+		ad.mfs.log.Errorln("Unable to index archive", ad.archive.fullPath, err)
+		return nil, fuse.EIO
+	}
+
+	if node, ok := ad.member(idx, name); ok {
+		return node, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// ArchiveFile is a file in an archive.
+type ArchiveFile struct {
+	mfs *MinFS
+
+	archive *archiveObject
+	member  *archiveMember
+
+	Path  string
+	Inode uint64
+
+	UID uint32
+	GID uint32
+}
+
+// Attr returns the attributes of the member.
+func (af *ArchiveFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	*a = fuse.Attr{
+		Inode: af.Inode,
+		Size:  uint64(af.member.size),
+		Atime: af.member.mtime,
+		Mtime: af.member.mtime,
+		Ctime: af.member.mtime,
+		Mode:  af.mfs.config.mode &^ 0222,
+		Uid:   af.UID,
+		Gid:   af.GID,
+	}
+	return nil
+}
+
+// Open opens the member for reading, archives can't be written.
+func (af *ArchiveFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+
+	api, err := af.mfs.getBucketApi(ctx, req.Uid, af.archive.bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &archiveHandle{f: af, api: api, offset: af.member.offset}
+	h.r = &objectReaderAt{api: api, sse: af.mfs.sse(af.archive.bucket), object: af.archive, timeout: af.mfs.config.opTimeout}
+
+	if zf := af.member.zf; zf != nil {
+		switch zf.Method {
+		case zip.Store:
+		case zip.Deflate:
+			h.compressed = true
+		default:
+			af.mfs.log.Println("Unsupported compression of", af.member.name, "in archive", af.archive.fullPath)
+			return nil, fuse.Errno(syscall.ENOTSUP)
+		}
+
+		// Reads the local header of the member.
+		if h.offset, err = zf.DataOffset(); err != nil {
+			af.mfs.log.Errorln("Unable to open", af.member.name, "of archive", af.archive.fullPath, err)
+			return nil, fuse.EIO
+		}
+	}
+
+	return h, nil
+}
+
+// archiveHandle reads a member by range of the archive. Compressed members
+// are decompressed from one request for their data, reading on from the
+// last read.
+type archiveHandle struct {
+	f   *ArchiveFile
+	api *minio.Client
+
+	// offset of the data in the archive
+	offset     int64
+	compressed bool
+
+	// reads the data of members stored as is
+	r *objectReaderAt
+
+	mu     sync.Mutex
+	object *minio.Object
+	rc     io.ReadCloser
+	pos    int64
+}
+
+// Read reads the requested range of the member.
+func (h *archiveHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	m := h.f.member
+	if req.Offset >= m.size {
+		return nil
+	}
+
+	size := int64(req.Size)
+	if req.Offset+size > m.size {
+		size = m.size - req.Offset
+	}
+	buff := make([]byte, size)
+
+	var (
+		n   int
+		err error
+	)
+	if h.compressed {
+		n, err = h.readCompressed(buff, req.Offset)
+	} else {
+		n, err = h.r.readAt(ctx, buff, h.offset+req.Offset)
+	}
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		h.f.mfs.log.Errorln("Error reading", m.name, "of archive", h.f.archive.fullPath, err)
+		return fuse.EIO
+	}
+
+	resp.Data = buff[:n]
+	return nil
+}
+
+// readCompressed reads a compressed member at offset, reopening it when
+// reading backwards.
+func (h *archiveHandle) readCompressed(buff []byte, offset int64) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.rc != nil && offset < h.pos {
+		h.close()
+	}
+
+	if h.rc == nil {
+		zf := h.f.member.zf
+
+		opts := h.f.mfs.getOptions(h.f.archive.bucket)
+		if err := opts.SetRange(h.offset, h.offset+int64(zf.CompressedSize64)-1); err != nil {
+			return 0, err
+		}
+		if err := opts.SetMatchETag(h.f.archive.etag); err != nil {
+			return 0, err
+		}
+
+		// The reader outlives the request, it reads with no deadline.
+		object, err := h.api.GetObject(context.Background(), h.f.archive.bucket, h.f.archive.key, opts)
+		if err != nil {
+			return 0, err
+		}
+		h.object, h.rc, h.pos = object, flate.NewReader(object), 0
+	}
+
+	if skipped, err := io.CopyN(ioutil.Discard, h.rc, offset-h.pos); err != nil {
+		h.pos += skipped
+		return 0, err
+	}
+	h.pos = offset
+
+	n, err := io.ReadFull(h.rc, buff)
+	h.pos += int64(n)
+	return n, err
+}
+
+// Release closes the member.
+func (h *archiveHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.rc != nil {
+		h.close()
+	}
+	return nil
+}
+
+// close closes the compressed member, callers hold mu.
+func (h *archiveHandle) close() {
+	h.rc.Close()
+	h.object.Close()
+	h.rc, h.object = nil, nil
+}
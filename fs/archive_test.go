@@ -0,0 +1,147 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// tarOf returns a tar archive of n members of a few bytes each.
+func tarOf(t *testing.T, n int) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < n; i++ {
+		data := []byte(fmt.Sprintf("member %d", i))
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("m%02d", i), Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// countGets counts the reads of the object at key.
+func countGets(s3 *fakeS3, key string) *int32 {
+	var gets int32
+	s3.fail = func(r *http.Request) int {
+		if r.Method == http.MethodGet && r.URL.Path == "/bucket/"+key {
+			atomic.AddInt32(&gets, 1)
+		}
+		return 0
+	}
+	return &gets
+}
+
+func TestArchiveIndexedInOneRead(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "a.tar", tarOf(t, 50))
+	gets := countGets(s3, "a.tar")
+	mfs := newTestFS(t, s3, ArchiveMount([]string{".tar"}))
+
+	ctx := context.Background()
+	node, err := mfs.dirAt("bucket").lookup(ctx, "a.tar", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad, ok := node.(*ArchiveDir)
+	if !ok {
+		t.Fatalf("a.tar is a %T, expected an archive", node)
+	}
+
+	entries, err := ad.ReadDirAll(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 50 {
+		t.Fatalf("%d members listed, expected 50", len(entries))
+	}
+	if n := atomic.LoadInt32(gets); n != 1 {
+		t.Fatalf("archive read %d times to index it, expected once", n)
+	}
+
+	member, err := ad.Lookup(ctx, "m42", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := member.(*ArchiveFile).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &fuse.ReadResponse{}
+	if err = h.(*archiveHandle).Read(ctx, &fuse.ReadRequest{Size: 64}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "member 42" {
+		t.Fatalf("read %q, expected %q", resp.Data, "member 42")
+	}
+}
+
+func TestArchiveIndexesUsedLastKept(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	data := tarOf(t, 1)
+	for i := 0; i <= maxArchiveIndexes; i++ {
+		s3.put("bucket", fmt.Sprintf("%02d.tar", i), data)
+	}
+	mfs := newTestFS(t, s3, ArchiveMount([]string{".tar"}))
+
+	ctx := context.Background()
+	index := func(i int) *archiveIndex {
+		key := fmt.Sprintf("%02d.tar", i)
+		archive := &archiveObject{bucket: "bucket", key: key, etag: s3.etag("bucket", key), size: int64(len(data)), format: "tar", fullPath: "bucket/" + key}
+		idx, err := mfs.archiveIndex(ctx, 0, archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+
+	// The first is used again before the cache fills, the second is the
+	// one used least recently.
+	first := index(0)
+	index(1)
+	for i := 2; i < maxArchiveIndexes; i++ {
+		index(i)
+	}
+	if index(0) != first {
+		t.Fatal("index of an archive not kept while the cache isn't full")
+	}
+	index(maxArchiveIndexes)
+
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+	if len(mfs.archives) != maxArchiveIndexes || mfs.archiveUse.Len() != maxArchiveIndexes {
+		t.Fatalf("%d indexes kept, expected %d", len(mfs.archives), maxArchiveIndexes)
+	}
+	if _, ok := mfs.archives["bucket/01.tar@"+s3.etag("bucket", "01.tar")]; ok {
+		t.Fatal("index used least recently kept")
+	}
+	if _, ok := mfs.archives["bucket/00.tar@"+s3.etag("bucket", "00.tar")]; !ok {
+		t.Fatal("index used recently evicted")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+var errBlockKey = errors.New("block cache file is sealed, and no cache encryption key is set")
+
+// blockCached returns if read only opens cache object in a block cache
+// file, when it is sealed or compressed.
+func (mfs *MinFS) blockCached(object minio.ObjectInfo) bool {
+	return mfs.config.cacheCipher != nil || (mfs.config.cacheCompression != "" && compressible(object))
+}
+
+// blockCodec encodes and decodes the blocks of a block cache file, the
+// block files of compress.go. Sealed, every block is sealed with AES-GCM
+// once compressed, and the nonce of the file is kept in the index.
+type blockCodec struct {
+	compress bool
+
+	// seals the blocks when set, under nonces derived from the nonce of
+	// the file, bound to their number and the size of the object
+	aead  cipher.AEAD
+	nonce []byte
+	size  int64
+}
+
+// newBlockCodec returns the codec of a block cache file with flags, holding
+// an object of size, its nonce to be read from the index.
+func newBlockCodec(flags uint32, size int64, aead cipher.AEAD) (*blockCodec, error) {
+	codec := &blockCodec{compress: flags&blockCompressed != 0, size: size}
+	if flags&blockSealed != 0 {
+		if aead == nil {
+			return nil, errBlockKey
+		}
+		codec.aead = aead
+		codec.nonce = make([]byte, aead.NonceSize())
+	}
+	return codec, nil
+}
+
+// newNonce draws the nonce of a file to seal.
+func (c *blockCodec) newNonce() error {
+	if c.aead == nil {
+		return nil
+	}
+	c.nonce = make([]byte, c.aead.NonceSize())
+	_, err := io.ReadFull(crand.Reader, c.nonce)
+	return err
+}
+
+func (c *blockCodec) flags() uint32 {
+	var flags uint32
+	if c.compress {
+		flags |= blockCompressed
+	}
+	if c.aead != nil {
+		flags |= blockSealed
+	}
+	return flags
+}
+
+// blockNonce returns the nonce of block i, the nonce of the file with the
+// block number xored into its last bytes.
+func (c *blockCodec) blockNonce(i int) []byte {
+	nonce := append([]byte(nil), c.nonce...)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^uint64(i))
+	return nonce
+}
+
+// blockData returns the data authenticated with block i, so blocks can't
+// be moved nor the file cut.
+func (c *blockCodec) blockData(i int) []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data[0:], uint64(i))
+	binary.BigEndian.PutUint64(data[8:], uint64(c.size))
+	return data
+}
+
+func (c *blockCodec) encode(i int, block []byte) []byte {
+	frame := block
+	if c.compress {
+		frame = zstdEncoder.EncodeAll(block, nil)
+	}
+	if c.aead != nil {
+		frame = c.aead.Seal(nil, c.blockNonce(i), frame, c.blockData(i))
+	}
+	return frame
+}
+
+// decode returns block i stored as frame, in dst when it fits.
+func (c *blockCodec) decode(i int, frame, dst []byte) ([]byte, error) {
+	var err error
+	if c.aead != nil {
+		if frame, err = c.aead.Open(frame[:0], c.blockNonce(i), frame, c.blockData(i)); err != nil {
+			return nil, err
+		}
+	}
+	if c.compress {
+		return zstdDecoder.DecodeAll(frame, dst[:0])
+	}
+	return append(dst[:0], frame...), nil
+}
+
+// sealCache seals the cache file at cachePath, left in the clear by the
+// writers of the version with etag of key, into its block cache file and
+// removes it, read only opens read the sealed file after. Nothing is left
+// in the clear once the last writable handle closes.
+func (mfs *MinFS) sealCache(cachePath, key, etag string) {
+	if mfs.config.cacheCipher == nil {
+		return
+	}
+	blockPath := blockCachePath(cachePath)
+
+	// Locked in order, as in moveCache.
+	unlockFirst := mfs.km.Lock(blockPath)
+	defer unlockFirst()
+	unlockSecond := mfs.km.Lock(cachePath)
+	defer unlockSecond()
+
+	src, err := mfs.openLocal(cachePath, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		mfs.log.Errorln("Unable to seal cache file", cachePath, err)
+		return
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err == nil {
+		err = mfs.writeSealed(src, blockPath, minio.ObjectInfo{Key: key, Size: info.Size()})
+	}
+	if err != nil {
+		mfs.log.Errorln("Unable to seal cache file", cachePath, err)
+	} else if info, err = mfs.statLocal(blockPath); err == nil {
+		mfs.cacheAdded(blockPath, info)
+		mfs.recordCache(blockPath, key, etag)
+	}
+
+	// Handles still reading it keep the file, it is gone from the cache.
+	if err = os.Remove(cachePath); err != nil && !os.IsNotExist(err) {
+		mfs.log.Errorln("Unable to remove cache file", cachePath, err)
+		return
+	}
+	mfs.cacheRemoved(cachePath)
+	mfs.forgetContent(etag, cachePath)
+	mfs.unrecordCache(cachePath)
+}
+
+// writeSealed writes the object read from r to the block cache file at
+// path, aside until complete.
+func (mfs *MinFS) writeSealed(r io.Reader, path string, object minio.ObjectInfo) error {
+	codec := &blockCodec{
+		compress: mfs.config.cacheCompression != "" && compressible(object),
+		aead:     mfs.config.cacheCipher,
+		size:     object.Size,
+	}
+	if err := codec.newNonce(); err != nil {
+		return err
+	}
+
+	tmpPath := path + parallelTmpExt
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := newBlockWriter(tmp, codec)
+	if _, err = io.Copy(w, r); err == nil {
+		err = w.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
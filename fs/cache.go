@@ -17,75 +17,350 @@ package minfs
 
 import (
 	"fmt"
-	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"syscall"
 	"time"
+
+	"bazil.org/fuse"
 )
 
 // File implements both Node and Handle for the hello file.
 type CacheItem struct {
-	Path    string
-	Size    float64
-	ModTime time.Time
+	Path       string
+	Size       int64
+	ModTime    time.Time
+	AccessTime time.Time
+
+	// the file linked at Path, zero when links aren't told apart
+	file fileKey
+}
+
+// fileKey identifies a file, with the device and inode of its links.
+type fileKey struct {
+	dev uint64
+	ino uint64
+}
+
+// cacheItemOf returns the item of the cache file at path with info.
+func cacheItemOf(path string, info os.FileInfo) CacheItem {
+	file, _ := fileKeyOf(info)
+	return CacheItem{
+		Path:       path,
+		Size:       diskSize(info),
+		ModTime:    info.ModTime(),
+		AccessTime: accessTime(info),
+		file:       file,
+	}
+}
+
+// cacheIndex accounts the files of a cache directory as they are added and
+// evicted, so checking the quota doesn't walk the directory. Guarded by
+// mfs.m.
+type cacheIndex struct {
+	items map[string]CacheItem
+	size  int64
+
+	// paths accounted of every file linked more than once, the bytes of a
+	// file are accounted once
+	links map[fileKey]int
+
+	// when the index was last rebuilt from the directory, zero if never
+	reconciled time.Time
+}
+
+// cacheDirs returns every cache directory, the cache first.
+func (mfs *MinFS) cacheDirs() []string {
+	dirs := []string{mfs.config.cache}
+	for _, bc := range mfs.config.bucketCaches {
+		dirs = append(dirs, bc.dir)
+	}
+	return dirs
+}
+
+// cacheIndexFor returns the index of the cache directory holding path,
+// callers hold mfs.m.
+func (mfs *MinFS) cacheIndexFor(path string) *cacheIndex {
+	if dir, ok := mfs.cacheDirFor(path); ok {
+		return mfs.cacheIndexOf(dir)
+	}
+	return nil
+}
+
+// cacheDirFor returns the cache directory holding path. Cache directories
+// don't nest, so at most one does.
+func (mfs *MinFS) cacheDirFor(path string) (string, bool) {
+	for _, dir := range mfs.cacheDirs() {
+		if dir = filepath.Clean(dir); strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// cacheIndexOf returns the index of the cache directory dir, callers hold
+// mfs.m.
+func (mfs *MinFS) cacheIndexOf(dir string) *cacheIndex {
+	idx, ok := mfs.caches[dir]
+	if !ok {
+		idx = &cacheIndex{items: map[string]CacheItem{}, links: map[fileKey]int{}}
+		mfs.caches[dir] = idx
+	}
+	return idx
+}
+
+// add accounts item, replacing the item accounted at its path. The bytes
+// of a file linked at several paths are accounted with its first link.
+func (idx *cacheIndex) add(item CacheItem) {
+	idx.remove(item.Path)
+	idx.items[item.Path] = item
+
+	if item.file != (fileKey{}) {
+		idx.links[item.file]++
+		if idx.links[item.file] > 1 {
+			return
+		}
+	}
+	idx.size += item.Size
+}
+
+// remove drops the item accounted at path, and returns the bytes freed by
+// removing it: none while the file is linked at another path.
+func (idx *cacheIndex) remove(path string) int64 {
+	item, ok := idx.items[path]
+	if !ok {
+		return 0
+	}
+	delete(idx.items, path)
+
+	if item.file != (fileKey{}) {
+		idx.links[item.file]--
+		if idx.links[item.file] > 0 {
+			return 0
+		}
+		delete(idx.links, item.file)
+	}
+	idx.size -= item.Size
+	return item.Size
+}
+
+// reset replaces the items accounted with items.
+func (idx *cacheIndex) reset(items []CacheItem) {
+	idx.items = make(map[string]CacheItem, len(items))
+	idx.links = map[fileKey]int{}
+	idx.size = 0
+	for _, item := range items {
+		item.Path = filepath.Clean(item.Path)
+		idx.add(item)
+	}
+}
+
+// cacheAdded accounts the cache file at path, replacing what was accounted
+// for it before.
+func (mfs *MinFS) cacheAdded(path string, info os.FileInfo) {
+	path = filepath.Clean(path)
+	if !isCacheFile(path) {
+		return
+	}
+
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	idx := mfs.cacheIndexFor(path)
+	if idx == nil {
+		return
+	}
+
+	idx.add(cacheItemOf(path, info))
+}
+
+// cacheAccessed marks the accounted cache file at path as used at t.
+func (mfs *MinFS) cacheAccessed(path string, t time.Time) {
+	path = filepath.Clean(path)
+
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	if idx := mfs.cacheIndexFor(path); idx != nil {
+		if item, ok := idx.items[path]; ok {
+			item.AccessTime = t
+			idx.items[path] = item
+		}
+	}
+}
+
+// cacheRemoved drops the cache file at path from the accounting, and
+// returns the bytes its removal freed.
+func (mfs *MinFS) cacheRemoved(path string) (freed int64) {
+	path = filepath.Clean(path)
+
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	if idx := mfs.cacheIndexFor(path); idx != nil {
+		freed = idx.remove(path)
+	}
+
+	// The ranges of an evicted sparse file are gone with it.
+	delete(mfs.ranges, path)
+	return freed
 }
 
-// Return cache items for cache directory
-func DirSize(path string) ([]CacheItem, float64, error) {
-	var totalSize float64
+// cacheUsage returns the quota of every cache directory together, and the
+// bytes and files accounted in them. A bucket cache directory without a
+// quota of its own has the quota of the cache.
+func (mfs *MinFS) cacheUsage() (quota, used int64, files int) {
+	dirs := []string{mfs.config.cache}
+	quota = mfs.config.quota
+	for _, bc := range mfs.config.bucketCaches {
+		dirs = append(dirs, bc.dir)
+		if bc.quota > 0 {
+			quota += bc.quota
+		} else {
+			quota += mfs.config.quota
+		}
+	}
+
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	for _, dir := range dirs {
+		idx := mfs.cacheIndexOf(filepath.Clean(dir))
+		used += idx.size
+		files += len(idx.items)
+	}
+	return quota, used, files
+}
+
+// isCacheFile returns if path is a cache file: an object cached whole, or
+// the sparse file of an object read by range.
+func isCacheFile(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == globalCacheExt || ext == globalRangeCacheExt || ext == globalBlockCacheExt
+}
+
+// cacheItems returns the files accounted in the cache directory dir, least
+// recently used first, and their size in bytes. The index is rebuilt from
+// the directory when it wasn't for globalCacheReconcile, correcting the
+// drift of files changed in place and removed behind our back.
+func (mfs *MinFS) cacheItems(dir string) ([]CacheItem, int64, error) {
+	dir = filepath.Clean(dir)
+
+	mfs.m.Lock()
+	idx := mfs.cacheIndexOf(dir)
+	stale := time.Since(idx.reconciled) >= globalCacheReconcile
+	mfs.m.Unlock()
+
+	if stale {
+		items, _, err := DirSize(dir)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		mfs.m.Lock()
+		idx.reset(items)
+		size := idx.size
+		idx.reconciled = time.Now()
+		mfs.m.Unlock()
+
+		return items, size, nil
+	}
+
+	mfs.m.Lock()
+	items := make([]CacheItem, 0, len(idx.items))
+	for _, item := range idx.items {
+		items = append(items, item)
+	}
+	size := idx.size
+	mfs.m.Unlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].AccessTime.Before(items[j].AccessTime)
+	})
+
+	return items, size, nil
+}
+
+// Return cache items for cache directory, and their size in bytes
+func DirSize(path string) ([]CacheItem, int64, error) {
+	var totalSize int64
 	var items []CacheItem
 
 	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && filepath.Ext(path) == ".fcache" {
-			sizeGB := float64(info.Size()) / math.Pow(1024.0, 3.0)
-
-			f := CacheItem{Path: path, Size: sizeGB, ModTime: info.ModTime()}
-			totalSize += sizeGB
+		if !info.IsDir() && isCacheFile(path) {
+			f := cacheItemOf(path, info)
+			totalSize += f.Size
 			items = append(items, f)
 		}
 		return err
 	})
 
+	// Least recently used first, the modification time is when the file
+	// was downloaded.
 	sort.Slice(items[:], func(i, j int) bool {
-		return items[i].ModTime.Before(items[j].ModTime)
+		return items[i].AccessTime.Before(items[j].AccessTime)
 	})
 
 	return items, totalSize, err
 }
 
-// Deletes cache items until size quota is satisified
-func (mfs *MinFS) DeleteUntilQuota(items []CacheItem, quota float64) {
-	for _, item := range items {
-		// Lock the cache resource until we are done deleting
-		unlock := mfs.km.Lock(item.Path)
-
-		// Need to lock the map as we check..
-		used := false
-		mfs.m.Lock()
+// cacheInUse returns if the cache file at path is open or being downloaded
+// to, or is the file aside a download in progress writes to. Callers hold
+// the km lock of path, so it stays unused until released.
+func (mfs *MinFS) cacheInUse(path string) bool {
+	// Need to lock the map as we check..
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
 
-		// Search for open file handles that are using our cache resource
-		for _, cachePath := range mfs.openfds {
-			used = used || (cachePath == item.Path)
-			if used {
-				break // Hold the map lock for as short as possible
+	// Files being downloaded to aren't open yet, but are just as much in use,
+	// as are the files aside they're downloaded to, named after them.
+	if mfs.downloads[filepath.Clean(path)] > 0 {
+		return true
+	}
+	if isPartialCacheFile(path) {
+		for download := range mfs.downloads {
+			if strings.HasPrefix(filepath.Clean(path), download) {
+				return true
 			}
 		}
-		mfs.m.Unlock()
+	}
 
-		// Since we've locked the cache resource, no new FDs can be created for this resource until we are done
-		if !used {
-			os.Remove(item.Path)
-			quota -= item.Size
+	// Search for open file handles that are using our cache resource
+	for _, cachePath := range mfs.openfds {
+		if cachePath == path {
+			return true
 		}
+	}
 
-		// This allows a new open request to re-create the cache resource and serve a new file handle
-		unlock()
+	// Writes not uploaded yet are only in the cache.
+	for _, ws := range mfs.writers {
+		if ws.cachePath == path && ws.dirty {
+			return true
+		}
+	}
+	return false
+}
 
-		if quota < 0 {
+// Deletes cache items until quota bytes are freed, and drops them from
+// the persisted index at once.
+func (mfs *MinFS) DeleteUntilQuota(items []CacheItem, quota int64) {
+	var evicted []string
+	defer func() {
+		mfs.unrecordCache(evicted...)
+	}()
+
+	for _, item := range items {
+		if freed, ok := mfs.evictCache(item.Path); ok {
+			evicted = append(evicted, item.Path)
+			quota -= freed
+		}
+
+		if quota <= 0 {
 			break
 		}
 
@@ -93,25 +368,417 @@ func (mfs *MinFS) DeleteUntilQuota(items []CacheItem, quota float64) {
 
 }
 
-// Go routine to monitor cache at regular intervals and preform cleanup as needed
-func (mfs *MinFS) MonitorCache() {
-	fmt.Println("Starting cache monitor: quota =", mfs.config.quota, "GB")
+// evictCache removes the cache file at path unless it is in use, pinned or
+// holds writes not uploaded yet, and returns the bytes freed. Callers drop
+// the file from the persisted index.
+func (mfs *MinFS) evictCache(path string) (freed int64, ok bool) {
+	// Lock the cache resource until we are done deleting
+	unlock := mfs.km.Lock(path)
+
+	// This allows a new open request to re-create the cache resource and serve a new file handle
+	defer unlock()
+
+	// Since we've locked the cache resource, no new FDs can be created for this resource until we are done
+	if mfs.cacheInUse(path) || mfs.cachePinned(path) || mfs.stagedCachePaths()[filepath.Clean(path)] {
+		return 0, false
+	}
+
+	os.Remove(path)
+	freed = mfs.cacheRemoved(path)
+	mfs.forgetCacheBucket(path)
+	mfs.metrics.evicted(freed)
+	return freed, true
+}
+
+// reserveCache makes room for size bytes in the cache directory of bucket
+// before a download, evicting down to the low watermark when they don't
+// fit in the quota. The download fails with ENOSPC when the files in use
+// leave no room, instead of filling the disk. Downloads in flight take
+// their room once complete.
+func (mfs *MinFS) reserveCache(bucket string, size int64) error {
+	dir, quota := filepath.Clean(mfs.cacheDir(bucket)), mfs.cacheQuota(bucket)
+
+	used := mfs.cacheUsed(dir)
+	if used+size <= quota {
+		return nil
+	}
+
+	items, used, err := mfs.cacheItems(dir)
+	if err != nil {
+		mfs.log.Errorln("Error in lstating cache directory", dir, "...it's likely in flux:", err)
+		return nil
+	}
+	mfs.DeleteUntilQuota(items, used+size-int64(float64(quota)*mfs.config.lowWatermark))
+
+	if used = mfs.cacheUsed(dir); used+size <= quota {
+		return nil
+	}
+
+	mfs.log.Errorln("Cache FULL:", dir, "Size:", humanSize(used), "of", humanSize(quota), "no room for", humanSize(size), "Open Files:", mfs.openFiles())
+	mfs.logPinned(dir)
+	return fuse.Errno(syscall.ENOSPC)
+}
+
+// cacheUsed returns the bytes accounted in the cache directory dir.
+func (mfs *MinFS) cacheUsed(dir string) int64 {
+	mfs.m.Lock()
 	defer mfs.m.Unlock()
 
-	MAX_SIZE := float64(mfs.config.quota)
+	return mfs.cacheIndexOf(dir).size
+}
+
+// logPinned logs the pinned files, open handles and downloads holding cache
+// files of the cache directory dir, which eviction can't remove.
+func (mfs *MinFS) logPinned(dir string) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	idx := mfs.cacheIndexOf(dir)
+	for cachePath := range mfs.pinned {
+		if item, ok := idx.items[cachePath]; ok {
+			mfs.log.Println("Cache file", item.Path, "of", humanSize(item.Size), "is pinned")
+		}
+	}
+	for handle, cachePath := range mfs.openfds {
+		if item, ok := idx.items[filepath.Clean(cachePath)]; ok {
+			mfs.log.Println("Cache file", item.Path, "of", humanSize(item.Size), "is pinned by handle", handle)
+		}
+	}
+	for cachePath := range mfs.downloads {
+		if strings.HasPrefix(cachePath, dir+string(filepath.Separator)) {
+			mfs.log.Println("Cache file", cachePath, "is pinned by a download")
+		}
+	}
+}
+
+// purgeCache removes the cache file at path of an object gone, unless it is
+// in use. A file in use is evicted once it isn't, as nothing reads it again.
+func (mfs *MinFS) purgeCache(path string) {
+	unlock := mfs.km.Lock(path)
+	defer unlock()
+
+	if mfs.cacheInUse(path) {
+		return
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		mfs.log.Errorln("Unable to remove cache file", path, err)
+		return
+	}
+	mfs.cacheRemoved(path)
+	mfs.forgetCacheBucket(path)
+	mfs.unrecordCache(path)
+}
+
+// moveCache moves the cache file at from to to. Handles open on it keep
+// reading and writing the file under its new name. A file being downloaded
+// to isn't moved, nor over a file in use.
+func (mfs *MinFS) moveCache(from, to string) {
+	if from == to {
+		return
+	}
+
+	// Locked in order, as opens lock one at a time.
+	first, second := from, to
+	if second < first {
+		first, second = second, first
+	}
+	unlockFirst := mfs.km.Lock(first)
+	defer unlockFirst()
+	unlockSecond := mfs.km.Lock(second)
+	defer unlockSecond()
+
+	mfs.m.Lock()
+	downloading := mfs.downloads[filepath.Clean(from)] > 0
+	mfs.m.Unlock()
+
+	if downloading || mfs.cacheInUse(to) {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+		mfs.log.Errorln("Unable to move cache file", from, err)
+		return
+	}
+
+	if err := os.Rename(from, to); err != nil {
+		if !os.IsNotExist(err) {
+			mfs.log.Errorln("Unable to move cache file", from, err)
+		}
+		return
+	}
+
+	// Open handles hold the file under its new name now.
+	mfs.m.Lock()
+	for handle, cachePath := range mfs.openfds {
+		if cachePath == from {
+			mfs.openfds[handle] = to
+		}
+	}
+	for _, ws := range mfs.writers {
+		if ws.cachePath == from {
+			ws.cachePath = to
+		}
+	}
+	mfs.m.Unlock()
+
+	mfs.cacheRemoved(from)
+	if info, err := mfs.statLocal(to); err == nil {
+		mfs.cacheAdded(to, info)
+	}
+}
+
+// touchCache marks the cache file at path as used now, so eviction keeps
+// it over files used less recently. Access times aren't updated by reads
+// on most mounts, so hits update them explicitly.
+func (mfs *MinFS) touchCache(path string, info os.FileInfo) error {
+	now := time.Now().Local()
+	mtime := now
+	if haveAccessTime {
+		mtime = info.ModTime()
+	}
+	mfs.cacheAccessed(path, now)
+	return mfs.retryLocal(func() error {
+		return os.Chtimes(path, now, mtime)
+	})
+}
+
+// checkCache evicts the least recently used files of the cache directory
+// dir once above the high watermark of quota bytes, down to the low
+// watermark.
+func (mfs *MinFS) checkCache(dir string, quota int64) {
+	items, size, err := mfs.cacheItems(dir)
+	if err != nil {
+		mfs.log.Errorln("Error in lstating cache directory", dir, "...it's likely in flux:", err)
+		return
+	}
+
+	mfs.metrics.cacheSize(dir, size, len(items))
+
+	// Buckets above their share are evicted down to it first.
+	if filepath.Clean(dir) == filepath.Clean(mfs.config.cache) && mfs.checkBucketQuotas(items) {
+		if items, size, err = mfs.cacheItems(dir); err != nil {
+			mfs.log.Errorln("Error in lstating cache directory", dir, "...it's likely in flux:", err)
+			return
+		}
+	}
+
+	if size <= int64(float64(quota)*mfs.config.highWatermark) {
+		mfs.log.Println("Cache OK:", dir, "Cache files:", len(items), "Size:", humanSize(size), "of", humanSize(quota), "Open Files:", mfs.openFiles())
+	} else {
+		mfs.log.Println("Cache OVERLOAD:", dir, "Cache files:", len(items), "Size:", humanSize(size), "of", humanSize(quota), "Open Files:", mfs.openFiles())
+		mfs.DeleteUntilQuota(mfs.overShareFirst(items), size-int64(float64(quota)*mfs.config.lowWatermark))
+	}
+}
+
+// bucketItems returns the items of the buckets with a cache quota, by
+// bucket, in the order of items. Cache files the mount didn't open since
+// it started aren't known to belong to a bucket, only the quota of the
+// cache evicts them.
+func (mfs *MinFS) bucketItems(items []CacheItem) map[string][]CacheItem {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	byBucket := map[string][]CacheItem{}
+	for _, item := range items {
+		if bucket, ok := mfs.cacheBuckets[filepath.Clean(item.Path)]; ok {
+			byBucket[bucket] = append(byBucket[bucket], item)
+		}
+	}
+	return byBucket
+}
+
+// checkBucketQuotas evicts the least recently used files of every bucket
+// above the high watermark of its quota, down to the low watermark. It
+// returns if any bucket was evicted.
+func (mfs *MinFS) checkBucketQuotas(items []CacheItem) bool {
+	if len(mfs.config.bucketQuotas) == 0 {
+		return false
+	}
+
+	var evicted bool
+	for bucket, bucketItems := range mfs.bucketItems(items) {
+		quota := mfs.config.bucketQuotas[bucket]
+
+		var size int64
+		for _, item := range bucketItems {
+			size += item.Size
+		}
+
+		if size <= int64(float64(quota)*mfs.config.highWatermark) {
+			continue
+		}
+
+		mfs.log.Println("Bucket cache OVERLOAD:", bucket, "Cache files:", len(bucketItems), "Size:", humanSize(size), "of", humanSize(quota))
+		mfs.DeleteUntilQuota(bucketItems, size-int64(float64(quota)*mfs.config.lowWatermark))
+		evicted = true
+	}
+	return evicted
+}
+
+// overShareFirst orders items for eviction with the files of buckets above
+// their quota first, each group least recently used first.
+func (mfs *MinFS) overShareFirst(items []CacheItem) []CacheItem {
+	if len(mfs.config.bucketQuotas) == 0 {
+		return items
+	}
+
+	over := map[string]bool{}
+	for bucket, bucketItems := range mfs.bucketItems(items) {
+		var size int64
+		for _, item := range bucketItems {
+			size += item.Size
+		}
+		over[bucket] = size > mfs.config.bucketQuotas[bucket]
+	}
+
+	mfs.m.Lock()
+	overShare := func(item CacheItem) bool {
+		return over[mfs.cacheBuckets[filepath.Clean(item.Path)]]
+	}
+	ordered := make([]CacheItem, len(items))
+	copy(ordered, items)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return overShare(ordered[i]) && !overShare(ordered[j])
+	})
+	mfs.m.Unlock()
+
+	return ordered
+}
+
+// forgetCacheBucket drops the bucket of the cache file at path once it is
+// removed.
+func (mfs *MinFS) forgetCacheBucket(path string) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	delete(mfs.cacheBuckets, filepath.Clean(path))
+}
+
+// isPartialCacheFile returns if path is left by a download cut short: a
+// download to a file aside, renamed once complete, or a sparse file whose
+// ranges were only known to an earlier mount.
+func isPartialCacheFile(path string) bool {
+	for _, ext := range []string{".part.minio", peerTmpExt, parallelTmpExt, globalRangeCacheExt} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweepCache removes what crashed downloads left in the cache directory
+// dir, empty cache files, as left by a crash before their data reached the
+// disk, and cache files with names the current scheme doesn't make, as left
+// by an earlier one. With orphans swept, the cache files of versions gone
+// from the servers are removed too. An empty object cached is fetched
+// again. It runs before the mount serves requests, so no file is in use.
+func (mfs *MinFS) sweepCache(dir string) {
+	var buckets []string
+	if mfs.config.sweepOrphans {
+		var err error
+		if buckets, err = mfs.sweepBuckets(dir); err != nil {
+			mfs.log.Errorln("Unable to list the buckets cached in", dir, "orphans are kept", err)
+		}
+	}
+
+	var removed, orphans int
+	var reclaimed int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		orphan := false
+		if !isPartialCacheFile(path) {
+			if !isCacheFile(path) {
+				return nil
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return nil
+			}
+			rel = filepath.ToSlash(rel)
+
+			if info.Size() > 0 && mfs.cacheNameValid(rel) {
+				if orphan = len(buckets) > 0 && mfs.cacheOrphaned(buckets, rel); !orphan {
+					return nil
+				}
+			}
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			mfs.log.Errorln("Unable to remove stale cache file", path, err)
+			return nil
+		}
+		removed++
+		if orphan {
+			orphans++
+		}
+		reclaimed += diskSize(info)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		mfs.log.Errorln("Unable to sweep cache directory", dir, err)
+	}
+	if removed > 0 {
+		mfs.log.Println("Removed", removed, "stale cache files from", dir, "of which", orphans, "orphans, reclaiming", humanSize(reclaimed))
+	}
+}
+
+// humanSize formats size bytes in the largest binary unit it has one of.
+func humanSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+
+	value, unit := float64(size), 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// Go routine to monitor cache at regular intervals and preform cleanup as
+// needed, until done is closed.
+func (mfs *MinFS) MonitorCache(done <-chan struct{}) {
+	mfs.log.Println("Starting cache monitor: quota =", humanSize(mfs.config.quota))
+
+	MAX_SIZE := mfs.config.quota
 
 	for {
 		select {
+		case <-done:
+			mfs.log.Println("Stopping cache monitor")
+			return
 
 		case <-time.After(30 * time.Second):
-			items, size, err := DirSize(mfs.config.cache)
-			if err != nil {
-				mfs.log.Println("Error in lstating cache directory...it's likely in flux:", err)
-			} else if size <= MAX_SIZE {
-				mfs.log.Println("Cache OK: Cache files:", len(items), "Size:", size, "GB Open Files:", len(mfs.openfds))
-			} else {
-				mfs.log.Println("Cache OVERLOAD: Cache files:", len(items), "Size:", size, "GB Open Files:", len(mfs.openfds))
-				mfs.DeleteUntilQuota(items, size-MAX_SIZE)
+			if mfs.limiter != nil {
+				mfs.log.Println("Request rate:", mfs.limiter.Rate(), "/s, limit:", mfs.config.maxRequests, "/s")
+			}
+
+			if retried, shed := mfs.retries.Stats(); retried > 0 || shed > 0 {
+				mfs.log.Println("Retries:", retried, "done,", shed, "refused by the retry budget")
+			}
+
+			mfs.metrics.openFiles(mfs.openFiles())
+
+			mfs.checkCache(mfs.config.cache, MAX_SIZE)
+
+			// Bucket cache directories are evicted by their own quota.
+			for _, bc := range mfs.config.bucketCaches {
+				quota := MAX_SIZE
+				if bc.quota > 0 {
+					quota = bc.quota
+				}
+				mfs.checkCache(bc.dir, quota)
 			}
 
 		}
@@ -0,0 +1,187 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// etag returns the etag of the object key of bucket.
+func (s3 *fakeS3) etag(bucket, key string) string {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	return s3.buckets[bucket][key].etag
+}
+
+func TestEvictionSparesDownload(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1<<20)
+
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "object", data)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	s3.fail = func(r *http.Request) int {
+		if r.Method == http.MethodGet && r.URL.Path == "/bucket/object" {
+			close(started)
+			<-release
+		}
+		return 0
+	}
+	mfs := newTestFS(t, s3)
+
+	ctx := context.Background()
+	node, err := mfs.dirAt("bucket").lookup(ctx, "object", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachePath := mfs.cachePath("bucket", "object", s3.etag("bucket", "object"))
+
+	opened := make(chan *FileHandle)
+	go func() {
+		h, err := node.(*File).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Error(err)
+		}
+		fh, _ := h.(*FileHandle)
+		opened <- fh
+	}()
+
+	// The download writes to a file aside, no one holds its key lock. It's
+	// skipped by eviction as the download is in progress.
+	<-started
+	parts, _ := filepath.Glob(cachePath + "*")
+	var part string
+	for _, p := range parts {
+		if isPartialCacheFile(p) {
+			part = p
+		}
+	}
+	if part == "" {
+		close(release)
+		t.Fatalf("no file aside the download in %v", parts)
+	}
+
+	if _, ok := mfs.evictCache(part); ok {
+		t.Error("file aside the download evicted")
+	}
+	mfs.DeleteUntilQuota([]CacheItem{{Path: part, Size: int64(len(data))}}, 1)
+	if _, err := os.Stat(part); err != nil {
+		t.Errorf("file aside the download gone: %v", err)
+	}
+	close(release)
+
+	fh := <-opened
+	if fh == nil {
+		t.FailNow()
+	}
+
+	cached, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, data) {
+		t.Fatalf("cache file has %d bytes of the %d of the object", len(cached), len(data))
+	}
+
+	// Open, it's kept.
+	if _, ok := mfs.evictCache(cachePath); ok {
+		t.Fatal("file evicted once downloaded, while open")
+	}
+
+	// Once closed it can go.
+	fh.Release(ctx, &fuse.ReleaseRequest{})
+	if _, ok := mfs.evictCache(cachePath); !ok {
+		t.Fatal("file not evicted once closed")
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Fatalf("cache file left after eviction: %v", err)
+	}
+}
+
+func TestMonitorCacheStops(t *testing.T) {
+	mfs := newTestFS(t, newFakeS3(t))
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		mfs.MonitorCache(done)
+		close(stopped)
+	}()
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cache monitor still running once stopped")
+	}
+}
+
+func TestShortCacheFileFetchedAgain(t *testing.T) {
+	data := []byte("the whole object")
+
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "object", data)
+
+	var gets int32
+	s3.fail = func(r *http.Request) int {
+		if r.Method == http.MethodGet && r.URL.Path == "/bucket/object" {
+			atomic.AddInt32(&gets, 1)
+		}
+		return 0
+	}
+	mfs := newTestFS(t, s3)
+
+	// Left by a download cut short.
+	cachePath := mfs.cachePath("bucket", "object", s3.etag("bucket", "object"))
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cachePath, data[:4], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	node, err := mfs.dirAt("bucket").lookup(ctx, "object", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := node.(*File).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{})
+
+	if gets := atomic.LoadInt32(&gets); gets != 1 {
+		t.Fatalf("object fetched %d times, expected once", gets)
+	}
+	resp := &fuse.ReadResponse{}
+	if err = h.(*FileHandle).Read(ctx, &fuse.ReadRequest{Size: 64}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Data, data) {
+		t.Fatalf("read %q from the cache file, expected %q", resp.Data, data)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+// globalCacheIndexBucket is the bucket of the meta store the cache index is
+// persisted in: a bucket of records for every cache directory, and whether
+// the last mount shut down cleanly, by directory.
+const globalCacheIndexBucket = "cache/"
+
+// cacheRecord is a cache file as persisted in the cache index, keyed by its
+// path relative to the cache directory.
+type cacheRecord struct {
+	Size       int64
+	ModTime    time.Time
+	AccessTime time.Time
+
+	// the object version cached, empty when unknown
+	Key  string
+	ETag string
+}
+
+// cacheRecords returns the records of the cache directory dir, made when
+// missing.
+func cacheRecords(tx *meta.Tx, dir string) (*meta.Bucket, error) {
+	return tx.Bucket(globalCacheIndexBucket).CreateBucketIfNotExists(filepath.Clean(dir) + "/")
+}
+
+// cacheRecordKey returns the key of the cache file at path, relative to the
+// cache directory dir.
+func cacheRecordKey(dir, path string) (string, bool) {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// cacheRecordOf returns the record of the accounted item in the cache
+// directory dir, keeping the version of the record it replaces. The version
+// of other files is told from their name when it can be.
+func cacheRecordOf(item CacheItem, rel string, old cacheRecord) cacheRecord {
+	record := cacheRecord{
+		Size:       item.Size,
+		ModTime:    item.ModTime,
+		AccessTime: item.AccessTime,
+		Key:        old.Key,
+		ETag:       old.ETag,
+	}
+	if record.Key == "" {
+		if key, etag, hashed, ok := parseCacheName(rel); ok && !hashed {
+			record.Key, record.ETag = key, etag
+		}
+	}
+	return record
+}
+
+// recordCache persists the accounted cache file at path as a version of the
+// object key with etag.
+func (mfs *MinFS) recordCache(path, key, etag string) {
+	if mfs.db == nil {
+		return
+	}
+
+	path = filepath.Clean(path)
+	dir, ok := mfs.cacheDirFor(path)
+	if !ok {
+		return
+	}
+	rel, ok := cacheRecordKey(dir, path)
+	if !ok {
+		return
+	}
+
+	mfs.m.Lock()
+	item, ok := mfs.caches[dir].items[path]
+	mfs.m.Unlock()
+	if !ok {
+		return
+	}
+
+	if err := mfs.db.Update(func(tx *meta.Tx) error {
+		b, err := cacheRecords(tx, dir)
+		if err != nil {
+			return err
+		}
+		return b.Put(rel, cacheRecordOf(item, rel, cacheRecord{Key: key, ETag: etag}))
+	}); err != nil {
+		mfs.log.Errorln("Unable to record cache file", path, err)
+	}
+}
+
+// unrecordCache drops the cache files at paths from the persisted index, in
+// one transaction.
+func (mfs *MinFS) unrecordCache(paths ...string) {
+	if mfs.db == nil || len(paths) == 0 {
+		return
+	}
+
+	dirs := make([]string, len(paths))
+	for i, path := range paths {
+		dirs[i], _ = mfs.cacheDirFor(filepath.Clean(path))
+	}
+
+	if err := mfs.db.Update(func(tx *meta.Tx) error {
+		for i, path := range paths {
+			if dirs[i] == "" {
+				continue
+			}
+			rel, ok := cacheRecordKey(dirs[i], path)
+			if !ok {
+				continue
+			}
+			b, err := cacheRecords(tx, dirs[i])
+			if err != nil {
+				return err
+			}
+			if err = b.Delete(rel); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		mfs.log.Errorln("Unable to drop", len(paths), "cache files from the index", err)
+	}
+}
+
+// loadCacheIndex accounts the cache directory dir from the index the last
+// mount left when it shut down cleanly, instead of walking the directory.
+// Every file recorded is stat, those gone are dropped and the others
+// accounted as they are on disk, last used when either says. Files not
+// recorded are found once the index is rebuilt from the directory, after
+// globalCacheReconcile. It is false when there's no index to trust, after a
+// crash or on the first mount.
+func (mfs *MinFS) loadCacheIndex(dir string) bool {
+	dir = filepath.Clean(dir)
+
+	records := map[string]cacheRecord{}
+	err := mfs.db.View(func(tx *meta.Tx) error {
+		var clean bool
+		if err := tx.Bucket(globalCacheIndexBucket).Get(dir, &clean); err != nil || !clean {
+			return err
+		}
+
+		b := tx.Bucket(globalCacheIndexBucket).Bucket(dir + "/")
+		if b.InnerBucket == nil {
+			return nil
+		}
+		return b.InnerBucket.ForEach(func(k, v []byte) error {
+			var record cacheRecord
+			if err := b.Get(string(k), &record); err != nil {
+				return err
+			}
+			records[string(k)] = record
+			return nil
+		})
+	})
+	if meta.IsNoSuchObject(err) {
+		return false
+	} else if err != nil {
+		mfs.log.Errorln("Unable to load the cache index of", dir, err)
+		return false
+	} else if len(records) == 0 {
+		return false
+	}
+
+	items := make([]CacheItem, 0, len(records))
+	var gone []string
+	for rel, record := range records {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		info, err := mfs.statLocal(path)
+		if os.IsNotExist(err) {
+			gone = append(gone, path)
+			continue
+		} else if err != nil {
+			mfs.log.Errorln("Unable to stat cache file", path, err)
+			return false
+		}
+
+		item := cacheItemOf(path, info)
+		if record.AccessTime.After(item.AccessTime) {
+			item.AccessTime = record.AccessTime
+		}
+		items = append(items, item)
+
+		// Versions cached are linked to by objects with their etag.
+		if record.ETag != "" {
+			mfs.addContent(record.ETag, path)
+		}
+	}
+
+	mfs.m.Lock()
+	idx := mfs.cacheIndexOf(dir)
+	idx.reset(items)
+	size := idx.size
+	idx.reconciled = time.Now()
+	mfs.m.Unlock()
+
+	mfs.unrecordCache(gone...)
+
+	mfs.log.Println("Loaded the cache index of", dir, "Cache files:", len(items), "Size:", humanSize(size), "gone:", len(gone))
+	return true
+}
+
+// saveCacheIndex persists what is accounted in the cache directory dir,
+// replacing the records of the files gone, and if the mount shuts down
+// cleanly with it. The access times kept in memory only are saved with it.
+func (mfs *MinFS) saveCacheIndex(dir string, clean bool) {
+	if mfs.db == nil {
+		return
+	}
+	dir = filepath.Clean(dir)
+
+	mfs.m.Lock()
+	idx := mfs.cacheIndexOf(dir)
+	items := make([]CacheItem, 0, len(idx.items))
+	for _, item := range idx.items {
+		items = append(items, item)
+	}
+	mfs.m.Unlock()
+
+	if err := mfs.db.Update(func(tx *meta.Tx) error {
+		parent := tx.Bucket(globalCacheIndexBucket)
+
+		old := map[string]cacheRecord{}
+		if b := parent.Bucket(dir + "/"); b.InnerBucket != nil {
+			if err := b.InnerBucket.ForEach(func(k, v []byte) error {
+				var record cacheRecord
+				if err := b.Get(string(k), &record); err != nil {
+					return err
+				}
+				old[string(k)] = record
+				return nil
+			}); err != nil {
+				return err
+			}
+			if err := parent.DeleteBucket(dir + "/"); err != nil {
+				return err
+			}
+		}
+
+		b, err := cacheRecords(tx, dir)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			rel, ok := cacheRecordKey(dir, item.Path)
+			if !ok {
+				continue
+			}
+			if err = b.Put(rel, cacheRecordOf(item, rel, old[rel])); err != nil {
+				return err
+			}
+		}
+		return parent.Put(dir, clean)
+	}); err != nil {
+		mfs.log.Errorln("Unable to save the cache index of", dir, err)
+	}
+}
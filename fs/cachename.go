@@ -0,0 +1,238 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strings"
+)
+
+// globalMaxNameLen is the longest file name cache filesystems take.
+const globalMaxNameLen = 255
+
+// cacheNameEscaper escapes the characters cache names are built with, so
+// keys and etags can't be mistaken for the separators.
+var cacheNameEscaper = strings.NewReplacer("%", "%25", "#", "%23", "+", "%2B", "/", "%2F")
+
+// escapeCacheElement escapes a path element of a key, or an etag. Empty,
+// dot and dot dot elements are escaped too, they'd be dropped by the join
+// or climb out of the cache.
+func escapeCacheElement(s string) string {
+	switch s {
+	case "":
+		return "%"
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	return cacheNameEscaper.Replace(s)
+}
+
+// splitETag splits a multipart etag into the etag of its part etags and the
+// number of parts, the number is empty for other etags.
+func splitETag(etag string) (string, string) {
+	if i := strings.LastIndexByte(etag, '-'); i >= 0 {
+		return etag[:i], etag[i+1:]
+	}
+	return etag, ""
+}
+
+// cacheName returns the path of the cache file of the object version with
+// etag, relative to the cache directory.
+//
+// By default the key is kept as the path of the file, every element
+// escaped, and the etag follows its name after a #. The part count of a
+// multipart etag follows after a +, as `dir/name#etag+parts.fcache`.
+// Elements and names too long for the filesystem are hashed.
+//
+// With hashed names the key and etag are hashed into a file name of fixed
+// length, all directly in the cache directory.
+func (mfs *MinFS) cacheName(key, etag string) string {
+	if mfs.hashesCacheNames() {
+		return mfs.hashCacheName(key, etag)
+	}
+
+	elems := escapeCacheKey(key)
+
+	sum, parts := splitETag(etag)
+	name := elems[len(elems)-1] + "#" + escapeCacheElement(sum)
+	if parts != "" {
+		name += "+" + escapeCacheElement(parts)
+	}
+
+	if len(name)+len(globalCacheExt) > globalMaxNameLen {
+		elems[len(elems)-1] = mfs.hashCacheName(key, etag)
+	} else {
+		elems[len(elems)-1] = name + globalCacheExt
+	}
+	return path.Join(elems...)
+}
+
+// escapeCacheKey returns the escaped path elements of key, elements too
+// long for the filesystem hashed.
+func escapeCacheKey(key string) []string {
+	elems := strings.Split(key, "/")
+	for i := range elems {
+		elems[i] = escapeCacheElement(elems[i])
+		if len(elems[i]) > globalMaxNameLen {
+			sum := sha256.Sum256([]byte(elems[i]))
+			elems[i] = hex.EncodeToString(sum[:])
+		}
+	}
+	return elems
+}
+
+// cacheNamePrefix returns the directory holding the cache files of key,
+// relative to the cache directory, and the prefix of their names. It is
+// false with hashed names, the versions of a key can't be told apart from
+// other files then.
+func (mfs *MinFS) cacheNamePrefix(key string) (string, string, bool) {
+	if mfs.hashesCacheNames() {
+		return "", "", false
+	}
+
+	elems := escapeCacheKey(key)
+	return path.Join(elems[:len(elems)-1]...), elems[len(elems)-1] + "#", true
+}
+
+// hashesCacheNames returns if every cache file is named after a hash, as
+// with hashed names or an encrypted cache, whose names don't show keys.
+func (mfs *MinFS) hashesCacheNames() bool {
+	return mfs.config.hashedCacheNames || mfs.config.cacheNameKey != nil
+}
+
+// hashCacheName returns the hashed cache file name of the object version
+// with etag. With an encrypted cache the hash is keyed, so names of known
+// keys can't be told either.
+func (mfs *MinFS) hashCacheName(key, etag string) string {
+	if mfs.config.cacheNameKey == nil {
+		sum := sha256.Sum256([]byte(key + "\x00" + etag))
+		return hex.EncodeToString(sum[:]) + globalCacheExt
+	}
+
+	mac := hmac.New(sha256.New, mfs.config.cacheNameKey)
+	mac.Write([]byte(key + "\x00" + etag))
+	return hex.EncodeToString(mac.Sum(nil)) + globalCacheExt
+}
+
+// unescapeCacheElement returns the path element of a key, or the etag,
+// escapeCacheElement escaped as s. It is false when s isn't escaped so.
+func unescapeCacheElement(s string) (string, bool) {
+	switch s {
+	case "%":
+		return "", true
+	case "%2E":
+		return ".", true
+	case "%2E%2E":
+		return "..", true
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '#', '+', '/':
+			return "", false
+		case '%':
+			if i+2 >= len(s) {
+				return "", false
+			}
+			switch s[i+1 : i+3] {
+			case "25":
+				b.WriteByte('%')
+			case "23":
+				b.WriteByte('#')
+			case "2B":
+				b.WriteByte('+')
+			case "2F":
+				b.WriteByte('/')
+			default:
+				return "", false
+			}
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), true
+}
+
+// isHashName returns if name is a hash as cache names are made of.
+func isHashName(name string) bool {
+	if len(name) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// parseCacheName returns the key and etag of the cache file at rel,
+// relative to the cache directory, as named by cacheName with the key
+// kept. It is false for the names cacheName doesn't make, and for names
+// with elements hashed, which can't be told back.
+func parseCacheName(rel string) (key, etag string, hashed, ok bool) {
+	rel = strings.TrimSuffix(rel, path.Ext(rel))
+
+	elems := strings.Split(rel, "/")
+	last := elems[len(elems)-1]
+	if isHashName(last) {
+		return "", "", true, true
+	}
+
+	i := strings.IndexByte(last, '#')
+	if i < 0 {
+		return "", "", false, false
+	}
+	elems[len(elems)-1] = last[:i]
+
+	sum, parts := last[i+1:], ""
+	if j := strings.IndexByte(sum, '+'); j >= 0 {
+		sum, parts = sum[:j], sum[j+1:]
+	}
+
+	for i, elem := range elems {
+		if isHashName(elem) {
+			hashed = true
+		}
+		if elems[i], ok = unescapeCacheElement(elem); !ok {
+			return "", "", false, false
+		}
+	}
+
+	if etag, ok = unescapeCacheElement(sum); !ok {
+		return "", "", false, false
+	}
+	if parts != "" {
+		if parts, ok = unescapeCacheElement(parts); !ok {
+			return "", "", false, false
+		}
+		etag += "-" + parts
+	}
+	return strings.Join(elems, "/"), etag, hashed, true
+}
+
+// cacheNameValid returns if rel, the path of a cache file relative to the
+// cache directory, is a name cacheName makes under the current scheme.
+func (mfs *MinFS) cacheNameValid(rel string) bool {
+	if mfs.hashesCacheNames() {
+		return !strings.Contains(rel, "/") && isHashName(strings.TrimSuffix(rel, path.Ext(rel)))
+	}
+	_, _, _, ok := parseCacheName(rel)
+	return ok
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// canaryConfig is the object read end to end by the canary.
+type canaryConfig struct {
+	bucket   string
+	key      string
+	interval time.Duration
+}
+
+// canaryStatus is the outcome of the last canary run.
+type canaryStatus struct {
+	OK      bool          `json:"ok"`
+	LastRun time.Time     `json:"lastRun"`
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// canary periodically reads an object through the same paths as the
+// kernel does: lookup (listing), open (stat and cache) and read.
+type canary struct {
+	mfs *MinFS
+	cfg canaryConfig
+
+	mu   sync.Mutex
+	last canaryStatus
+}
+
+func (c *canary) status() canaryStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.last
+}
+
+// run runs the canary every interval until done is closed.
+func (c *canary) run(done <-chan struct{}) {
+	for {
+		c.check()
+
+		select {
+		case <-done:
+			return
+		case <-time.After(c.cfg.interval):
+		}
+	}
+}
+
+func (c *canary) check() {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.interval)
+	defer cancel()
+
+	err := c.read(ctx)
+
+	status := canaryStatus{
+		OK:      err == nil,
+		LastRun: start,
+		Latency: time.Since(start),
+	}
+	if err != nil {
+		status.Error = err.Error()
+		c.mfs.log.Errorln("Canary", c.cfg.bucket+"/"+c.cfg.key, "failed:", err)
+	}
+
+	c.mu.Lock()
+	c.last = status
+	c.mu.Unlock()
+}
+
+// read reads the canary object, verifying its size and, for objects
+// uploaded in one part, its md5.
+func (c *canary) read(ctx context.Context) error {
+	uid := c.mfs.config.uid
+
+	node, err := c.mfs.Root()
+	if err != nil {
+		return err
+	}
+
+	// The names are looked up from the root of the mount, below the bucket
+	// or prefix it is rooted at.
+	d := c.mfs.keyDelimiter()
+	names := append([]string{c.cfg.bucket}, strings.Split(strings.Trim(c.cfg.key, d), d)...)
+	if root := c.mfs.config.root; root != "" {
+		names = names[strings.Count(root, "/")+1:]
+	}
+
+	for i, name := range names {
+		if i > 0 || c.mfs.config.root != "" {
+			name = c.mfs.names.present(name)
+		}
+
+		dir, ok := node.(*Dir)
+		if !ok {
+			return fmt.Errorf("%s is not a directory", name)
+		}
+		if node, err = dir.lookup(ctx, name, uid); err != nil {
+			return fmt.Errorf("lookup of %s: %v", name, err)
+		}
+	}
+
+	f, ok := node.(*File)
+	if !ok {
+		return fmt.Errorf("%s is not a file", c.cfg.key)
+	}
+
+	handle, err := f.Open(ctx, &fuse.OpenRequest{
+		Header: fuse.Header{Uid: uid, Gid: c.mfs.config.gid},
+		Flags:  fuse.OpenReadOnly,
+	}, &fuse.OpenResponse{})
+	if err != nil {
+		return fmt.Errorf("open: %v", err)
+	}
+
+	fh := handle.(*FileHandle)
+	defer func() {
+		fh.Release(ctx, &fuse.ReleaseRequest{})
+
+		// Evict the cached copy, so the next run fetches the object again.
+		// A copy other handles use, or pinned, is kept.
+		if fh.cachePath != "" {
+			if _, ok := c.mfs.evictCache(fh.cachePath); ok {
+				c.mfs.unrecordCache(fh.cachePath)
+			}
+		}
+	}()
+
+	var data bytes.Buffer
+	for int64(data.Len()) < int64(f.Size) {
+		resp := &fuse.ReadResponse{}
+		if err = fh.Read(ctx, &fuse.ReadRequest{Offset: int64(data.Len()), Size: 128 * 1024}, resp); err != nil {
+			return fmt.Errorf("read: %v", err)
+		}
+		if len(resp.Data) == 0 {
+			break
+		}
+		data.Write(resp.Data)
+	}
+
+	if uint64(data.Len()) != f.Size {
+		return fmt.Errorf("read %d bytes of %d", data.Len(), f.Size)
+	}
+
+	// Multipart etags aren't an md5 of the content.
+	if etag := strings.Trim(f.ETag, "\""); len(etag) == md5.Size*2 {
+		sum := md5.Sum(data.Bytes())
+		if hex.EncodeToString(sum[:]) != etag {
+			return fmt.Errorf("content doesn't match etag %s", etag)
+		}
+	}
+
+	return nil
+}
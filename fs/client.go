@@ -0,0 +1,194 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// endpointKey identifies an endpoint by scheme and host, so routes
+// pointing at the same server share one client.
+func endpointKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// endpointFor returns the endpoint serving bucket, buckets without a
+// route are served by the target.
+func (mfs *MinFS) endpointFor(bucket string) *url.URL {
+	if u, ok := mfs.config.routes[bucket]; ok {
+		return u
+	}
+	return mfs.config.target
+}
+
+// endpoints returns every distinct endpoint of the mount, the target first.
+func (mfs *MinFS) endpoints() []*url.URL {
+	seen := map[string]bool{endpointKey(mfs.config.target): true}
+	endpoints := []*url.URL{mfs.config.target}
+	for _, u := range mfs.config.routes {
+		if seen[endpointKey(u)] {
+			continue
+		}
+		seen[endpointKey(u)] = true
+		endpoints = append(endpoints, u)
+	}
+	return endpoints
+}
+
+// clientKey identifies the client of a uid for an endpoint.
+type clientKey struct {
+	endpoint string
+	uid      uint32
+}
+
+// cachedClient is a client and the credentials it signs with.
+type cachedClient struct {
+	api   *minio.Client
+	creds *credentials.Credentials
+}
+
+// getApi returns the client for the target endpoint.
+func (mfs *MinFS) getApi(ctx context.Context, uid uint32) (*minio.Client, error) {
+	return mfs.getEndpointApi(ctx, uid, mfs.config.target)
+}
+
+// getBucketApi returns the client for the endpoint serving bucket.
+func (mfs *MinFS) getBucketApi(ctx context.Context, uid uint32, bucket string) (*minio.Client, error) {
+	return mfs.getEndpointApi(ctx, uid, mfs.endpointFor(bucket))
+}
+
+// getEndpointApi returns the client for endpoint signing with the
+// credentials of uid, creating it on first use. A client is built again
+// when the provider hands out other credentials for the uid.
+//
+// Every endpoint is accessed with the same credentials for a uid, a route
+// only selects which server a bucket is read from. All clients share the
+// transport, and so its connections.
+func (mfs *MinFS) getEndpointApi(ctx context.Context, uid uint32, endpoint *url.URL) (*minio.Client, error) {
+	creds, err := mfs.provider.Credentials(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	mfs.cm.Lock()
+	defer mfs.cm.Unlock()
+
+	key := clientKey{endpointKey(endpoint), uid}
+	if c, ok := mfs.clients[key]; ok && c.creds == creds {
+		return c.api, nil
+	}
+
+	api, err := mfs.newClient(endpoint, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	mfs.clients[key] = cachedClient{api, creds}
+	return api, nil
+}
+
+// newClient builds a minio client for endpoint signing with creds. Callers
+// hold cm.
+func (mfs *MinFS) newClient(endpoint *url.URL, creds *credentials.Credentials) (*minio.Client, error) {
+	var transport http.RoundTripper = &expiryTransport{mfs.transport, creds}
+
+	// Retries pass the limiter like any other request, it sits below them.
+	if mfs.limiter != nil {
+		transport = &limitedTransport{transport, mfs.limiter}
+	}
+
+	transport = newRetryTransport(transport, mfs.config.maxRetries, globalRetryBackoff, mfs.config.retryBackoff, mfs.retries)
+
+	if mfs.config.metricsAddr != "" {
+		transport = &metricsTransport{transport, mfs.metrics}
+	}
+
+	if len(mfs.config.headers) > 0 {
+		transport = &headerTransport{transport, mfs.config.headers}
+	}
+
+	options := &minio.Options{
+		Creds:     creds,
+		Secure:    endpoint.Scheme == "https",
+		Transport: transport,
+		Region:    mfs.config.region,
+	}
+	options.BucketLookup = mfs.config.bucketLookup
+
+	return minio.New(endpoint.Host, options)
+}
+
+// newTransport returns the transport to the servers, trusting the
+// certificates configured for the mount. Connections are kept alive and
+// reused, up to a bound per server. Requests go through the proxy of the
+// mount, or the one of the environment. Tunneled through the proxy, https
+// endpoints are verified as without it.
+func (mfs *MinFS) newTransport() *http.Transport {
+	proxy := http.ProxyFromEnvironment
+	if mfs.config.proxy != nil {
+		proxy = http.ProxyURL(mfs.config.proxy)
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          globalMaxIdleConns,
+		MaxIdleConnsPerHost:   globalMaxIdleConns,
+		MaxConnsPerHost:       globalMaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			RootCAs:            mfs.config.rootCAs,
+			InsecureSkipVerify: mfs.config.insecure,
+		},
+		// Set this value so that the underlying transport round-tripper
+		// doesn't try to auto decode the body of objects with
+		// content-encoding set to `gzip`.
+		//
+		// Refer:
+		//    https://golang.org/src/net/http/transport.go?h=roundTrip#L1843
+		DisableCompression: true,
+	}
+}
+
+// headerTransport sets the custom headers on every request. The values may
+// hold secrets for a gateway in front of the servers, they are never logged.
+type headerTransport struct {
+	http.RoundTripper
+
+	headers map[string]string
+}
+
+// RoundTrip sends a copy of the request carrying the custom headers.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// certPEM returns the certificate of the TLS server s3 in PEM.
+func certPEM(s3 *fakeS3) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s3.Certificate().Raw})
+}
+
+// listTLS lists the bucket of the TLS server s3, through a mount with
+// options.
+func listTLS(t *testing.T, s3 *fakeS3, options ...func(*Config)) error {
+	t.Helper()
+
+	_, err := newTestFS(t, s3, options...).dirAt("bucket").scanBucket(context.Background(), 0)
+	return err
+}
+
+func TestCACertPEM(t *testing.T) {
+	s3 := newFakeS3TLS(t, "bucket")
+
+	if err := listTLS(t, s3, CACertPEM(certPEM(s3))); err != nil {
+		t.Fatalf("listing with the CA of the server failed: %v", err)
+	}
+}
+
+func TestCACertFile(t *testing.T) {
+	s3 := newFakeS3TLS(t, "bucket")
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(path, certPEM(s3), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := listTLS(t, s3, CACert(path)); err != nil {
+		t.Fatalf("listing with the CA file of the server failed: %v", err)
+	}
+}
+
+func TestUnknownCARejected(t *testing.T) {
+	s3 := newFakeS3TLS(t, "bucket")
+
+	// Asked through the transport, the clients retry failed handshakes for a while.
+	req, err := http.NewRequest(http.MethodGet, s3.URL+"/bucket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newTestFS(t, s3).transport.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("request to a server of an unknown CA failed with %v, expected a certificate error", err)
+	}
+
+	if err := listTLS(t, s3, Insecure()); err != nil {
+		t.Fatalf("insecure listing failed: %v", err)
+	}
+}
+
+func TestCACertInvalid(t *testing.T) {
+	for name, option := range map[string]func(*Config){
+		"missing file": CACert(filepath.Join(t.TempDir(), "missing.pem")),
+		"no PEM":       CACertPEM([]byte("not a certificate")),
+	} {
+		cfg := &Config{mountpoint: "/mnt"}
+		Target("https://127.0.0.1")(cfg)
+		option(cfg)
+		if err := cfg.validate(); err == nil || !strings.HasPrefix(err.Error(), "CA certificate is not valid") {
+			t.Errorf("%s failed validation with %v, expected the CA reported as not valid", name, err)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// A block cache file holds an object in blocks of globalCacheBlock bytes,
+// each compressed as a zstd frame of its own, so a read only decodes the
+// blocks it covers. The blocks are followed by a zstd skippable frame
+// holding the index: the stored size of every block, the nonce of a sealed
+// file, then the size of the object, the block size, the number of blocks,
+// the flags and blockFileMagic. A file only compressed stays a valid zstd
+// stream. Blocks may be sealed as well, or instead, see blockCodec.
+const (
+	globalCacheBlock = 1 << 20
+
+	// skippableMagic starts a zstd frame decoders skip.
+	skippableMagic = 0x184D2A50
+	blockFileMagic = 0x4D5A4331
+	blockFooter    = 8 + 4 + 4 + 4 + 4
+
+	blockCompressed = 1 << 0
+	blockSealed     = 1 << 1
+)
+
+var errBlockIndex = errors.New("block cache file has no valid index")
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// incompressibleExts and incompressibleTypes are of formats compressed
+// already, compressing them again only costs time.
+var (
+	incompressibleExts = map[string]bool{
+		".bam": true, ".cram": true, ".gz": true, ".bgz": true, ".bz2": true,
+		".xz": true, ".zst": true, ".zip": true, ".7z": true,
+	}
+	incompressibleTypes = map[string]bool{
+		"application/gzip": true, "application/x-gzip": true, "application/zstd": true,
+		"application/x-bzip2": true, "application/x-xz": true, "application/zip": true,
+		"application/x-7z-compressed": true,
+	}
+)
+
+// compressible returns if object is worth caching compressed.
+func compressible(object minio.ObjectInfo) bool {
+	if incompressibleExts[strings.ToLower(filepath.Ext(object.Key))] {
+		return false
+	}
+	contentType := strings.TrimSpace(strings.Split(object.ContentType, ";")[0])
+	return !incompressibleTypes[strings.ToLower(contentType)]
+}
+
+// blockCachePath returns the block cache file of the object version cached
+// at cachePath.
+func blockCachePath(cachePath string) string {
+	return strings.TrimSuffix(cachePath, globalCacheExt) + globalBlockCacheExt
+}
+
+// isBlockCachePath returns if the cache file at path is a block cache file.
+func isBlockCachePath(path string) bool {
+	return filepath.Ext(path) == globalBlockCacheExt
+}
+
+// readCachePath returns the cache file read only opens of the object read
+// from, its block cache file when blocks are sealed or compressed, unless
+// the version is cached as is already.
+func (mfs *MinFS) readCachePath(cachePath string, object minio.ObjectInfo) string {
+	if !mfs.blockCached(object) {
+		return cachePath
+	}
+	if _, err := mfs.statLocal(cachePath); err == nil {
+		return cachePath
+	}
+	return blockCachePath(cachePath)
+}
+
+// cachedSize returns the size of the object cached at path, -1 when a
+// block cache file has no valid index.
+func (mfs *MinFS) cachedSize(path string, info os.FileInfo) int64 {
+	if !isBlockCachePath(path) {
+		return info.Size()
+	}
+
+	f, err := mfs.openLocal(path, os.O_RDONLY, 0)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+
+	bf, err := openBlockFile(f, mfs.config.cacheCipher)
+	if err != nil {
+		return -1
+	}
+	return bf.size
+}
+
+// fetchBlocks downloads the object to the block cache file at path, aside
+// until complete. A download failing midway starts over.
+func (f *File) fetchBlocks(ctx context.Context, uid uint32, api *minio.Client, object minio.ObjectInfo, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	opts := f.mfs.getOptions(f.Bucket())
+	if err := opts.SetMatchETag(object.ETag); err != nil {
+		return err
+	}
+
+	codec := &blockCodec{
+		compress: f.mfs.config.cacheCompression != "" && compressible(object),
+		aead:     f.mfs.config.cacheCipher,
+		size:     object.Size,
+	}
+
+	tmpPath := path + parallelTmpExt
+	err := f.mfs.retryExpired(ctx, uid, func() error {
+		// Every attempt seals under a nonce of its own.
+		if err := codec.newNonce(); err != nil {
+			return err
+		}
+
+		obj, err := api.GetObject(ctx, f.Bucket(), f.ObjectPath(), opts)
+		if err != nil {
+			return err
+		}
+		defer obj.Close()
+
+		tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+
+		w := newBlockWriter(tmp, codec)
+		if _, err = io.Copy(w, obj); err == nil {
+			err = w.Close()
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// blockWriter writes a block cache file to w.
+type blockWriter struct {
+	w     io.Writer
+	codec *blockCodec
+
+	block []byte
+	sizes []uint32
+	size  int64
+}
+
+func newBlockWriter(w io.Writer, codec *blockCodec) *blockWriter {
+	return &blockWriter{w: w, codec: codec, block: make([]byte, 0, globalCacheBlock)}
+}
+
+// Write buffers p, writing every block filled.
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := copy(bw.block[len(bw.block):cap(bw.block)], p)
+		bw.block = bw.block[:len(bw.block)+m]
+		p = p[m:]
+
+		if len(bw.block) == cap(bw.block) {
+			if err := bw.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush writes the block buffered.
+func (bw *blockWriter) flush() error {
+	if len(bw.block) == 0 {
+		return nil
+	}
+
+	frame := bw.codec.encode(len(bw.sizes), bw.block)
+	if _, err := bw.w.Write(frame); err != nil {
+		return err
+	}
+	bw.sizes = append(bw.sizes, uint32(len(frame)))
+	bw.size += int64(len(bw.block))
+	bw.block = bw.block[:0]
+	return nil
+}
+
+// Close writes the last block and the index.
+func (bw *blockWriter) Close() error {
+	if err := bw.flush(); err != nil {
+		return err
+	}
+
+	count := len(bw.sizes)
+	index := make([]byte, 8+count*4, 8+count*4+len(bw.codec.nonce)+blockFooter)
+	binary.LittleEndian.PutUint32(index[0:], skippableMagic)
+	binary.LittleEndian.PutUint32(index[4:], uint32(cap(index)-8))
+	for i, size := range bw.sizes {
+		binary.LittleEndian.PutUint32(index[8+i*4:], size)
+	}
+	index = append(index, bw.codec.nonce...)
+
+	footer := make([]byte, blockFooter)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(bw.size))
+	binary.LittleEndian.PutUint32(footer[8:], globalCacheBlock)
+	binary.LittleEndian.PutUint32(footer[12:], uint32(count))
+	binary.LittleEndian.PutUint32(footer[16:], bw.codec.flags())
+	binary.LittleEndian.PutUint32(footer[20:], blockFileMagic)
+
+	_, err := bw.w.Write(append(index, footer...))
+	return err
+}
+
+// blockFile reads a block cache file at any offset, keeping the block
+// decoded last for the reads that follow.
+type blockFile struct {
+	f     *os.File
+	codec *blockCodec
+
+	size      int64
+	blockSize int64
+
+	// offset of every block in the file, and of the index after them
+	offsets []int64
+
+	mu      sync.Mutex
+	decoded int
+	block   []byte
+}
+
+// openBlockFile reads the index of the block cache file f, sealed blocks
+// are opened with aead.
+func openBlockFile(f *os.File, aead cipher.AEAD) (*blockFile, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, blockFooter)
+	if info.Size() < 8+blockFooter {
+		return nil, errBlockIndex
+	} else if _, err = f.ReadAt(footer, info.Size()-blockFooter); err != nil {
+		return nil, err
+	}
+
+	size := int64(binary.LittleEndian.Uint64(footer[0:]))
+	blockSize := int64(binary.LittleEndian.Uint32(footer[8:]))
+	count := int64(binary.LittleEndian.Uint32(footer[12:]))
+	flags := binary.LittleEndian.Uint32(footer[16:])
+	if binary.LittleEndian.Uint32(footer[20:]) != blockFileMagic || blockSize == 0 || size < 0 {
+		return nil, errBlockIndex
+	}
+
+	codec, err := newBlockCodec(flags, size, aead)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := int64(len(codec.nonce))
+
+	indexSize := 8 + count*4 + nonceSize + blockFooter
+	if indexSize > info.Size() || count != (size+blockSize-1)/blockSize {
+		return nil, errBlockIndex
+	}
+
+	index := make([]byte, count*4+nonceSize)
+	if _, err = f.ReadAt(index, info.Size()-indexSize+8); err != nil {
+		return nil, err
+	}
+	copy(codec.nonce, index[count*4:])
+
+	offsets := make([]int64, count+1)
+	for i := int64(0); i < count; i++ {
+		offsets[i+1] = offsets[i] + int64(binary.LittleEndian.Uint32(index[i*4:]))
+	}
+	if offsets[count] != info.Size()-indexSize {
+		return nil, errBlockIndex
+	}
+
+	return &blockFile{
+		f:         f,
+		codec:     codec,
+		size:      size,
+		blockSize: blockSize,
+		offsets:   offsets,
+		decoded:   -1,
+	}, nil
+}
+
+// ReadAt reads the object at off, decoding the blocks covered.
+func (bf *blockFile) ReadAt(p []byte, off int64) (n int, err error) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	for n < len(p) && off < bf.size {
+		i := int(off / bf.blockSize)
+		if i != bf.decoded {
+			if err = bf.decode(i); err != nil {
+				return n, err
+			}
+		}
+
+		m := copy(p[n:], bf.block[off-int64(i)*bf.blockSize:])
+		n += m
+		off += int64(m)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// decode decodes block i, callers hold mu.
+func (bf *blockFile) decode(i int) error {
+	frame := make([]byte, bf.offsets[i+1]-bf.offsets[i])
+	if _, err := bf.f.ReadAt(frame, bf.offsets[i]); err != nil {
+		return err
+	}
+
+	// Every block but the last is whole.
+	want := bf.blockSize
+	if rest := bf.size - int64(i)*bf.blockSize; rest < want {
+		want = rest
+	}
+
+	block, err := bf.codec.decode(i, frame, bf.block)
+	if err == nil && int64(len(block)) != want {
+		err = errBlockIndex
+	}
+	if err != nil {
+		bf.decoded = -1
+		return err
+	}
+	bf.block, bf.decoded = block, i
+	return nil
+}
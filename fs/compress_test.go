@@ -0,0 +1,100 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeBlockFile writes data to a block cache file encoded with codec.
+func writeBlockFile(t *testing.T, codec *blockCodec, data []byte) *os.File {
+	f, err := os.Create(filepath.Join(t.TempDir(), "object"+globalBlockCacheExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	if err = codec.newNonce(); err != nil {
+		t.Fatal(err)
+	}
+	w := newBlockWriter(f, codec)
+	if _, err = io.Copy(w, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestBlockFileRoundTrip(t *testing.T) {
+	aead, _, err := parseCacheKey(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks whole and a last one cut short.
+	data := bytes.Repeat([]byte("ACGT"), globalCacheBlock/2+1000)
+	for _, tc := range []struct {
+		name     string
+		compress bool
+		aead     cipher.AEAD
+	}{
+		{"compressed", true, nil},
+		{"sealed", false, aead},
+		{"compressed and sealed", true, aead},
+	} {
+		f := writeBlockFile(t, &blockCodec{compress: tc.compress, aead: tc.aead, size: int64(len(data))}, data)
+
+		bf, err := openBlockFile(f, aead)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if bf.size != int64(len(data)) {
+			t.Fatalf("%s: size %d, expected %d", tc.name, bf.size, len(data))
+		}
+		got, err := ioutil.ReadAll(io.NewSectionReader(bf, 0, bf.size))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: read back %d bytes differing, %v", tc.name, len(got), err)
+		}
+
+		// A read across two blocks.
+		p := make([]byte, 100)
+		off := int64(globalCacheBlock - 50)
+		if _, err = bf.ReadAt(p, off); err != nil || !bytes.Equal(p, data[off:off+100]) {
+			t.Fatalf("%s: read across blocks differs, %v", tc.name, err)
+		}
+	}
+}
+
+func TestSealedBlockFileNeedsKey(t *testing.T) {
+	aead, _, err := parseCacheKey(strings.Repeat("ab", 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := writeBlockFile(t, &blockCodec{aead: aead, size: 4}, []byte("data"))
+
+	if _, err = openBlockFile(f, nil); err != errBlockKey {
+		t.Fatalf("opened without the key: %v", err)
+	}
+}
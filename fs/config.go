@@ -16,9 +16,24 @@
 package minfs
 
 import (
+	"crypto/cipher"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 )
 
 // Config is being used for storge of configuration items
@@ -26,19 +41,168 @@ type Config struct {
 	basePath string
 
 	cache       string
-	quota       int
+	quota       int64
 	accountID   string
 	accessKey   string
 	secretKey   string
 	secretToken string
 	target      *url.URL
+	targetErr   error
+	rootCAs     *x509.CertPool
+	caErr       error
+	proxy       *url.URL
+	proxyErr    error
+	routes      map[string]*url.URL
+	headers     map[string]string
 	mountpoint  string
+	region      string
+	readOnly    bool
 	insecure    bool
 	debug       bool
 
+	localRetries int
+	maxRequests  int
+	retryBudget  int
+
+	// retries of failed requests, and the longest backoff between them
+	maxRetries   int
+	retryBackoff time.Duration
+
+	// bounds of a request to the servers, and of a download to the cache
+	opTimeout       time.Duration
+	downloadTimeout time.Duration
+
+	// downloads taking longer are logged, 0 never
+	slowDownload time.Duration
+
+	// how often the objects cached are checked for removal, 0 never
+	reconcileInterval time.Duration
+
+	// the cache files of versions gone from the servers are removed on start
+	sweepOrphans bool
+
+	// how long presigned urls of files are valid
+	presignExpiry time.Duration
+
+	maxCacheFileSize int64
+	nodeCacheSize    int
+	listingCacheTTL  time.Duration
+	statCacheTTL     time.Duration
+	tagCacheTTL      time.Duration
+
+	// how long the buckets listed at the root are kept in memory
+	bucketListTTL time.Duration
+
+	// fractions of the quota eviction starts above, and evicts down to
+	highWatermark float64
+	lowWatermark  float64
+
+	streamPartSize  int64
+	streamThreshold int64
+	rangeReads      bool
+
+	// bytes prefetched ahead of sequential reads by range, 0 disables
+	readahead int64
+
+	// requests at once downloading objects of at least downloadThreshold bytes
+	downloadConcurrency int
+	downloadThreshold   int64
+
+	healthAddr  string
+	metricsAddr string
+	canary      *canaryConfig
+
+	sts    *stsConfig
+	stsErr error
+
+	// the mount signs with the credentials of the IAM role of the node,
+	// fetched from iamEndpoint when set
+	iam         bool
+	iamEndpoint string
+
+	// how buckets are addressed in requests
+	bucketLookup    minio.BucketLookupType
+	bucketLookupErr error
+
+	// fetches the static keys again once they expired
+	refresh func() (AccessConfig, error)
+
+	// provides the credentials instead of the config when set
+	provider CredentialProvider
+
+	// credentials of uids, and if uids without are denied
+	users            map[uint32]AccessConfig
+	usersErr         error
+	denyUnknownUsers bool
+
+	// uids without credentials of their own make anonymous requests
+	anonymous bool
+
+	peerAddr   string
+	cachePeers []string
+	peerSecret []byte
+
+	bucketCaches map[string]*bucketCache
+
+	// share of the cache directory a bucket may take, in bytes
+	bucketQuotas map[string]int64
+
+	// server side encryption of the objects of a bucket
+	sse    map[string]encrypt.ServerSide
+	sseErr error
+
+	// cache files are named after a hash of the key and etag
+	hashedCacheNames bool
+
+	// algorithm cache files of objects read are compressed with, if any
+	cacheCompression string
+
+	// objects with the etag of a file cached are linked to it, not fetched
+	cacheDedup bool
+
+	// seals the cache files of objects read and keys the names of cache
+	// files, nil keeps them in the clear
+	cacheCipher  cipher.AEAD
+	cacheNameKey []byte
+	cacheKeyErr  error
+
+	// buckets presented at the root when listed, in this order
+	allowedBuckets []string
+
+	// bucket, or prefix in a bucket, presented as the root
+	root string
+
+	staticBuckets []string
+	unions        map[string][]string
+	strictListing bool
+	dirMarkers    bool
+	maxPathDepth  int
+
+	// keys are split into directories by, or "" for a flat listing
+	delimiter string
+
+	preservePOSIXMeta bool
+	symlinkType       string
+	windowsNames      bool
+	archiveExts       []string
+
 	uid  uint32
 	gid  uint32
 	mode os.FileMode
+
+	// permissions of every directory, root and buckets included
+	dirMode os.FileMode
+}
+
+// bucketCache is the cache directory of a bucket.
+type bucketCache struct {
+	dir string
+
+	// in bytes, 0 is the quota of the cache
+	quota int64
+
+	// largest file the directory holds, 0 is unlimited
+	maxFileSize int64
 }
 
 // AccessConfig - access credentials and version of `config.json`.
@@ -61,6 +225,39 @@ func InitMinFSConfig() (*AccessConfig, error) {
 	return ac, nil
 }
 
+// EnvOptions - the options set in the environment, for deployments
+// configured without a command line: the target in MINFS_ENDPOINT, the
+// region in MINFS_REGION, the bucket lookup in MINFS_BUCKET_LOOKUP, the
+// cache directory in MINFS_CACHE_DIR and insecure mode with MINFS_INSECURE.
+// New applies them before its options, which override them.
+func EnvOptions() ([]func(*Config), error) {
+	var opts []func(*Config)
+
+	if endpoint := os.Getenv("MINFS_ENDPOINT"); endpoint != "" {
+		opts = append(opts, Target(endpoint))
+	}
+	if region := os.Getenv("MINFS_REGION"); region != "" {
+		opts = append(opts, Region(region))
+	}
+	if style := os.Getenv("MINFS_BUCKET_LOOKUP"); style != "" {
+		opts = append(opts, BucketLookup(style))
+	}
+	if dir := os.Getenv("MINFS_CACHE_DIR"); dir != "" {
+		opts = append(opts, CacheDir(dir))
+	}
+
+	if value := os.Getenv("MINFS_INSECURE"); value != "" {
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("MINFS_INSECURE invalid, pass true or false: %q", value)
+		}
+		if insecure {
+			opts = append(opts, Insecure())
+		}
+	}
+	return opts, nil
+}
+
 // Mountpoint configures the target mountpoint
 func Mountpoint(mountpoint string) func(*Config) {
 	return func(cfg *Config) {
@@ -68,12 +265,212 @@ func Mountpoint(mountpoint string) func(*Config) {
 	}
 }
 
-// Target url target option for Config
+// Target url target option for Config, as `https://host`, `s3://host:port`
+// or a bare `host:port`. An invalid target is reported by validate.
 func Target(target string) func(*Config) {
 	return func(cfg *Config) {
-		if u, err := url.Parse(target); err == nil {
-			cfg.target = u
+		cfg.target, cfg.targetErr = parseEndpoint(target)
+	}
+}
+
+// parseEndpoint parses the url of a server. s3:// and bare hosts are served
+// over https, like S3 itself.
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	if endpoint == "" {
+		return nil, errors.New("no endpoint given")
+	}
+
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	case "s3":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected http, https or s3", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %q", endpoint)
+	}
+
+	// Only the host is used, a path would be silently ignored.
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return nil, fmt.Errorf("%q has more than a host, buckets are presented at the root of the mount", endpoint)
+	}
+
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}, nil
+}
+
+// EndpointRouting - routes buckets to the endpoint serving them, buckets
+// without a route are served by the target.
+func EndpointRouting(routes map[string]string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.routes = map[string]*url.URL{}
+		for bucket, endpoint := range routes {
+			// An invalid endpoint is kept as nil, for validate to report.
+			u, _ := parseEndpoint(endpoint)
+			cfg.routes[bucket] = u
+		}
+	}
+}
+
+// CustomHeaders - headers set on every request to the servers, such as
+// the credentials of a gateway in front of them.
+func CustomHeaders(headers map[string]string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.headers = headers
+	}
+}
+
+// StaticBuckets - presents exactly these buckets at the root, without
+// listing the buckets the credentials have access to.
+func StaticBuckets(buckets []string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.staticBuckets = buckets
+	}
+}
+
+// Buckets - presents only these buckets at the root, in this order. The
+// buckets are listed as usual, a bucket not in the list is not presented
+// nor looked up.
+func Buckets(names ...string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.allowedBuckets = names
+	}
+}
+
+// Root - presents this bucket, or this prefix in a bucket as
+// `bucket/prefix`, as the root of the mount instead of the buckets.
+func Root(bucketOrPrefix string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.root = strings.Trim(bucketOrPrefix, "/")
+	}
+}
+
+// CacheCompression - caches the objects opened read only compressed with
+// algo, only zstd is supported. Objects of formats compressed already are
+// cached as is.
+func CacheCompression(algo string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.cacheCompression = algo
+	}
+}
+
+// CacheEncryptionKey - seals the cache files of objects opened read only
+// with AES-GCM under key, hex encoded as 16, 24 or 32 bytes, and names
+// every cache file after a keyed hash. An invalid key is reported by
+// validate.
+func CacheEncryptionKey(key string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.cacheCipher, cfg.cacheNameKey, cfg.cacheKeyErr = parseCacheKey(key)
+	}
+}
+
+// StrictListing - fails a directory listing that errors midway, instead
+// of presenting the entries listed until the error.
+func StrictListing() func(*Config) {
+	return func(cfg *Config) {
+		cfg.strictListing = true
+	}
+}
+
+// WindowsSafeNames - presents keys with names that are illegal on Windows
+// percent encoded, so they can be reached through a re-export to Windows.
+func WindowsSafeNames() func(*Config) {
+	return func(cfg *Config) {
+		cfg.windowsNames = true
+	}
+}
+
+// PreservePOSIXMeta - presents the file metadata stored with objects by
+// archival tools, such as the creation time in x-amz-meta-crtime.
+func PreservePOSIXMeta() func(*Config) {
+	return func(cfg *Config) {
+		cfg.preservePOSIXMeta = true
+	}
+}
+
+// SymlinkObjects - presents objects of contentType as symlinks, their body
+// being the target. Servers that don't list metadata, unlike MinIO, present
+// them as files.
+func SymlinkObjects(contentType string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.symlinkType = contentType
+	}
+}
+
+// RangeReads - reads objects opened read only by range into a sparse cache
+// file, instead of fetching them whole on open. Only the ranges read are
+// fetched and cached.
+func RangeReads() func(*Config) {
+	return func(cfg *Config) {
+		cfg.rangeReads = true
+	}
+}
+
+// ReadaheadBytes - prefetches up to n bytes ahead of sequential reads of
+// files read by range, in the background. Reads that aren't sequential
+// aren't prefetched for.
+func ReadaheadBytes(n int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.readahead = n
+	}
+}
+
+// ArchiveMount - presents objects with one of these extensions as read only
+// directories of their members, members are read by range without fetching
+// the archive. Extensions ending in tar are read as uncompressed tar, any
+// other as zip.
+func ArchiveMount(extensions []string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.archiveExts = extensions
+	}
+}
+
+// MaxPathDepth - hides directories whose entries would be more than n
+// levels below the bucket, 0 is unlimited.
+func MaxPathDepth(n int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.maxPathDepth = n
+	}
+}
+
+// Delimiter - splits keys into directories by delimiter, / by default. An
+// empty delimiter lists buckets recursively, presenting every key as a
+// file named by its whole path, without directories. With another
+// delimiter the slashes in names are percent encoded, as in a flat listing.
+func Delimiter(delimiter string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.delimiter = delimiter
+	}
+}
+
+// DirMarkers - sets if made directories are persisted as marker objects,
+// enabled by default. Without markers a directory only exists in memory
+// until objects are written below it.
+func DirMarkers(enabled bool) func(*Config) {
+	return func(cfg *Config) {
+		cfg.dirMarkers = enabled
+	}
+}
+
+// UnionPrefix - presents the entries of several prefixes in one directory.
+// The directory name and the prefixes are paths starting with the bucket,
+// all in the same bucket. When prefixes list the same name the first wins.
+func UnionPrefix(name string, prefixes []string) func(*Config) {
+	return func(cfg *Config) {
+		if cfg.unions == nil {
+			cfg.unions = map[string][]string{}
 		}
+		cfg.unions[strings.Trim(name, "/")] = prefixes
 	}
 }
 
@@ -84,50 +481,926 @@ func CacheDir(path string) func(*Config) {
 	}
 }
 
-// CacheDir - cache directory path option for Config
+// HashedCacheNames - names cache files after a hash of the key and etag,
+// all directly in the cache directory, instead of after the key.
+func HashedCacheNames() func(*Config) {
+	return func(cfg *Config) {
+		cfg.hashedCacheNames = true
+	}
+}
+
+// CacheDedup - caches an object whose etag is cached already for another
+// key as a hard link to that file, instead of fetching it again. The file
+// is accounted once in the quota, whichever links it has.
+func CacheDedup() func(*Config) {
+	return func(cfg *Config) {
+		cfg.cacheDedup = true
+	}
+}
+
+// StreamingUploads - files opened write only and truncated are uploaded part
+// by part as they are written sequentially, once threshold bytes were
+// written, so only one part of partSize bytes is staged in the cache.
+func StreamingUploads(partSize, threshold int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.streamPartSize = partSize
+		cfg.streamThreshold = threshold
+	}
+}
+
+// DownloadConcurrency - downloads large objects to the cache in chunks,
+// fetched by n range requests at once instead of a single stream. 1 is a
+// single stream.
+func DownloadConcurrency(n int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.downloadConcurrency = n
+	}
+}
+
+// ParallelDownloadThreshold - objects smaller than size bytes are
+// downloaded as a single stream, regardless of the download concurrency.
+func ParallelDownloadThreshold(size int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.downloadThreshold = size
+	}
+}
+
+// BucketCacheDir - caches the objects of bucket in dir instead of the cache
+// directory, with its own quota in GB. A quota of 0 is the cache quota.
+func BucketCacheDir(bucket, dir string, quota int) func(*Config) {
+	return BucketCacheDirBytes(bucket, dir, int64(quota)<<30)
+}
+
+// BucketCacheDirBytes - caches the objects of bucket in dir, with its own
+// quota in bytes.
+func BucketCacheDirBytes(bucket, dir string, quota int64) func(*Config) {
+	return func(cfg *Config) {
+		if cfg.bucketCaches == nil {
+			cfg.bucketCaches = map[string]*bucketCache{}
+		}
+		cfg.bucketCaches[bucket] = &bucketCache{dir: dir, quota: quota}
+	}
+}
+
+// BucketCacheQuota - bounds the objects of bucket to quota bytes of the cache
+// directory, besides the quota of the cache. The bucket is evicted down to
+// its share first when above it.
+func BucketCacheQuota(bucket string, quota int64) func(*Config) {
+	return func(cfg *Config) {
+		if cfg.bucketQuotas == nil {
+			cfg.bucketQuotas = map[string]int64{}
+		}
+		cfg.bucketQuotas[bucket] = quota
+	}
+}
+
+// BucketSSEC - reads and writes the objects of bucket encrypted with the
+// customer key (SSE-C), of 32 bytes.
+func BucketSSEC(bucket string, key []byte) func(*Config) {
+	return func(cfg *Config) {
+		sse, err := encrypt.NewSSEC(key)
+		if err != nil {
+			cfg.sseErr = fmt.Errorf("Customer key of bucket %s invalid, %v", bucket, err)
+			return
+		}
+		cfg.setSSE(bucket, sse)
+	}
+}
+
+// BucketSSECKeyFile - reads and writes the objects of bucket encrypted with
+// the customer key (SSE-C) in the file at path, as 32 bytes or base64
+// encoded.
+func BucketSSECKeyFile(bucket, path string) func(*Config) {
+	return func(cfg *Config) {
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			cfg.sseErr = err
+			return
+		}
+		if len(key) != 32 {
+			if key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(key))); err != nil {
+				cfg.sseErr = fmt.Errorf("Customer key of bucket %s invalid, pass 32 bytes or base64 encoded", bucket)
+				return
+			}
+		}
+		BucketSSEC(bucket, key)(cfg)
+	}
+}
+
+// BucketSSEKMS - writes the objects of bucket encrypted with the KMS key
+// keyID (SSE-KMS), the server decrypts them on read.
+func BucketSSEKMS(bucket, keyID string) func(*Config) {
+	return func(cfg *Config) {
+		sse, err := encrypt.NewSSEKMS(keyID, nil)
+		if err != nil {
+			cfg.sseErr = fmt.Errorf("KMS key of bucket %s invalid, %v", bucket, err)
+			return
+		}
+		cfg.setSSE(bucket, sse)
+	}
+}
+
+func (cfg *Config) setSSE(bucket string, sse encrypt.ServerSide) {
+	if cfg.sse == nil {
+		cfg.sse = map[string]encrypt.ServerSide{}
+	}
+	cfg.sse[bucket] = sse
+}
+
+// MaxCacheFileSize - objects larger than size bytes are streamed from the
+// server instead of cached, by default the limit of the cache filesystem.
+func MaxCacheFileSize(size int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.maxCacheFileSize = size
+	}
+}
+
+// CacheQuota - cache quota in GB.
 func CacheQuota(size int) func(*Config) {
+	return CacheQuotaBytes(int64(size) << 30)
+}
+
+// CacheQuotaBytes - cache quota in bytes.
+func CacheQuotaBytes(size int64) func(*Config) {
 	return func(cfg *Config) {
 		cfg.quota = size
 	}
 }
 
-// SetGID - sets a custom gid for the mount.
-func SetGID(gid uint32) func(*Config) {
+// CacheHighWatermark - eviction starts once the cache is above this
+// fraction of its quota, by default the quota itself.
+func CacheHighWatermark(fraction float64) func(*Config) {
 	return func(cfg *Config) {
-		cfg.gid = gid
+		cfg.highWatermark = fraction
 	}
 }
 
-// SetUID - sets a custom uid for the mount.
-func SetUID(uid uint32) func(*Config) {
+// CacheLowWatermark - eviction evicts the cache down to this fraction of its
+// quota in one pass, by default 80%, so it doesn't evict a file at a time
+// while the cache sits at its quota.
+func CacheLowWatermark(fraction float64) func(*Config) {
 	return func(cfg *Config) {
-		cfg.uid = uid
+		cfg.lowWatermark = fraction
 	}
 }
 
-// Insecure - enable insecure mode.
-func Insecure() func(*Config) {
+// LocalRetries - number of times a cache file operation is retried on
+// transient local errors (EAGAIN, EMFILE, ...), 0 disables retrying.
+func LocalRetries(n int) func(*Config) {
 	return func(cfg *Config) {
-		cfg.insecure = true
+		cfg.localRetries = n
 	}
 }
 
-// Debug - enables debug logging.
-func Debug() func(*Config) {
+// MaxRequestsPerSecond - limits the S3 requests issued per second, 0 is unlimited.
+func MaxRequestsPerSecond(n int) func(*Config) {
 	return func(cfg *Config) {
-		cfg.debug = true
+		cfg.maxRequests = n
 	}
 }
 
-// Validates the config for sane values.
-func (cfg *Config) validate() error {
-	// check if mountpoint exists
-	if cfg.mountpoint == "" {
-		return errors.New("Mountpoint not set")
+// RetryBudget - limits the retries of failed S3 requests per second across
+// all requests, requests fail without retrying once it is spent. 0 is unlimited.
+func RetryBudget(n int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.retryBudget = n
 	}
+}
 
-	if cfg.target == nil {
-		return errors.New("Target not set")
+// MaxRetries - retries requests failing transiently up to n times, 0
+// doesn't retry.
+func MaxRetries(n int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.maxRetries = n
+	}
+}
+
+// RetryBackoff - caps the backoff between retries of failed requests,
+// which doubles from 200ms on every retry.
+func RetryBackoff(max time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.retryBackoff = max
+	}
+}
+
+// NodeCacheSize - number of recently resolved nodes kept in memory, 0 disables it.
+func NodeCacheSize(n int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.nodeCacheSize = n
+	}
+}
+
+// ListingCacheTTL - how long the listing of a directory is kept in memory,
+// so lookups in a directory just listed don't list it again, 0 disables it.
+func ListingCacheTTL(ttl time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.listingCacheTTL = ttl
+	}
+}
+
+// BucketListTTL - how long the buckets listed at the root are kept in
+// memory, so listings and lookups at the root don't list the buckets
+// again, 0 lists them with the listing cache ttl.
+func BucketListTTL(ttl time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.bucketListTTL = ttl
+	}
+}
+
+// StatCacheTTL - how long an object listed or stat is opened without
+// stating it again, 0 stats it on every open.
+func StatCacheTTL(ttl time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.statCacheTTL = ttl
+	}
+}
+
+// TagCacheTTL - how long the tags of an object are read as attributes
+// without fetching them again, 0 fetches them on every read.
+func TagCacheTTL(ttl time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.tagCacheTTL = ttl
+	}
+}
+
+// OpTimeout - bounds a stat or listing of the servers done for a request,
+// 0 doesn't bound them.
+func OpTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.opTimeout = timeout
+	}
+}
+
+// DownloadTimeout - bounds the download of an object to the cache, 0
+// doesn't bound it.
+func DownloadTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.downloadTimeout = timeout
+	}
+}
+
+// SlowDownload - logs a warning for the downloads from the servers taking
+// longer than threshold, with the key, size and throughput. 0 never logs.
+func SlowDownload(threshold time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.slowDownload = threshold
+	}
+}
+
+// CacheReconcile - checks every interval that the objects opened since the
+// mount still exist on the servers, the cache files of those removed are
+// dropped. 0, the default, never checks, a removed object is found when
+// opened.
+func CacheReconcile(interval time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.reconcileInterval = interval
+	}
+}
+
+// SweepOrphans - removes the cache files of versions no longer on the
+// servers on start, before the mount is served. Every cache file whose key
+// is known from its name is stat, in each bucket it may be of.
+func SweepOrphans() func(*Config) {
+	return func(cfg *Config) {
+		cfg.sweepOrphans = true
+	}
+}
+
+// PresignExpiry - how long the presigned urls read from the files are
+// valid, an hour by default and at most 7 days.
+func PresignExpiry(expiry time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.presignExpiry = expiry
+	}
+}
+
+// HealthAddr - serves the liveness (/healthz) and readiness (/readyz)
+// probes at addr.
+func HealthAddr(addr string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.healthAddr = addr
+	}
+}
+
+// Canary - reads the object at bucket/key every interval, through the same
+// paths as the kernel does. The mount isn't ready while the canary fails.
+func Canary(bucket, key string, interval time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.canary = &canaryConfig{
+			bucket:   bucket,
+			key:      key,
+			interval: interval,
+		}
+	}
+}
+
+// MetricsAddr - serves the metrics of the mount at /metrics on addr, in the
+// Prometheus format.
+func MetricsAddr(addr string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.metricsAddr = addr
+	}
+}
+
+// CachePeerAddr - serves the cached objects to peers at addr.
+func CachePeerAddr(addr string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.peerAddr = addr
+	}
+}
+
+// CachePeers - peers asked for an object on a cache miss, before fetching
+// it from the server. A peer is the url of its cache peer address.
+func CachePeers(peers []string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.cachePeers = peers
+	}
+}
+
+// CachePeerSecret - the secret shared by the peers of a cache, requests
+// between peers are signed with it. Peers refuse requests signed otherwise.
+func CachePeerSecret(secret string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.peerSecret = []byte(secret)
+	}
+}
+
+// SetGID - sets a custom gid for the mount.
+func SetGID(gid uint32) func(*Config) {
+	return func(cfg *Config) {
+		cfg.gid = gid
+	}
+}
+
+// SetUID - sets a custom uid for the mount.
+func SetUID(uid uint32) func(*Config) {
+	return func(cfg *Config) {
+		cfg.uid = uid
+	}
+}
+
+// FileMode - sets the permissions of the files, 0444 by default.
+func FileMode(mode os.FileMode) func(*Config) {
+	return func(cfg *Config) {
+		cfg.mode = mode
+	}
+}
+
+// DirMode - sets the permissions of the directories, the root and buckets
+// as well as prefixes, 0755 by default.
+func DirMode(mode os.FileMode) func(*Config) {
+	return func(cfg *Config) {
+		cfg.dirMode = mode
+	}
+}
+
+// AssumeRole - signs requests with temporary credentials of the role,
+// assumed with the access and secret keys at endpoint. The role ARN is
+// optional for MinIO, which derives the role from the keys. An invalid
+// endpoint is reported by validate.
+func AssumeRole(endpoint, roleARN string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.sts = &stsConfig{roleARN: roleARN}
+		cfg.sts.endpoint, cfg.stsErr = parseEndpoint(endpoint)
+	}
+}
+
+// WebIdentity - signs requests with temporary credentials exchanged for the
+// web identity token in tokenFile at endpoint. The file is read again on
+// every refresh. An invalid endpoint is reported by validate.
+func WebIdentity(endpoint, tokenFile string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.sts = &stsConfig{tokenFile: tokenFile}
+		cfg.sts.endpoint, cfg.stsErr = parseEndpoint(endpoint)
+	}
+}
+
+// IAMRole - signs requests with the credentials of the IAM role of the
+// node: from the web identity of the service account on EKS, the container
+// credentials on ECS, or the instance metadata on EC2. endpoint overrides
+// the STS or metadata endpoint asked, empty asks the one of the platform.
+// The credentials are fetched again shortly before they expire.
+func IAMRole(endpoint string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.iam = true
+		cfg.iamEndpoint = endpoint
+	}
+}
+
+// CredentialRefresh - fetches the access and secret keys and session token
+// again through fn, once the servers reject them as expired. By default
+// they're read again from the environment.
+func CredentialRefresh(fn func() (AccessConfig, error)) func(*Config) {
+	return func(cfg *Config) {
+		cfg.refresh = fn
+	}
+}
+
+// UserCredentials - signs the requests of uids with their own credentials,
+// read from the JSON file at path mapping uids to access configs. Other
+// uids use the mount credentials. An unreadable file is reported by
+// validate.
+func UserCredentials(path string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.users, cfg.usersErr = loadUserCredentials(path)
+	}
+}
+
+// DenyUnknownUsers - denies the requests of uids without credentials of
+// their own with EACCES, besides the uid of the mount.
+func DenyUnknownUsers() func(*Config) {
+	return func(cfg *Config) {
+		cfg.denyUnknownUsers = true
+	}
+}
+
+// Anonymous - uids without credentials of their own make anonymous
+// requests, unsigned, instead of using the mount credentials, besides the
+// uid of the mount. They can only read public buckets. A mount without keys
+// is anonymous for every uid regardless.
+func Anonymous() func(*Config) {
+	return func(cfg *Config) {
+		cfg.anonymous = true
+	}
+}
+
+// WithCredentialProvider - signs requests with the credentials of p, for
+// credentials kept in a secret store or broker. It overrides the keys of
+// the environment, STS and the credentials of users.
+func WithCredentialProvider(p CredentialProvider) func(*Config) {
+	return func(cfg *Config) {
+		cfg.provider = p
+	}
+}
+
+// Region - region requests are signed for, on every endpoint. By default
+// the region of each bucket is looked up from the server.
+func Region(region string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.region = region
+	}
+}
+
+// BucketLookup - addresses buckets in the path of requests with "path", in
+// the host name with "dns", or by what the endpoint supports with "auto",
+// the default: in the host name on AWS and Google Cloud Storage, in the
+// path elsewhere.
+func BucketLookup(style string) func(*Config) {
+	return func(cfg *Config) {
+		switch style {
+		case "auto":
+			cfg.bucketLookup = minio.BucketLookupAuto
+		case "path":
+			cfg.bucketLookup = minio.BucketLookupPath
+		case "dns":
+			cfg.bucketLookup = minio.BucketLookupDNS
+		default:
+			cfg.bucketLookupErr = fmt.Errorf("Bucket lookup %q is not one of auto, path or dns", style)
+		}
+	}
+}
+
+// awsRegionalHost matches the regional endpoints of AWS S3, which only
+// accept requests signed for their region.
+var awsRegionalHost = regexp.MustCompile(`^s3(?:\.dualstack)?[.-]([a-z0-9-]+)\.amazonaws\.com$`)
+
+// regionName matches the names of regions, as us-east-1.
+var regionName = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// ReadOnly - mounts read only, every operation changing the mount fails
+// with EROFS.
+func ReadOnly() func(*Config) {
+	return func(cfg *Config) {
+		cfg.readOnly = true
+	}
+}
+
+// CACert - trusts the CA certificates of the PEM bundle at path for https
+// endpoints, besides the system ones. An unreadable bundle is reported by
+// validate.
+func CACert(path string) func(*Config) {
+	return func(cfg *Config) {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			cfg.caErr = err
+			return
+		}
+		CACertPEM(pem)(cfg)
+	}
+}
+
+// CACertPEM - trusts the CA certificates of the PEM bundle for https
+// endpoints, besides the system ones.
+func CACertPEM(pem []byte) func(*Config) {
+	return func(cfg *Config) {
+		if cfg.rootCAs == nil {
+			if cfg.rootCAs, _ = x509.SystemCertPool(); cfg.rootCAs == nil {
+				cfg.rootCAs = x509.NewCertPool()
+			}
+		}
+
+		if !cfg.rootCAs.AppendCertsFromPEM(pem) {
+			cfg.caErr = errors.New("no certificate in the PEM bundle")
+		}
+	}
+}
+
+// Insecure - enable insecure mode, certificates of https endpoints aren't
+// verified. It overrides CACert.
+func Insecure() func(*Config) {
+	return func(cfg *Config) {
+		cfg.insecure = true
+	}
+}
+
+// Proxy - sends every request through the forward proxy at proxyURL, as
+// `http://proxy:3128`, `https://proxy` or `socks5://proxy:1080`, a bare
+// `host:port` is an http proxy. Without it the proxy is taken from
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY. An invalid url is reported by
+// validate.
+func Proxy(proxyURL string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.proxy, cfg.proxyErr = parseProxy(proxyURL)
+	}
+}
+
+// parseProxy parses the url of a forward proxy.
+func parseProxy(proxyURL string) (*url.URL, error) {
+	if proxyURL == "" {
+		return nil, errors.New("no proxy given")
+	}
+
+	if !strings.Contains(proxyURL, "://") {
+		proxyURL = "http://" + proxyURL
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected http, https or socks5", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %q", proxyURL)
+	}
+	return u, nil
+}
+
+// Debug - enables debug logging.
+func Debug() func(*Config) {
+	return func(cfg *Config) {
+		cfg.debug = true
+	}
+}
+
+// routeURLs returns the endpoints of routes.
+func routeURLs(routes map[string]*url.URL) (urls []*url.URL) {
+	for _, u := range routes {
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// nestedPaths returns if one of the paths is the other or below it.
+func nestedPaths(a, b string) bool {
+	a, aerr := filepath.Abs(a)
+	b, berr := filepath.Abs(b)
+	if aerr != nil || berr != nil {
+		return false
+	}
+
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
+
+// checkCacheDir makes the cache directory dir when missing, and checks
+// files can be made in it.
+func checkCacheDir(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	probe, err := ioutil.TempFile(dir, ".probe")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Validates the config for sane values.
+func (cfg *Config) validate() error {
+	// check if mountpoint exists
+	if cfg.mountpoint == "" {
+		return errors.New("Mountpoint not set")
+	}
+
+	if cfg.targetErr != nil {
+		return fmt.Errorf("Target is not valid: %v", cfg.targetErr)
+	}
+
+	if cfg.target == nil {
+		return errors.New("Target not set")
+	}
+
+	if cfg.caErr != nil {
+		return fmt.Errorf("CA certificate is not valid: %v", cfg.caErr)
+	}
+
+	if cfg.proxyErr != nil {
+		return fmt.Errorf("Proxy is not valid: %v", cfg.proxyErr)
+	}
+
+	if cfg.stsErr != nil {
+		return fmt.Errorf("STS endpoint is not valid: %v", cfg.stsErr)
+	}
+
+	if cfg.iam && cfg.sts != nil {
+		return errors.New("IAM role credentials can't be combined with STS")
+	}
+
+	if cfg.iam && (cfg.accessKey != "" || cfg.secretKey != "") {
+		return errors.New("IAM role credentials can't be combined with access and secret keys")
+	}
+
+	if cfg.sts != nil && cfg.sts.tokenFile == "" && (cfg.accessKey == "" || cfg.secretKey == "") {
+		return errors.New("Assuming a role needs the access and secret keys")
+	}
+
+	if cfg.anonymous && cfg.denyUnknownUsers {
+		return errors.New("Anonymous access can't be combined with denying unknown users")
+	}
+
+	if cfg.usersErr != nil {
+		return fmt.Errorf("User credentials are not valid: %v", cfg.usersErr)
+	}
+
+	for uid, ac := range cfg.users {
+		if ac.AccessKey == "" || ac.SecretKey == "" {
+			return fmt.Errorf("Credentials of uid %d need an access and a secret key", uid)
+		}
+	}
+
+	if cfg.quota < 0 {
+		return errors.New("Cache quota can't be negative")
+	}
+
+	// A quota below a few files evicts every file as soon as it's cached.
+	if cfg.quota < globalMinQuota {
+		return fmt.Errorf("Cache quota of %s is below the minimum of %s", humanSize(cfg.quota), humanSize(globalMinQuota))
+	}
+
+	// (uid_t)-1 leaves the owner unchanged to chown, no file has it.
+	if cfg.uid == math.MaxUint32 || cfg.gid == math.MaxUint32 {
+		return errors.New("Uid and gid can't be -1")
+	}
+
+	// Files without a mode can't be read by anyone.
+	if cfg.mode == 0 {
+		cfg.mode = globalFileMode
+	}
+
+	if cfg.mode&^os.ModePerm != 0 {
+		return fmt.Errorf("File mode %v has more than permission bits", cfg.mode)
+	}
+
+	// Directories without a mode can't be traversed by anyone.
+	if cfg.dirMode == 0 {
+		cfg.dirMode = globalDirMode
+	}
+
+	if cfg.dirMode&^os.ModePerm != 0 {
+		return fmt.Errorf("Directory mode %v has more than permission bits", cfg.dirMode)
+	}
+
+	if cfg.lowWatermark <= 0 || cfg.lowWatermark >= cfg.highWatermark || cfg.highWatermark > 1 {
+		return errors.New("Cache watermarks need a low watermark above 0 and below the high watermark, which can't be above 1")
+	}
+
+	if cfg.bucketLookupErr != nil {
+		return cfg.bucketLookupErr
+	}
+
+	if cfg.region != "" && !regionName.MatchString(cfg.region) {
+		return fmt.Errorf("Region %q is not valid", cfg.region)
+	}
+
+	for bucket, u := range cfg.routes {
+		if u == nil {
+			return fmt.Errorf("Endpoint for bucket %s is not a valid url", bucket)
+		}
+	}
+
+	// A regional AWS endpoint rejects requests signed for another region.
+	for _, endpoint := range append([]*url.URL{cfg.target}, routeURLs(cfg.routes)...) {
+		m := awsRegionalHost.FindStringSubmatch(endpoint.Hostname())
+		if m != nil && cfg.region != "" && cfg.region != m[1] {
+			return fmt.Errorf("Region %s doesn't match the region of endpoint %s", cfg.region, endpoint.Host)
+		}
+	}
+
+	if cfg.maxRequests < 0 {
+		return errors.New("Max requests per second can't be negative")
+	}
+
+	// Listings split on another delimiter don't carry the metadata of objects.
+	if cfg.delimiter != "/" && cfg.delimiter != "" && (cfg.preservePOSIXMeta || cfg.symlinkType != "") {
+		return fmt.Errorf("Delimiter %q can't be combined with POSIX metadata or symlinks", cfg.delimiter)
+	}
+	if cfg.delimiter == "" && len(cfg.unions) > 0 {
+		return errors.New("Unions can't be presented in a flat listing")
+	}
+
+	if cfg.maxPathDepth < 0 {
+		return errors.New("Max path depth can't be negative")
+	}
+
+	if cfg.retryBudget < 0 {
+		return errors.New("Retry budget can't be negative")
+	}
+
+	if cfg.statCacheTTL < 0 {
+		return errors.New("Stat cache ttl can't be negative")
+	}
+
+	if cfg.tagCacheTTL < 0 {
+		return errors.New("Tag cache ttl can't be negative")
+	}
+
+	if cfg.bucketListTTL < 0 {
+		return errors.New("Bucket list ttl can't be negative")
+	}
+
+	if cfg.cacheCompression != "" && cfg.cacheCompression != "zstd" {
+		return fmt.Errorf("Cache compression %s is not supported, pass zstd", cfg.cacheCompression)
+	}
+
+	if cfg.sseErr != nil {
+		return cfg.sseErr
+	}
+	for bucket := range cfg.sse {
+		if bucket == "" || strings.Contains(bucket, "/") {
+			return fmt.Errorf("Encrypted bucket %q is not a valid bucket name", bucket)
+		}
+	}
+
+	if cfg.cacheKeyErr != nil {
+		return fmt.Errorf("Cache encryption key invalid, %v", cfg.cacheKeyErr)
+	}
+	// Sparse files and files served to peers would be kept in the clear.
+	if cfg.cacheCipher != nil && cfg.rangeReads {
+		return errors.New("Cache encryption can't be combined with range reads")
+	}
+	if cfg.cacheCipher != nil && (cfg.peerAddr != "" || len(cfg.cachePeers) > 0) {
+		return errors.New("Cache encryption can't be combined with cache peers")
+	}
+
+	// Cache files are served as the uids that fetched them could read them,
+	// only peers may ask for them.
+	if (cfg.peerAddr != "" || len(cfg.cachePeers) > 0) && len(cfg.peerSecret) == 0 {
+		return errors.New("Cache peers need a shared secret, set it in MINFS_PEER_SECRET")
+	}
+
+	if cfg.opTimeout < 0 {
+		return errors.New("Operation timeout can't be negative")
+	}
+
+	if cfg.downloadTimeout < 0 {
+		return errors.New("Download timeout can't be negative")
+	}
+
+	if cfg.slowDownload < 0 {
+		return errors.New("Slow download threshold can't be negative")
+	}
+
+	if cfg.reconcileInterval < 0 {
+		return errors.New("Cache reconcile interval can't be negative")
+	}
+
+	if cfg.presignExpiry < time.Second || cfg.presignExpiry > globalMaxPresignExpiry {
+		return fmt.Errorf("Presign expiry of %v isn't between a second and %v", cfg.presignExpiry, globalMaxPresignExpiry)
+	}
+
+	if cfg.maxRetries < 0 {
+		return errors.New("Max retries can't be negative")
+	}
+
+	if cfg.retryBackoff <= 0 {
+		return errors.New("Retry backoff must be positive")
+	}
+
+	if (cfg.streamPartSize != 0 && cfg.streamPartSize < minPartSize) || cfg.streamThreshold < 0 {
+		return fmt.Errorf("Streaming uploads need parts of at least %d bytes and a threshold that isn't negative", minPartSize)
+	}
+
+	if cfg.readahead < 0 {
+		return errors.New("Readahead can't be negative")
+	}
+
+	if cfg.downloadConcurrency < 0 || cfg.downloadThreshold < 0 {
+		return errors.New("Download concurrency and threshold can't be negative")
+	}
+
+	if cfg.maxCacheFileSize < 0 {
+		return errors.New("Max cache file size can't be negative")
+	}
+
+	if cfg.canary != nil && (cfg.canary.bucket == "" || cfg.canary.key == "" || cfg.canary.interval <= 0) {
+		return errors.New("Canary needs a bucket, key and positive interval")
+	}
+
+	if cfg.cache == "" {
+		return errors.New("Cache directory not set")
+	}
+
+	// A cache directory inside another would be evicted by both quotas.
+	dirs := []string{cfg.cache}
+	for bucket, bc := range cfg.bucketCaches {
+		if bc.dir == "" || bc.quota < 0 {
+			return fmt.Errorf("Cache directory of bucket %s needs a path and a quota that isn't negative", bucket)
+		}
+
+		for _, dir := range dirs {
+			if nestedPaths(dir, bc.dir) {
+				return fmt.Errorf("Cache directory %s of bucket %s overlaps cache directory %s", bc.dir, bucket, dir)
+			}
+		}
+		dirs = append(dirs, bc.dir)
+	}
+
+	for bucket, quota := range cfg.bucketQuotas {
+		if bucket == "" || strings.Contains(bucket, "/") {
+			return fmt.Errorf("Bucket %q of a cache quota is not a valid bucket name", bucket)
+		}
+		if quota <= 0 {
+			return fmt.Errorf("Cache quota of bucket %s must be positive", bucket)
+		}
+		// A bucket cached in its own directory has its quota there.
+		if _, ok := cfg.bucketCaches[bucket]; ok {
+			return fmt.Errorf("Cache quota of bucket %s can't be combined with its cache directory", bucket)
+		}
+	}
+
+	// Walking a cache directory in the mount would walk the mount.
+	for _, dir := range dirs {
+		if nestedPaths(dir, cfg.mountpoint) {
+			return fmt.Errorf("Cache directory %s overlaps mountpoint %s", dir, cfg.mountpoint)
+		}
+		if err := checkCacheDir(dir); err != nil {
+			return fmt.Errorf("Cache directory %s is not usable: %v", dir, err)
+		}
+	}
+
+	for _, ext := range cfg.archiveExts {
+		if ext == "" || strings.Contains(ext, "/") {
+			return fmt.Errorf("Archive extension %q is not valid", ext)
+		}
+	}
+
+	for _, bucket := range cfg.staticBuckets {
+		if bucket == "" || strings.Contains(bucket, "/") {
+			return fmt.Errorf("Static bucket %q is not a valid bucket name", bucket)
+		}
+	}
+
+	for _, bucket := range cfg.allowedBuckets {
+		if bucket == "" || strings.Contains(bucket, "/") {
+			return fmt.Errorf("Allowed bucket %q is not a valid bucket name", bucket)
+		}
+	}
+	if len(cfg.allowedBuckets) > 0 && len(cfg.staticBuckets) > 0 {
+		return errors.New("Allowed buckets and static buckets can't be combined")
+	}
+
+	if cfg.root != "" {
+		for _, elem := range strings.Split(cfg.root, "/") {
+			if elem == "" || elem == "." || elem == ".." {
+				return fmt.Errorf("Root %s is not a valid bucket or prefix", cfg.root)
+			}
+		}
+		if len(cfg.allowedBuckets) > 0 || len(cfg.staticBuckets) > 0 {
+			return errors.New("Root can't be combined with allowed or static buckets")
+		}
+		if cfg.canary != nil && !strings.HasPrefix(path.Join(cfg.canary.bucket, cfg.canary.key), cfg.root+"/") {
+			return fmt.Errorf("Canary %s/%s must be below the root %s", cfg.canary.bucket, cfg.canary.key, cfg.root)
+		}
+	}
+
+	for name, prefixes := range cfg.unions {
+		bucket := strings.Split(name, "/")[0]
+		if !strings.Contains(name, "/") {
+			return fmt.Errorf("Union %s must be a directory in a bucket", name)
+		}
+		for _, prefix := range prefixes {
+			if strings.Split(strings.Trim(prefix, "/"), "/")[0] != bucket {
+				return fmt.Errorf("Union %s prefix %s is not in bucket %s", name, prefix, bucket)
+			}
+		}
 	}
 
 	return nil
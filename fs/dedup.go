@@ -0,0 +1,169 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// addContent remembers that the cache file at path holds the object
+// version with etag, objects cached later with the same etag link to it.
+// Block cache files are laid out by their own key, they aren't shared.
+func (mfs *MinFS) addContent(etag, path string) {
+	if !mfs.config.cacheDedup || etag == "" || isBlockCachePath(path) {
+		return
+	}
+
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	mfs.contents[etag] = filepath.Clean(path)
+}
+
+// forgetContent forgets that the cache file at path holds the version with
+// etag, once it is gone or changed in place.
+func (mfs *MinFS) forgetContent(etag, path string) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	if mfs.contents[etag] == filepath.Clean(path) {
+		delete(mfs.contents, etag)
+	}
+}
+
+// linkContent caches the object version at path as a link to the cache
+// file holding a version with its etag, and returns if it did. A file that
+// doesn't have the size of the object or is open for writing isn't linked,
+// it is fetched instead. Callers hold the km lock of path.
+func (mfs *MinFS) linkContent(path string, object minio.ObjectInfo) bool {
+	if !mfs.config.cacheDedup || isBlockCachePath(path) {
+		return false
+	}
+
+	mfs.m.Lock()
+	source, ok := mfs.contents[object.ETag]
+	mfs.m.Unlock()
+	if !ok || source == filepath.Clean(path) {
+		return false
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		mfs.log.Errorln("Unable to link cache file", path, err)
+		return false
+	}
+
+	if err := os.Link(source, path); err != nil {
+		if os.IsNotExist(err) {
+			mfs.forgetContent(object.ETag, source)
+		} else {
+			mfs.log.Errorln("Unable to link cache file", path, "to", source, err)
+		}
+		return false
+	}
+
+	// A writer unsharing the source forgets it before counting its links,
+	// one made meanwhile may have been missed and would be written through.
+	if !mfs.sharedContent(object.ETag, source) {
+		mfs.log.Debugln("Cache file", source, "written meanwhile, fetching", object.Key, "instead")
+		os.Remove(path)
+		return false
+	}
+
+	info, err := mfs.statLocal(path)
+	if err != nil || mfs.cachedSize(path, info) != object.Size {
+		mfs.log.Errorln("Cache file", source, "doesn't hold", object.Key, "fetching it instead")
+		os.Remove(path)
+		mfs.forgetContent(object.ETag, source)
+		return false
+	}
+
+	mfs.cacheAdded(path, info)
+	mfs.log.Debugln("Linked cache file", path, "to", source)
+	return true
+}
+
+// sharedContent returns if the cache file at source still holds the version
+// with etag for others to link to, and isn't open for writing.
+func (mfs *MinFS) sharedContent(etag, source string) bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	if mfs.contents[etag] != source {
+		return false
+	}
+	for _, ws := range mfs.writers {
+		if filepath.Clean(ws.cachePath) == source {
+			return false
+		}
+	}
+	return true
+}
+
+// unshareCache gives the cache file at path holding the version with etag
+// a copy of its own when it is linked at other paths, before it is written
+// in place, so the other links keep holding their version. Callers hold the
+// km lock of path.
+func (mfs *MinFS) unshareCache(path, etag string) error {
+	mfs.forgetContent(etag, path)
+
+	info, err := mfs.statLocal(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil || linkCount(info) <= 1 {
+		return err
+	}
+
+	// Left by a crash midway, a copy aside is swept as a partial download.
+	tmp := path + ".part.minio"
+	if err = copyFile(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if info, err = mfs.statLocal(path); err != nil {
+		return err
+	}
+	mfs.cacheAdded(path, info)
+	return nil
+}
+
+// copyFile copies the file at src to a new file at dst.
+func copyFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
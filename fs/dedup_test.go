@@ -0,0 +1,62 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// sharedSource caches data as the version with etag for others to link to.
+func sharedSource(t *testing.T, mfs *MinFS, etag string, data []byte) string {
+	source := filepath.Join(mfs.config.cache, "source")
+	if err := ioutil.WriteFile(source, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mfs.addContent(etag, source)
+	return source
+}
+
+func TestLinkContent(t *testing.T) {
+	mfs := newTestFS(t, newFakeS3(t, "bucket"), CacheDedup())
+	sharedSource(t, mfs, "etag", []byte("data"))
+
+	path := filepath.Join(mfs.config.cache, "linked")
+	if !mfs.linkContent(path, minio.ObjectInfo{Key: "object", ETag: "etag", Size: 4}) {
+		t.Fatal("cache file not linked")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "data" {
+		t.Fatalf("linked cache file holds %q, %v", data, err)
+	}
+}
+
+func TestLinkContentSkipsWrittenSource(t *testing.T) {
+	mfs := newTestFS(t, newFakeS3(t, "bucket"), CacheDedup())
+	source := sharedSource(t, mfs, "etag", []byte("data"))
+	mfs.addWriter("bucket/source", source, 0)
+
+	path := filepath.Join(mfs.config.cache, "linked")
+	if mfs.linkContent(path, minio.ObjectInfo{Key: "object", ETag: "etag", Size: 4}) {
+		t.Fatal("cache file linked to a file open for writing")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("link to a file open for writing left behind: %v", err)
+	}
+}
@@ -16,11 +16,14 @@
 package minfs
 
 import (
+	"bytes"
 	"context"
-	"fmt"
+	"errors"
+	"net/url"
 	"os"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -30,6 +33,10 @@ import (
 	minio "github.com/minio/minio-go/v7"
 )
 
+// errListTruncated is returned with the partial entries of a listing that
+// failed midway, unless the listing is strict.
+var errListTruncated = errors.New("Listing truncated")
+
 type FilesystemElement interface { // Okay i like it, Picasso
 	Dirpath() string
 	Dirent() fuse.Dirent
@@ -65,17 +72,19 @@ type Dir struct {
 
 // Attr returns the attributes for the directory
 func (dir *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	mtime := dir.mfs.dirTime(dir.FullPath(), dir.Mtime)
 	*a = fuse.Attr{
 		Inode:  dir.Inode,
 		Size:   dir.Size,
-		Atime:  dir.Atime,
-		Mtime:  dir.Mtime,
-		Ctime:  dir.Chgtime,
-		Crtime: dir.Crtime,
+		Atime:  orTime(dir.Atime, mtime),
+		Mtime:  mtime,
+		Ctime:  orTime(dir.Chgtime, mtime),
+		Crtime: orTime(dir.Crtime, mtime),
 		Mode:   dir.Mode,
 		Uid:    dir.UID,
 		Gid:    dir.GID,
 		Flags:  dir.Flags,
+		Valid:  dir.mfs.nodes.Valid(dir.FullPath()),
 	}
 
 	return nil
@@ -99,14 +108,77 @@ func (dir *Dir) FullPath() string {
 	return fullPath
 }
 
+// childPath returns the full path of the entry name in dir.
+func (dir *Dir) childPath(name string) string {
+	return path.Join(dir.FullPath(), name)
+}
+
 // Bucket returns the first element of the fullpath
 func (dir *Dir) Bucket() string {
 	return strings.Split(dir.FullPath(), "/")[0]
 }
 
-// Search prefix returns everything after the bucket, or nothing if it is the bucket
+// Search prefix returns everything after the bucket, or nothing if it is the bucket.
+// The bucket is trimmed as the first element of the path, so elements
+// repeating it, as in `a/a/b`, stay in the prefix.
 func (dir *Dir) SearchPrefix() string {
-	return strings.Replace(dir.FullPath()+"/", dir.Bucket()+"/", "", 1)
+	rest := strings.TrimPrefix(strings.TrimPrefix(dir.FullPath(), dir.Bucket()), "/")
+	if rest == "" {
+		return ""
+	}
+	return dir.mfs.keyPath(rest) + dir.mfs.keyDelimiter()
+}
+
+// atMaxDepth returns if the entries of dir are at the max path depth, so
+// its subdirectories can't be presented.
+func (dir *Dir) atMaxDepth() bool {
+	if dir.mfs.flatListing() {
+		return true
+	}
+
+	max := dir.mfs.config.maxPathDepth
+	return max > 0 && strings.Count(dir.SearchPrefix(), dir.mfs.keyDelimiter())+1 >= max
+}
+
+// resolvesNames returns if the names in dir can be looked up one by one,
+// instead of scanning it. The buckets at the root and the entries of a
+// union are only known from a scan.
+func (dir *Dir) resolvesNames() bool {
+	_, union := dir.mfs.config.unions[dir.FullPath()]
+	return dir.Path != "" && !union
+}
+
+// dirTime returns the modification time of the directory at fullPath: the
+// newest object it held when last listed, else mtime it was presented
+// with, else the start of the mount.
+func (mfs *MinFS) dirTime(fullPath string, mtime time.Time) time.Time {
+	mfs.m.Lock()
+	t, ok := mfs.dirTimes[fullPath]
+	mfs.m.Unlock()
+
+	if ok {
+		return t
+	}
+	return orTime(mtime, mfs.started)
+}
+
+// setDirTime records t as the newest object of the directory at fullPath.
+func (mfs *MinFS) setDirTime(fullPath string, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+	mfs.dirTimes[fullPath] = t
+}
+
+// orTime returns t, or fallback when t is zero.
+func orTime(t, fallback time.Time) time.Time {
+	if t.IsZero() {
+		return fallback
+	}
+	return t
 }
 
 // Dirent will return the fuse Dirent for current dir
@@ -121,190 +193,1094 @@ func (dir Dir) Dirpath() string {
 	return dir.Path
 }
 
-// Returns FileElements given a scanRoot request (./)
+// Returns FileElements given a scanRoot request (./), buckets are listed
+// from every endpoint and each is presented from the endpoint it is routed to.
 func (dir *Dir) scanRoot(ctx context.Context, Uid uint32) (entries []FilesystemElement, err error) {
-	prefix := dir.FullPath()
-	if prefix != "" {
-		prefix = prefix + "/"
+	// A static bucket set is presented as is, without enumerating buckets.
+	if buckets := dir.mfs.config.staticBuckets; len(buckets) > 0 {
+		for _, key := range buckets {
+			entries = append(entries, dir.bucketEntry(key))
+		}
+		return entries, nil
 	}
 
-	api, err := dir.mfs.getApi(Uid)
-	if err != nil {
-		return nil, err
+	for _, endpoint := range dir.mfs.endpoints() {
+		api, err := dir.mfs.getEndpointApi(ctx, Uid, endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		var ch []minio.BucketInfo
+		octx, cancel := withTimeout(ctx, dir.mfs.config.opTimeout)
+		err = dir.mfs.retryExpired(octx, Uid, func() (err error) {
+			ch, err = api.ListBuckets(octx)
+			return err
+		})
+		if err != nil && timedOut(ctx, octx) {
+			cancel()
+			dir.mfs.log.Errorln("Listing of the buckets timed out after", dir.mfs.config.opTimeout)
+			return nil, fuse.EIO
+		}
+		cancel()
+		if minio.ToErrorResponse(err).Code == "AccessDenied" && len(dir.mfs.config.allowedBuckets) > 0 {
+			// Credentials allowed some buckets only may not list them, the
+			// buckets allowed are presented as they are.
+			if dir.mfs.bucketsDenied(endpoint) {
+				dir.mfs.log.Println("Listing of the buckets of", endpointKey(endpoint), "denied, presenting the buckets allowed instead")
+			}
+			for _, key := range dir.mfs.config.allowedBuckets {
+				if endpointKey(dir.mfs.endpointFor(key)) == endpointKey(endpoint) {
+					entries = append(entries, dir.bucketEntry(key))
+				}
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for idx := range ch {
+
+			key := ch[idx].Name
+			if endpointKey(dir.mfs.endpointFor(key)) != endpointKey(endpoint) {
+				continue
+			} else if !dir.mfs.bucketAllowed(key) {
+				continue
+			}
+
+			d := dir.bucketEntry(key)
+
+			// A bucket dates from its creation until listed.
+			d.Crtime, d.Mtime = ch[idx].CreationDate, ch[idx].CreationDate
+
+			entries = append(entries, d)
+		}
+	}
+
+	return dir.mfs.orderBuckets(entries), nil
+}
+
+// bucketEntry returns the entry of the bucket named key at the root.
+func (dir *Dir) bucketEntry(key string) Dir {
+	return Dir{
+		dir:   dir,
+		Path:  key,
+		Inode: dir.mfs.inodes.inode(key),
+		Mode:  dir.mfs.config.dirMode | os.ModeDir,
+		GID:   dir.mfs.config.gid,
+		UID:   dir.mfs.config.uid,
+	}
+}
+
+// bucketsDenied records that endpoint denies listing its buckets, and
+// returns if it is the first time, so the fallback is logged once.
+func (mfs *MinFS) bucketsDenied(endpoint *url.URL) bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	key := endpointKey(endpoint)
+	if mfs.deniedLists[key] {
+		return false
+	}
+	mfs.deniedLists[key] = true
+	return true
+}
+
+// bucketAllowed returns if bucket is presented at the root, every bucket is
+// without an allowlist.
+func (mfs *MinFS) bucketAllowed(bucket string) bool {
+	if len(mfs.config.allowedBuckets) == 0 {
+		return true
+	}
+	for _, name := range mfs.config.allowedBuckets {
+		if name == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// orderBuckets returns the buckets listed in the order of the allowlist.
+func (mfs *MinFS) orderBuckets(entries []FilesystemElement) []FilesystemElement {
+	if len(mfs.config.allowedBuckets) == 0 {
+		return entries
+	}
+
+	listed := map[string]FilesystemElement{}
+	for _, e := range entries {
+		listed[e.Dirpath()] = e
+	}
+
+	ordered := make([]FilesystemElement, 0, len(entries))
+	for _, name := range mfs.config.allowedBuckets {
+		if e, ok := listed[name]; ok {
+			ordered = append(ordered, e)
+			delete(listed, name)
+		}
+	}
+	return ordered
+}
+
+// Returns FileElements given a scanBucket request by querying minio, a
+// listing rejected for expired credentials is listed again once they're
+// refreshed. A listing failing transiently midway is listed again, and
+// truncated once the retries are spent. Listed again, it resumes after the
+// last key listed instead of listing the directory from the start.
+func (dir *Dir) scanBucket(ctx context.Context, uid uint32) (entries []FilesystemElement, err error) {
+	if prefixes, ok := dir.mfs.config.unions[dir.FullPath()]; ok {
+		return dir.scanUnion(ctx, uid, prefixes)
+	}
+
+	octx, cancel := withTimeout(ctx, dir.mfs.config.opTimeout)
+	defer cancel()
+
+	l := &listing{}
+	err = dir.mfs.retryExpired(octx, uid, func() error {
+		entries, err = dir.listBucket(octx, uid, l)
+		return err
+	})
+	if err != nil && timedOut(ctx, octx) {
+		dir.mfs.log.Errorln("Listing of", dir.FullPath(), "timed out after", dir.mfs.config.opTimeout)
+		return nil, fuse.EIO
+	} else if isTransientError(err) && !dir.mfs.config.strictListing {
+		dir.mfs.log.Errorln("Listing of", dir.FullPath(), "truncated after", len(entries), "entries:", err)
+		return entries, errListTruncated
 	}
+	return entries, err
+}
+
+// listing is what a listing of a directory got so far, so a listing cut
+// short resumes after the last key listed.
+type listing struct {
+	entries []FilesystemElement
+
+	// last key listed
+	after string
+
+	// directories hidden beyond the max depth
+	hidden int
+
+	// the directory is as new as its newest object, or marker
+	newest time.Time
+}
+
+// flatListing returns if buckets are listed recursively, every key
+// presented as a file below the bucket.
+func (mfs *MinFS) flatListing() bool {
+	return mfs.config.delimiter == ""
+}
 
-	ch, err := api.ListBuckets(ctx)
+// listBucket lists the entries of the directory, from the start or after
+// the last key of l. The listing is cancelled when it returns early, or
+// when the request is interrupted.
+//
+// Listed with ListObjectsV2 and the delimiter, a directory resuming after
+// its last key may be listed again, it is presented once.
+func (dir *Dir) listBucket(ctx context.Context, uid uint32, l *listing) (entries []FilesystemElement, err error) {
+	bucket := dir.Bucket()
+	prefix := dir.SearchPrefix()
 
+	api, err := dir.mfs.getBucketApi(ctx, uid, bucket)
 	if err != nil {
 		return nil, err
 	}
 
-	var seq uint64
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	for idx := range ch {
+	// Subdirectories at the max depth have entries beyond it, they're hidden.
+	hideDirs := dir.atMaxDepth()
+	d := dir.mfs.keyDelimiter()
 
-		key := ch[idx].Name
-		seq += 1
+	ch := dir.listKeys(ctx, api, minio.ListObjectsOptions{
+		Prefix:       prefix,
+		Recursive:    dir.mfs.flatListing(),
+		WithMetadata: dir.mfs.listMetadata(),
+		StartAfter:   l.after,
+		UseV1:        false,
+	})
 
-		var d = Dir{
-			dir:   dir,
-			Path:  key,
-			Inode: seq,
-			Mode:  0770 | os.ModeDir,
-			GID:   dir.mfs.config.gid,
-			UID:   dir.mfs.config.uid,
+	for objInfo := range ch {
+		if objInfo.Err != nil {
+			if dir.mfs.config.strictListing || isExpiredCredentials(objInfo.Err) {
+				return nil, objInfo.Err
+			} else if isTransientError(objInfo.Err) {
+				// Listed again, see scanBucket.
+				return l.entries, objInfo.Err
+			}
+
+			dir.mfs.log.Errorln("Listing of", dir.FullPath(), "truncated after", len(l.entries), "entries:", objInfo.Err)
+			return l.entries, errListTruncated
+		}
+
+		l.after = objInfo.Key
+		if objInfo.LastModified.After(l.newest) {
+			l.newest = objInfo.LastModified
+		}
+
+		// A flat listing has no directories, their markers aren't presented.
+		if dir.mfs.flatListing() && strings.HasSuffix(objInfo.Key, d) {
+			continue
 		}
 
-		entries = append(entries, d)
+		// Parts of appends in progress are gone once composed.
+		if dir.mfs.isAppendPart(bucket, objInfo.Key) {
+			continue
+		}
+
+		if hideDirs && strings.HasSuffix(objInfo.Key, d) && objInfo.Key != prefix {
+			l.hidden++
+			continue
+		}
+
+		if entry := dir.objectEntry(prefix, objInfo); entry != nil {
+			l.entries = append(l.entries, entry)
+		}
+	}
+
+	if l.hidden > 0 {
+		dir.mfs.log.Println("Hiding", l.hidden, "directories of", dir.FullPath(), "beyond the max path depth")
+	}
+	dir.mfs.setDirTime(dir.FullPath(), l.newest)
+
+	// An object and a directory of the same name, as `data` and `data/`,
+	// are presented as the directory. Resuming may list a directory twice.
+	entries = dir.dedupeEntries(l.entries)
+
+	// Directories made without a marker exist until the mount goes away.
+	for _, name := range dir.mfs.virtualDirs(dir.FullPath()) {
+		if hideDirs || containsPath(entries, name) {
+			continue
+		}
+		entries = append(entries, dir.virtualDir(name))
+	}
+
+	// Files created through the mount are listed before they're uploaded.
+	for _, f := range dir.mfs.createdFiles(dir.FullPath()) {
+		if !containsPath(entries, f.Path) {
+			f.dir = dir
+			entries = append(entries, f)
+		}
 	}
 
 	return entries, nil
 }
 
-// Returns FileElements given a scanBucket request by querying minio
-func (dir *Dir) scanBucket(ctx context.Context, uid uint32) (entries []FilesystemElement, err error) {
-
+// lookupBucket resolves the entry named name with a listing of one key
+// for the directory of that name and one for the object, instead of
+// listing the whole directory. Returns nil when there is no such entry.
+func (dir *Dir) lookupBucket(ctx context.Context, uid uint32, name string) (FilesystemElement, error) {
 	bucket := dir.Bucket()
 	prefix := dir.SearchPrefix()
+	key := prefix + dir.mfs.names.segment(name)
+	d := dir.mfs.keyDelimiter()
 
-	api, err := dir.mfs.getApi(uid)
+	api, err := dir.mfs.getBucketApi(ctx, uid, bucket)
 	if err != nil {
 		return nil, err
 	}
 
-	ch := api.ListObjects(ctx, bucket, minio.ListObjectsOptions{
-		Prefix:    prefix,
-		Recursive: false,
+	// A directory wins over an object of the same name, like in a scan.
+	if !dir.atMaxDepth() {
+		if _, ok, err := dir.firstKey(ctx, api, key+d); err != nil {
+			return nil, err
+		} else if ok {
+			return dir.objectEntry(prefix, minio.ObjectInfo{Key: key + d}), nil
+		}
+	}
+
+	// The object is the first key starting with its own name.
+	if objInfo, ok, err := dir.firstKey(ctx, api, key); err != nil {
+		return nil, err
+	} else if ok && objInfo.Key == key {
+		return dir.objectEntry(prefix, objInfo), nil
+	}
+
+	for _, dirName := range dir.mfs.virtualDirs(dir.FullPath()) {
+		if dirName == name && !dir.atMaxDepth() {
+			return dir.virtualDir(name), nil
+		}
+	}
+
+	for _, f := range dir.mfs.createdFiles(dir.FullPath()) {
+		if f.Path == name {
+			f.dir = dir
+			return f, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// firstKey returns the first key listed below prefix in the bucket of dir,
+// the listing is cancelled after it.
+func (dir *Dir) firstKey(ctx context.Context, api *minio.Client, prefix string) (minio.ObjectInfo, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objInfo, ok := <-dir.listKeys(ctx, api, minio.ListObjectsOptions{
+		Prefix:       prefix,
+		Recursive:    false,
+		MaxKeys:      1,
+		WithMetadata: dir.mfs.listMetadata(),
 	})
+	if !ok {
+		return objInfo, false, nil
+	}
+	return objInfo, objInfo.Err == nil, objInfo.Err
+}
 
-	var seq uint64
+// listKeys lists the keys of the bucket of dir as api.ListObjects does,
+// split into directories on the delimiter. ListObjects only splits on /,
+// other delimiters are listed page by page with ListObjectsV2, the common
+// prefixes listed as keys ending with the delimiter.
+func (dir *Dir) listKeys(ctx context.Context, api *minio.Client, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	d := dir.mfs.keyDelimiter()
+	if d == "/" || opts.Recursive {
+		return api.ListObjects(ctx, dir.Bucket(), opts)
+	}
 
-	for objInfo := range ch {
-		key := objInfo.Key[len(prefix):]
+	ch := make(chan minio.ObjectInfo, 1)
+	send := func(objInfo minio.ObjectInfo) bool {
+		select {
+		case ch <- objInfo:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 
-		seq += 1
+	go func() {
+		defer close(ch)
 
-		path := path.Base(key)
+		core := minio.Core{Client: api}
+		token := ""
+		for {
+			if ctx.Err() != nil {
+				return
+			}
 
-		if strings.HasSuffix(key, "/") {
-			var d = Dir{
-				dir:   dir,
-				Path:  path,
-				Inode: seq,
-				Mode:  0555 | os.ModeDir,
-				GID:   dir.mfs.config.gid,
-				UID:   dir.mfs.config.uid,
+			result, err := core.ListObjectsV2(dir.Bucket(), opts.Prefix, opts.StartAfter, token, d, opts.MaxKeys)
+			if err != nil {
+				send(minio.ObjectInfo{Err: err})
+				return
 			}
 
-			entries = append(entries, d)
-		} else {
-			var f = File{
-				dir:     dir,
-				Path:    path,
-				Size:    uint64(objInfo.Size),
-				Inode:   seq,
-				Mode:    dir.mfs.config.mode,
-				GID:     dir.mfs.config.gid,
-				UID:     dir.mfs.config.uid,
-				Chgtime: objInfo.LastModified,
-				Crtime:  objInfo.LastModified,
-				Mtime:   objInfo.LastModified,
-				Atime:   objInfo.LastModified,
-				ETag:    objInfo.ETag,
+			for _, objInfo := range result.Contents {
+				objInfo.ETag = strings.Trim(objInfo.ETag, "\"")
+				if !send(objInfo) {
+					return
+				}
 			}
-			entries = append(entries, f)
+			for _, p := range result.CommonPrefixes {
+				if !send(minio.ObjectInfo{Key: p.Prefix}) {
+					return
+				}
+			}
+
+			if !result.IsTruncated {
+				return
+			}
+			token = result.NextContinuationToken
 		}
+	}()
+	return ch
+}
+
+// objectEntry returns the entry presenting the object listed below prefix,
+// nil for the marker of the directory itself.
+func (dir *Dir) objectEntry(prefix string, objInfo minio.ObjectInfo) FilesystemElement {
+	key := objInfo.Key[len(prefix):]
+
+	// The marker of the directory itself.
+	if key == "" {
+		return nil
 	}
 
-	return entries, nil
+	// The listing isn't recursive, what follows the prefix is one element,
+	// with the delimiter for a directory. An empty element, as the `a//` of
+	// `a//b`, can't be presented. A flat listing presents all of it as the
+	// name of a file.
+	d := dir.mfs.keyDelimiter()
+	name := strings.TrimSuffix(key, d)
+	if dir.mfs.flatListing() {
+		name = key
+	} else if name == "" || strings.Contains(name, d) {
+		dir.mfs.log.Debugln("Hiding", objInfo.Key, "with an empty path element")
+		return nil
+	}
+
+	path := dir.mfs.names.present(name)
+	inode := dir.mfs.inodes.inode(dir.childPath(path))
+
+	if strings.HasSuffix(key, d) {
+		return Dir{
+			dir:   dir,
+			Path:  path,
+			Inode: inode,
+			Mode:  dir.mfs.config.dirMode | os.ModeDir,
+			GID:   dir.mfs.config.gid,
+			UID:   dir.mfs.config.uid,
+		}
+	} else if format := dir.mfs.archiveFormat(path); format != "" {
+		return ArchiveDir{
+			archive: &archiveObject{
+				bucket:   dir.Bucket(),
+				key:      objInfo.Key,
+				etag:     objInfo.ETag,
+				size:     objInfo.Size,
+				format:   format,
+				fullPath: dir.childPath(path),
+			},
+			Path:  path,
+			Inode: inode,
+			Mtime: objInfo.LastModified,
+			GID:   dir.mfs.config.gid,
+			UID:   dir.mfs.config.uid,
+		}
+	}
+
+	crtime := objInfo.LastModified
+	if dir.mfs.config.preservePOSIXMeta {
+		crtime = objectCrtime(objInfo)
+	}
+
+	f := File{
+		dir:     dir,
+		Path:    path,
+		Size:    uint64(objInfo.Size),
+		Inode:   inode,
+		Mode:    dir.mfs.config.mode,
+		GID:     dir.mfs.config.gid,
+		UID:     dir.mfs.config.uid,
+		Chgtime: objInfo.LastModified,
+		Crtime:  crtime,
+		Mtime:   objInfo.LastModified,
+		Atime:   objInfo.LastModified,
+		ETag:    objInfo.ETag,
+		objMeta: &objectMeta{},
+	}
+	f.modified = objInfo.LastModified
+	f.objMeta.setListed(objInfo)
+
+	if dir.mfs.isSymlinkObject(objInfo) {
+		f.Mode = os.ModeSymlink | 0777
+	}
+	return f
 }
 
-// ReadDirAll will return all files in current dir
-func (dir *Dir) ReadDirAll(ctx context.Context, uid uint32) (entries []fuse.Dirent, err error) {
+// virtualDir returns the entry of a directory made without a marker.
+func (dir *Dir) virtualDir(name string) Dir {
+	return Dir{
+		dir:   dir,
+		Path:  name,
+		Inode: dir.mfs.inodes.inode(dir.childPath(name)),
+		Mode:  dir.mfs.config.dirMode | os.ModeDir,
+		GID:   dir.mfs.config.gid,
+		UID:   dir.mfs.config.uid,
+	}
+}
+
+// scanUnion returns the entries of every prefix of a union directory. An
+// entry keeps the directory of its prefix as parent, so it resolves to the
+// object it was listed from. When prefixes share a name, the first prefix
+// listing it wins.
+func (dir *Dir) scanUnion(ctx context.Context, uid uint32, prefixes []string) (entries []FilesystemElement, err error) {
+	for _, prefix := range prefixes {
+		src := dir.mfs.dirAt(prefix)
+
+		prefixEntries, serr := src.scanBucket(ctx, uid)
+		if serr != nil && serr != errListTruncated {
+			return nil, serr
+		} else if serr != nil {
+			err = serr
+		}
+
+		for _, entry := range prefixEntries {
+			if !containsPath(entries, entry.Dirpath()) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	return entries, err
+}
 
-	var fsElements []FilesystemElement
+// dedupeEntries drops the entries named as an entry before them, keeping
+// the first, except that a directory replaces an object of its name
+// wherever either was listed. Listings and lookups then agree on one entry
+// per name.
+func (dir *Dir) dedupeEntries(entries []FilesystemElement) []FilesystemElement {
+	seen := map[string]int{}
+	deduped := entries[:0]
+	for _, entry := range entries {
+		i, ok := seen[entry.Dirpath()]
+		if !ok {
+			seen[entry.Dirpath()] = len(deduped)
+			deduped = append(deduped, entry)
+			continue
+		}
 
+		_, isDir := entry.(Dir)
+		if _, wasDir := deduped[i].(Dir); isDir && !wasDir {
+			deduped[i] = entry
+		}
+		dir.mfs.log.Debugln("Hiding an entry of", dir.childPath(entry.Dirpath()), "listed twice")
+	}
+	return deduped
+}
+
+// containsPath returns if an entry named name is in entries.
+func containsPath(entries []FilesystemElement, name string) bool {
+	for _, entry := range entries {
+		if entry.Dirpath() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// scan lists the directory and keeps the entries for subsequent lookups. A
+// truncated listing returns its entries with errListTruncated, and isn't
+// kept as the listing of the directory.
+func (dir *Dir) scan(ctx context.Context, uid uint32) (fsElements []FilesystemElement, err error) {
+	if fsElements, ok := dir.mfs.listings.Get(uid, dir.FullPath()); ok {
+		return fsElements, nil
+	}
+
+	// The root of a mount rooted at a bucket or prefix is scanned as a
+	// directory of the bucket.
 	switch dir.Path {
 	case "":
-		fsElements, err = dir.scanRoot(ctx, uid)
-		if err != nil {
-			return nil, err
+		// Buckets change rarely, they are kept longer than listings.
+		var listed bool
+		if fsElements, listed = dir.mfs.buckets.Get(uid, ""); !listed {
+			fsElements, err = dir.scanRoot(ctx, uid)
+			if err != nil {
+				return nil, err
+			}
+			dir.mfs.buckets.Add(uid, "", fsElements)
 		}
 	default:
 		fsElements, err = dir.scanBucket(ctx, uid)
-		if err != nil {
+		if err != nil && err != errListTruncated {
 			return nil, err
 		}
 	}
 
+	dir.cacheNodes(uid, fsElements)
+	if err == nil {
+		dir.mfs.listings.Add(uid, dir.FullPath(), fsElements)
+	}
+	return fsElements, err
+}
+
+// ReadDirAll will return all files in current dir
+func (dir *Dir) ReadDirAll(ctx context.Context, uid uint32) (entries []fuse.Dirent, err error) {
+
+	fsElements, err := dir.scan(ctx, uid)
+	if err != nil && err != errListTruncated {
+		return nil, err
+	}
+
+	entries = make([]fuse.Dirent, 0, len(fsElements))
 	for _, x := range fsElements {
 		entries = append(entries, x.Dirent())
 	}
-	fmt.Println("Completed ReadDirAll:", entries)
 
 	return entries, nil
 
 }
 
-// Lookup returns the file node, and scans the current dir if necessary
-func (dir *Dir) Lookup(ctx context.Context, name string, uid uint32) (node fs.Node, err error) {
+// Lookup returns the node of the name looked up. The kernel keeps the
+// entry for as long as the node stays fresh in the node cache, like its
+// attributes.
+func (dir *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	node, err := dir.lookup(ctx, req.Name, req.Uid)
+	if err != nil {
+		return nil, err
+	}
 
-	var fsElements []FilesystemElement
+	resp.EntryValid = dir.mfs.nodes.Valid(path.Join(dir.FullPath(), req.Name))
+	return node, nil
+}
 
-	switch dir.Path {
-	case "":
-		fsElements, err = dir.scanRoot(ctx, uid)
-		if err != nil {
-			return nil, err
+// lookup returns the file node, and scans the current dir if necessary
+func (dir *Dir) lookup(ctx context.Context, name string, uid uint32) (node fs.Node, err error) {
+
+	// A bucket out of the allowlist isn't there.
+	if dir.Path == "" && !dir.mfs.bucketAllowed(name) {
+		return nil, fuse.ENOENT
+	}
+
+	// An open directory answers from the listing taken on open.
+	if snap, ok := dir.mfs.snapshots.get(uid, dir.FullPath()); ok {
+		if o, ok := snap.lookup(name); ok {
+			return dir.node(o), nil
+		} else if !snap.truncated {
+			return nil, fuse.ENOENT
 		}
-	default:
-		fsElements, err = dir.scanBucket(ctx, uid)
+	}
+
+	if o, ok := dir.mfs.nodes.Get(uid, path.Join(dir.FullPath(), name)); ok {
+		return dir.node(o), nil
+	}
+
+	// Below the root, a directory not listed lately resolves the name alone.
+	if _, listed := dir.mfs.listings.Get(uid, dir.FullPath()); !listed && dir.resolvesNames() {
+		o, err := dir.lookupBucket(ctx, uid, name)
 		if err != nil {
 			return nil, err
 		}
+
+		// A name not presented as is, as with names encoded for
+		// Windows, isn't the name of the entry.
+		node := dir.node(o)
+		if node == nil || o.Dirpath() != name {
+			return nil, fuse.ENOENT
+		}
+
+		dir.cacheNodes(uid, []FilesystemElement{o})
+		return node, nil
+	}
+
+	fsElements, err := dir.scan(ctx, uid)
+	if err != nil && err != errListTruncated {
+		return nil, err
 	}
 
-	var o interface{}
+	// Names are listed once, see dedupeEntries.
+	var o FilesystemElement
 	for idx := range fsElements {
 		if fsElements[idx].Dirpath() == name {
 			o = fsElements[idx]
+			break
 		}
 	}
 
+	if node := dir.node(o); node != nil {
+		return node, nil
+	}
+
+	// The name may be in the part of the listing we didn't get.
+	if err == errListTruncated {
+		return nil, fuse.EIO
+	}
+
+	return nil, fuse.ENOENT
+}
+
+// node returns the scanned element as a node below dir, or nil if there is none.
+//
+// An element listed from another directory, as in a union, keeps its parent.
+func (dir *Dir) node(o FilesystemElement) fs.Node {
 	if file, ok := o.(File); ok {
 		file.mfs = dir.mfs
-		file.dir = dir
-		return &file, nil
+		if file.dir == nil {
+			file.dir = dir
+		}
+		return &file
 	} else if subdir, ok := o.(Dir); ok {
 		subdir.mfs = dir.mfs
-		subdir.dir = dir
-		return &subdir, nil
+		if subdir.dir == nil {
+			subdir.dir = dir
+		}
+		return &subdir
+	} else if archive, ok := o.(ArchiveDir); ok {
+		archive.mfs = dir.mfs
+		return &archive
 	}
+	return nil
+}
 
-	return nil, fuse.ENOENT
+// cacheNodes keeps the scanned elements of dir for subsequent lookups.
+func (dir *Dir) cacheNodes(uid uint32, fsElements []FilesystemElement) {
+	for _, x := range fsElements {
+		dir.mfs.nodes.Add(uid, path.Join(dir.FullPath(), x.Dirpath()), x)
+	}
 }
 
 // Mkdir will make a new directory below current dir
+//
+// With directory markers the directory is persisted as an empty object named
+// after its prefix, otherwise it only exists in memory until objects are
+// written below it.
 func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
-	fmt.Println("Mkdir() not allowed")
-	return nil, nil
+	if dir.mfs.config.readOnly {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+
+	if dir.Path == "" {
+		return dir.makeBucket(ctx, req)
+	}
+
+	// Directories that would be hidden can't be made.
+	if dir.atMaxDepth() {
+		return nil, fuse.EPERM
+	}
+
+	subdir := &Dir{
+		dir:   dir,
+		mfs:   dir.mfs,
+		Path:  req.Name,
+		Inode: dir.mfs.inodes.inode(dir.childPath(req.Name)),
+		Mode:  dir.mfs.config.dirMode | os.ModeDir,
+		GID:   dir.mfs.config.gid,
+		UID:   dir.mfs.config.uid,
+
+		Mtime:   time.Now(),
+		Crtime:  time.Now(),
+		Chgtime: time.Now(),
+		Atime:   time.Now(),
+	}
+
+	if !dir.mfs.config.dirMarkers {
+		dir.mfs.addVirtualDir(subdir.FullPath())
+		dir.mfs.invalidate(subdir.FullPath())
+		return subdir, nil
+	}
+
+	api, err := dir.mfs.getBucketApi(ctx, req.Uid, dir.Bucket())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = api.PutObject(ctx, dir.Bucket(), subdir.SearchPrefix(), bytes.NewReader(nil), 0, dir.mfs.putOptions(dir.Bucket())); err != nil {
+		dir.mfs.log.Errorln("Unable to make directory marker for", subdir.FullPath(), err)
+		return nil, fuse.EIO
+	}
+
+	dir.mfs.invalidate(subdir.FullPath())
+	return subdir, nil
+}
+
+// makeBucket makes the bucket req.Name, on the endpoint it is routed to.
+func (dir *Dir) makeBucket(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	// A static bucket set can't grow, nor can a bucket out of the allowlist
+	// be made, the bucket wouldn't be presented.
+	if len(dir.mfs.config.staticBuckets) > 0 {
+		return nil, fuse.EPERM
+	} else if !dir.mfs.bucketAllowed(req.Name) {
+		return nil, fuse.EPERM
+	}
+
+	api, err := dir.mfs.getBucketApi(ctx, req.Uid, req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Made in the region requests are signed for, requests signed for it
+	// don't reach a bucket made elsewhere.
+	if err = api.MakeBucket(ctx, req.Name, minio.MakeBucketOptions{Region: dir.mfs.config.region}); err != nil {
+		dir.mfs.log.Errorln("Unable to make bucket", req.Name, err)
+
+		switch minio.ToErrorResponse(err).Code {
+		case "BucketAlreadyExists", "BucketAlreadyOwnedByYou":
+			return nil, fuse.EEXIST
+		case "InvalidBucketName":
+			return nil, fuse.Errno(syscall.EINVAL)
+		case "AccessDenied":
+			return nil, fuse.EPERM
+		}
+		return nil, fuse.EIO
+	}
+
+	bucket := &Dir{
+		dir:   dir,
+		mfs:   dir.mfs,
+		Path:  req.Name,
+		Inode: dir.mfs.inodes.inode(req.Name),
+		Mode:  dir.mfs.config.dirMode | os.ModeDir,
+		GID:   dir.mfs.config.gid,
+		UID:   dir.mfs.config.uid,
+	}
+
+	dir.mfs.invalidate(req.Name)
+	return bucket, nil
 }
 
 // Remove will delete a file or directory from current directory
 func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	fmt.Println("Remove() not allowed")
+	if dir.mfs.config.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+
+	if req.Dir {
+		return dir.removeDir(ctx, req)
+	}
+	return dir.removeFile(ctx, req)
+}
+
+// removeFile removes the object req.Name, and its cached copies that aren't
+// open.
+func (dir *Dir) removeFile(ctx context.Context, req *fuse.RemoveRequest) error {
+	// Files can't be outside of a bucket.
+	if dir.Path == "" {
+		return fuse.EPERM
+	}
+
+	f := &File{dir: dir, mfs: dir.mfs, Path: req.Name}
+	fullPath := f.FullPath()
+
+	unlockObject := dir.mfs.lockObject(fullPath)
+	defer unlockObject()
+
+	// A file created but not uploaded yet isn't an object, it is dropped
+	// before being uploaded.
+	if dir.mfs.unlinkWriter(fullPath) {
+		dir.mfs.invalidate(fullPath)
+		return nil
+	}
+
+	api, err := dir.mfs.getBucketApi(ctx, req.Uid, dir.Bucket())
+	if err != nil {
+		return err
+	}
+
+	object, err := api.StatObject(ctx, dir.Bucket(), f.ObjectPath(), dir.mfs.getOptions(dir.Bucket()))
+	if err != nil {
+		if meta.IsNoSuchObject(err) {
+			return fuse.ENOENT
+		}
+		dir.mfs.log.Errorln("Unable to stat", fullPath, err)
+		return fuse.EIO
+	}
+
+	if err = api.RemoveObject(ctx, dir.Bucket(), f.ObjectPath(), minio.RemoveObjectOptions{}); err != nil {
+		dir.mfs.log.Errorln("Unable to remove", fullPath, err)
+		if minio.ToErrorResponse(err).Code == "AccessDenied" {
+			return fuse.EPERM
+		}
+		return fuse.EIO
+	}
+
+	// Every cached version is dropped, whole, sparse or in blocks. The
+	// version removed is known by its etag even when not opened since the
+	// mount, as with hashed names.
+	cachePath := dir.mfs.cachePath(dir.Bucket(), object.Key, object.ETag)
+	for _, p := range []string{cachePath, rangeCachePath(cachePath), blockCachePath(cachePath)} {
+		dir.mfs.purgeCache(p)
+	}
+	dir.mfs.dropObject(dir.Bucket(), object.Key)
+
+	dir.mfs.invalidate(fullPath)
+	return nil
+}
+
+// removeDir removes the empty directory req.Name. A directory with a marker
+// is removed by deleting the marker. A directory without one only exists
+// while objects share its prefix, so removing it when empty is a no-op.
+// Either fails with ENOTEMPTY while objects remain below it.
+func (dir *Dir) removeDir(ctx context.Context, req *fuse.RemoveRequest) error {
+	// Buckets can't be removed.
+	if dir.Path == "" {
+		return fuse.EPERM
+	}
+
+	subdir := &Dir{dir: dir, mfs: dir.mfs, Path: req.Name}
+	prefix := subdir.SearchPrefix()
+
+	api, err := dir.mfs.getBucketApi(ctx, req.Uid, dir.Bucket())
+	if err != nil {
+		return err
+	}
+
+	// The marker and the first object below it tell it all.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	marker := false
+	for objInfo := range api.ListObjects(ctx, dir.Bucket(), minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+		MaxKeys:   2,
+	}) {
+		if objInfo.Err != nil {
+			dir.mfs.log.Errorln("Unable to list", subdir.FullPath(), objInfo.Err)
+			return fuse.EIO
+		}
+
+		if objInfo.Key != prefix {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		marker = true
+	}
+
+	if marker {
+		if err = api.RemoveObject(ctx, dir.Bucket(), prefix, minio.RemoveObjectOptions{}); err != nil {
+			dir.mfs.log.Errorln("Unable to remove directory marker of", subdir.FullPath(), err)
+			return fuse.EIO
+		}
+	}
+
+	dir.mfs.removeVirtualDir(subdir.FullPath())
+	dir.mfs.invalidate(subdir.FullPath())
 	return nil
 }
 
 // Create will return a new empty file in current dir, if the file is currently locked, it will wait for the lock to be freed.
+//
+// The file is staged in the cache and uploaded when its last writable handle
+// is closed, as for any file written. It is listed in the meanwhile.
 func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	fmt.Println("Create() not allowed")
-	return nil, nil, nil
+	if dir.mfs.config.readOnly {
+		return nil, nil, fuse.Errno(syscall.EROFS)
+	}
+
+	// Files can't be made outside of a bucket.
+	if dir.Path == "" {
+		return nil, nil, fuse.EPERM
+	}
+
+	fullPath := dir.childPath(req.Name)
+
+	unlockObject := dir.mfs.lockObject(fullPath)
+	defer unlockObject()
+
+	f := &File{
+		dir:     dir,
+		mfs:     dir.mfs,
+		Path:    req.Name,
+		Inode:   dir.mfs.inodes.inode(fullPath),
+		Mode:    req.Mode,
+		GID:     dir.mfs.config.gid,
+		UID:     dir.mfs.config.uid,
+		Mtime:   time.Now(),
+		Crtime:  time.Now(),
+		Chgtime: time.Now(),
+		Atime:   time.Now(),
+		objMeta: &objectMeta{},
+	}
+
+	// Staged by the version it has none of yet, reads of the objects never
+	// ask for it.
+	cachePath := dir.mfs.cachePath(f.Bucket(), f.ObjectPath(), "")
+	if err := os.MkdirAll(path.Dir(cachePath), 0777); err != nil {
+		return nil, nil, err
+	}
+
+	fh, err := dir.mfs.Acquire(f, cachePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fh.cachePath = cachePath
+	fh.uid = req.Uid
+
+	fh.File, err = dir.mfs.openLocal(cachePath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		dir.mfs.log.Errorln("Unable to create cache file for", fullPath, err)
+		dir.mfs.Release(fh)
+		return nil, nil, err
+	}
+
+	// An empty file is uploaded as well, even if nothing is written.
+	dir.mfs.addWriter(fullPath, cachePath, req.Uid)
+	dir.mfs.m.Lock()
+	ws := dir.mfs.writers[fullPath]
+	ws.created = f
+	ws.dirty = true
+	ws.removed = false
+	dir.mfs.m.Unlock()
+	fh.writer = true
+
+	dir.mfs.invalidate(fullPath)
+
+	resp.Flags |= fuse.OpenDirectIO
+	resp.Handle = fuse.HandleID(fh.handle)
+
+	dir.mfs.log.Debugln("Serving FH request [", fh.handle, "], created: ", fullPath, " staged @", cachePath)
+
+	return f, fh, nil
 }
 
 // Rename will rename files
+//
+// The object is copied server side and the source removed, within a bucket
+// or across buckets of the same endpoint. Directories hold any number of
+// objects, they can't be renamed at once and fail with EXDEV, so mv moves
+// their contents one by one.
 func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node) error {
-	fmt.Println("Rename() not allowed")
+	if dir.mfs.config.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+
+	newDir, ok := nd.(*Dir)
+	if !ok || dir.Path == "" || newDir.Path == "" {
+		return fuse.EPERM
+	}
+
+	node, err := dir.lookup(ctx, req.OldName, req.Uid)
+	if err != nil {
+		return err
+	}
+
+	src, ok := node.(*File)
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	if endpointKey(dir.mfs.endpointFor(dir.Bucket())) != endpointKey(dir.mfs.endpointFor(newDir.Bucket())) {
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	dst := &File{dir: newDir, mfs: dir.mfs, Path: req.NewName}
+	srcPath, dstPath := src.FullPath(), dst.FullPath()
+
+	// Writers of either wait for the move, locked in order so two renames
+	// between the same objects can't lock each other out.
+	first, second := srcPath, dstPath
+	if second < first {
+		first, second = second, first
+	}
+	unlockFirst := dir.mfs.lockObject(first)
+	defer unlockFirst()
+	if second != first {
+		unlockSecond := dir.mfs.lockObject(second)
+		defer unlockSecond()
+	}
+
+	// What was written to the source moves with it, writers wait meanwhile.
+	if err = src.uploadLocked(); err != nil {
+		return err
+	}
+
+	api, err := dir.mfs.getBucketApi(ctx, req.Uid, src.Bucket())
+	if err != nil {
+		return err
+	}
+
+	object, err := api.StatObject(ctx, src.Bucket(), src.ObjectPath(), dir.mfs.getOptions(src.Bucket()))
+	if err != nil {
+		if meta.IsNoSuchObject(err) {
+			return fuse.ENOENT
+		}
+		return fuse.EIO
+	}
+
+	mr := newMoveOp(srcPath, dstPath, object.ETag, req.Uid)
+	if err = dir.mfs.sync(&mr); err != nil {
+		return err
+	}
+
+	if err = <-mr.Error; err != nil {
+		dir.mfs.log.Errorln("Unable to rename", srcPath, "to", dstPath, err)
+		if minio.ToErrorResponse(err).Code == "AccessDenied" {
+			return fuse.EPERM
+		}
+		return fuse.EIO
+	}
+
+	// Handles of the source still open write to a file that's gone.
+	dir.mfs.unlinkWriter(srcPath)
+
+	// The cached copy stays warm under its new name.
+	dir.mfs.moveCache(
+		dir.mfs.cachePath(src.Bucket(), object.Key, object.ETag),
+		dir.mfs.cachePath(dst.Bucket(), dst.ObjectPath(), mr.TargetETag),
+	)
+
+	dir.mfs.invalidate(srcPath)
+	dir.mfs.invalidate(dstPath)
 	return nil
 }
 
@@ -318,3 +1294,17 @@ func (dir *Dir) bucket(tx *meta.Tx) *meta.Bucket {
 
 	return b.Bucket(dir.Path + "/")
 }
+
+// createBucket returns the bucket of the directory, made along with the
+// buckets of its parents when the directory wasn't stored in yet.
+func (dir *Dir) createBucket(tx *meta.Tx) (*meta.Bucket, error) {
+	if dir.dir == nil {
+		return tx.Bucket("minio/"), nil
+	}
+
+	b, err := dir.dir.createBucket(tx)
+	if err != nil {
+		return nil, err
+	}
+	return b.CreateBucketIfNotExists(dir.Path + "/")
+}
@@ -0,0 +1,469 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// listedNames returns the names of the entries listed.
+func listedNames(entries []FilesystemElement) (names []string) {
+	for _, entry := range entries {
+		switch v := entry.(type) {
+		case File:
+			names = append(names, v.Path)
+		case *File:
+			names = append(names, v.Path)
+		case Dir:
+			names = append(names, v.Path+"/")
+		case *Dir:
+			names = append(names, v.Path+"/")
+		}
+	}
+	return names
+}
+
+// failingPages fails the listings after the first page with status, the
+// first fails of them or every one when fails is negative.
+func failingPages(s3 *fakeS3, status int, fails int32) {
+	var failed int32
+	s3.fail = func(r *http.Request) int {
+		if r.URL.Query().Get("continuation-token") == "" {
+			return 0
+		}
+		if fails >= 0 && atomic.AddInt32(&failed, 1) > fails {
+			return 0
+		}
+		return status
+	}
+}
+
+func listedFiles(s3 *fakeS3) {
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		s3.put("bucket", key, []byte(key))
+	}
+	s3.page = 2
+}
+
+func TestListingTruncatedMidStream(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	listedFiles(s3)
+	failingPages(s3, http.StatusForbidden, -1)
+	mfs := newTestFS(t, s3)
+
+	entries, err := mfs.dirAt("bucket").scanBucket(context.Background(), 0)
+	if err != errListTruncated {
+		t.Fatalf("listing failed with %v, expected it truncated", err)
+	}
+	if names := listedNames(entries); len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Fatalf("listing truncated to %v, expected the first page", names)
+	}
+}
+
+func TestStrictListingFailsMidStream(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	listedFiles(s3)
+	failingPages(s3, http.StatusForbidden, -1)
+	mfs := newTestFS(t, s3, StrictListing())
+
+	entries, err := mfs.dirAt("bucket").scanBucket(context.Background(), 0)
+	if err == nil || err == errListTruncated {
+		t.Fatalf("strict listing failed with %v, expected the error of the page", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("strict listing returned %v", listedNames(entries))
+	}
+}
+
+func TestListingResumesAfterTransientError(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	listedFiles(s3)
+	failingPages(s3, -1, 1)
+	mfs := newTestFS(t, s3, RetryBackoff(time.Millisecond))
+
+	entries, err := mfs.dirAt("bucket").scanBucket(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listedNames(entries); len(names) != 5 {
+		t.Fatalf("listed %v after the connection was reset, expected every file once", names)
+	}
+}
+
+// unionEntries lists the union bucket/all of the prefixes 2023 and 2024.
+func unionEntries(t *testing.T, s3 *fakeS3) []FilesystemElement {
+	t.Helper()
+
+	mfs := newTestFS(t, s3, UnionPrefix("bucket/all", []string{"bucket/2023", "bucket/2024"}))
+	entries, err := mfs.dirAt("bucket/all").scanBucket(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestUnionDisjointPrefixes(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "2023/jan", []byte("jan"))
+	s3.put("bucket", "2024/feb", []byte("feb"))
+	s3.put("bucket", "2024/q1/mar", []byte("mar"))
+	s3.put("bucket", "2025/apr", []byte("apr"))
+
+	names := listedNames(unionEntries(t, s3))
+	if len(names) != 3 || names[0] != "jan" || names[1] != "feb" || names[2] != "q1/" {
+		t.Fatalf("union lists %v, expected the entries of both prefixes", names)
+	}
+}
+
+func TestUnionOverlappingPrefixes(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "2023/data", []byte("2023"))
+	s3.put("bucket", "2023/only", []byte("2023"))
+	s3.put("bucket", "2024/data", []byte("2024"))
+
+	entries := unionEntries(t, s3)
+	if names := listedNames(entries); len(names) != 2 || names[0] != "data" || names[1] != "only" {
+		t.Fatalf("union lists %v, expected every name once", names)
+	}
+
+	// The first prefix listing a name wins.
+	var f *File
+	switch v := entries[0].(type) {
+	case File:
+		f = &v
+	case *File:
+		f = v
+	}
+	if f == nil || f.dir.FullPath() != "bucket/2023" {
+		t.Fatalf("data presented from %v, expected the first prefix", entries[0])
+	}
+}
+
+// rmdir removes the directory name of bucket.
+func rmdir(mfs *MinFS, bucket, name string) error {
+	return mfs.dirAt(bucket).Remove(context.Background(), &fuse.RemoveRequest{Name: name, Dir: true})
+}
+
+func TestRemoveImplicitDir(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "full/file", []byte("data"))
+	mfs := newTestFS(t, s3)
+
+	if err := rmdir(mfs, "bucket", "full"); err != fuse.Errno(syscall.ENOTEMPTY) {
+		t.Fatalf("removing a directory holding objects failed with %v, expected ENOTEMPTY", err)
+	}
+	if _, ok := s3.object("bucket", "full/file"); !ok {
+		t.Fatal("object removed with its directory")
+	}
+
+	// Made without a marker, the directory is only known to the mount.
+	mfs.addVirtualDir("bucket/empty")
+	if err := rmdir(mfs, "bucket", "empty"); err != nil {
+		t.Fatalf("removing an empty directory failed with %v", err)
+	}
+	if names := mfs.virtualDirs("bucket"); len(names) != 0 {
+		t.Fatalf("directories %v left after removal", names)
+	}
+}
+
+func TestRemoveMarkerDir(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "full/", nil)
+	s3.put("bucket", "full/file", []byte("data"))
+	s3.put("bucket", "empty/", nil)
+	mfs := newTestFS(t, s3)
+
+	if err := rmdir(mfs, "bucket", "full"); err != fuse.Errno(syscall.ENOTEMPTY) {
+		t.Fatalf("removing a directory holding objects failed with %v, expected ENOTEMPTY", err)
+	}
+	if _, ok := s3.object("bucket", "full/"); !ok {
+		t.Fatal("marker of a directory holding objects removed")
+	}
+
+	if err := rmdir(mfs, "bucket", "empty"); err != nil {
+		t.Fatalf("removing an empty directory failed with %v", err)
+	}
+	if _, ok := s3.object("bucket", "empty/"); ok {
+		t.Fatal("marker of an empty directory kept after its removal")
+	}
+}
+
+// inodes returns the inodes of the entries listed, by name.
+func inodes(entries []FilesystemElement) map[string]uint64 {
+	byName := map[string]uint64{}
+	for _, entry := range entries {
+		byName[entry.Dirent().Name] = entry.Dirent().Inode
+	}
+	return byName
+}
+
+func TestInodesStableAcrossScans(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "dir/", nil)
+	s3.put("bucket", "file", []byte("data"))
+	s3.put("bucket", "other", []byte("data"))
+
+	ctx := context.Background()
+	first, err := newTestFS(t, s3).dirAt("bucket").scanBucket(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An object listed before it in a later scan doesn't shift the inodes.
+	s3.put("bucket", "a", []byte("data"))
+	mfs := newTestFS(t, s3)
+	second, err := mfs.dirAt("bucket").scanBucket(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	was, is := inodes(first), inodes(second)
+	for name, inode := range was {
+		if is[name] != inode {
+			t.Errorf("%s has inode %d, had %d", name, is[name], inode)
+		}
+	}
+
+	node, err := mfs.dirAt("bucket").lookup(ctx, "file", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inode := node.(*File).Inode; inode != was["file"] {
+		t.Errorf("file looked up with inode %d, listed with %d", inode, was["file"])
+	}
+}
+
+func TestDedupeEntriesPrefersDirs(t *testing.T) {
+	mfs := newTestFS(t, newFakeS3(t, "bucket"))
+	dir := mfs.dirAt("bucket")
+
+	for _, entries := range [][]FilesystemElement{
+		{File{Path: "data"}, Dir{Path: "data"}, File{Path: "x"}},
+		{Dir{Path: "data"}, File{Path: "data"}, File{Path: "x"}},
+		{Dir{Path: "data"}, File{Path: "x"}, Dir{Path: "data"}},
+	} {
+		deduped := dir.dedupeEntries(entries)
+		if names := listedNames(deduped); len(names) != 2 || names[0] != "data/" || names[1] != "x" {
+			t.Fatalf("deduped to %v, expected the directory data and the file x", names)
+		}
+	}
+}
+
+func TestObjectAndDirOfSameName(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "data", []byte("object"))
+	s3.put("bucket", "data/", nil)
+	s3.put("bucket", "data/file", []byte("file"))
+	mfs := newTestFS(t, s3)
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		entries, err := mfs.dirAt("bucket").scanBucket(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := listedNames(entries); len(names) != 1 || names[0] != "data/" {
+			t.Fatalf("listed %v, expected the directory data once", names)
+		}
+
+		node, err := mfs.dirAt("bucket").lookup(ctx, "data", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := node.(*Dir); !ok {
+			t.Fatalf("data looked up as %T, expected the directory", node)
+		}
+		mfs.invalidate("bucket/data")
+	}
+}
+
+func TestSearchPrefix(t *testing.T) {
+	mfs := newTestFS(t, newFakeS3(t, "aaa"))
+
+	for fullPath, want := range map[string]string{
+		"aaa":           "",
+		"aaa/b":         "b/",
+		"aaa/aaa":       "aaa/",
+		"aaa/aaa/aaa":   "aaa/aaa/",
+		"aaa/b/aaa/b":   "b/aaa/b/",
+		"aaa/1/2/3/4/5": "1/2/3/4/5/",
+	} {
+		if got := mfs.dirAt(fullPath).SearchPrefix(); got != want {
+			t.Errorf("%s searches %q, expected %q", fullPath, got, want)
+		}
+	}
+}
+
+func TestScanCustomDelimiter(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "a:b", nil)
+	s3.put("bucket", "a:c/d", nil)
+	s3.put("bucket", "a:x:y", nil)
+	s3.put("bucket", "e", nil)
+	s3.page = 2
+	mfs := newTestFS(t, s3, Delimiter(":"))
+
+	for fullPath, want := range map[string][]string{
+		"bucket":     {"a/", "e"},
+		"bucket/a":   {"b", "c%2Fd", "x/"},
+		"bucket/a:x": {"y"},
+	} {
+		entries, err := mfs.dirAt(fullPath).scanBucket(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := listedNames(entries)
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(want, ",") {
+			t.Errorf("%s lists %v, expected %v", fullPath, names, want)
+		}
+	}
+
+	node, err := mfs.dirAt("bucket/a").lookup(context.Background(), "c%2Fd", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := node.(*File); !ok || f.ObjectPath() != "a:c/d" {
+		t.Fatalf("looked up %#v, expected the object a:c/d", node)
+	}
+}
+
+func TestScanRepeatedNames(t *testing.T) {
+	s3 := newFakeS3(t, "aaa")
+	s3.put("aaa", "aaa/file", nil)
+	s3.put("aaa", "aaa/aaa/file", nil)
+	s3.put("aaa", "aaa/aaa/aaa/file", nil)
+	s3.put("aaa", "aaa/aaa/aaa/aaa/deep", nil)
+	mfs := newTestFS(t, s3)
+
+	for fullPath, want := range map[string][]string{
+		"aaa":                 {"aaa/"},
+		"aaa/aaa":             {"file", "aaa/"},
+		"aaa/aaa/aaa":         {"file", "aaa/"},
+		"aaa/aaa/aaa/aaa":     {"file", "aaa/"},
+		"aaa/aaa/aaa/aaa/aaa": {"deep"},
+	} {
+		entries, err := mfs.dirAt(fullPath).scanBucket(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := listedNames(entries)
+		if strings.Join(names, ",") != strings.Join(want, ",") {
+			t.Errorf("%s lists %v, expected %v", fullPath, names, want)
+		}
+	}
+}
+
+func TestAppendPartsHidden(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "log", []byte("old"))
+	s3.put("bucket", "notes"+appendPartInfix+"0123", nil)
+	mfs := newTestFS(t, s3, RetryBackoff(time.Millisecond))
+	ctx := context.Background()
+
+	scan := func() string {
+		entries, err := mfs.dirAt("bucket").scanBucket(ctx, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		return strings.Join(listedNames(entries), ",")
+	}
+
+	// The part is listed while the object is composed with it, its removal
+	// fails afterwards.
+	var during string
+	s3.fail = func(r *http.Request) int {
+		switch {
+		case r.Method == http.MethodHead && r.URL.Path == "/bucket/log" && during == "":
+			during = scan()
+		case r.Method == http.MethodDelete:
+			return http.StatusForbidden
+		}
+		return 0
+	}
+
+	source := filepath.Join(t.TempDir(), "source")
+	if err := ioutil.WriteFile(source, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	api, err := mfs.getBucketApi(ctx, 0, "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs.composeAppend(ctx, api, &AppendOperation{Source: source, Bucket: "bucket", Object: "log"})
+
+	// Objects named like parts are listed, only parts in progress aren't.
+	if want := "log,notes" + appendPartInfix + "0123"; during != want {
+		t.Errorf("bucket lists %v during the append, expected %v", during, want)
+	}
+
+	// A part left behind is listed, to be removed.
+	names := scan()
+	if !strings.Contains(names, "log"+appendPartInfix) {
+		t.Errorf("bucket lists %v, expected the part left behind", names)
+	}
+}
+
+func TestRenameMovesWrites(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	mfs := newTestFS(t, s3)
+
+	_, h1, h2 := openTwice(t, mfs, "bucket", "file")
+	write(t, h1, 0, "hello")
+
+	dir := mfs.dirAt("bucket")
+	if err := dir.Rename(context.Background(), &fuse.RenameRequest{OldName: "file", NewName: "moved"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := s3.object("bucket", "moved"); !ok || string(data) != "hello" {
+		t.Fatalf("renamed object holds %q, expected the writes", data)
+	}
+	if _, ok := s3.object("bucket", "file"); ok {
+		t.Fatal("source of the rename left")
+	}
+
+	closeHandle(h1)
+	closeHandle(h2)
+}
+
+func TestSnapshotLookup(t *testing.T) {
+	var entries []FilesystemElement
+	for i := 0; i < 1000; i++ {
+		entries = append(entries, &File{Path: fmt.Sprintf("file-%d", i), Inode: uint64(i + 2)})
+	}
+	entries = append(entries, &File{Path: "file-7", Inode: 1})
+	snap := newDirSnapshot(entries, false)
+
+	entry, ok := snap.lookup("file-7")
+	if f, _ := entry.(*File); !ok || f.Inode != 9 {
+		t.Fatalf("looked up %#v, expected the first file-7 listed", entry)
+	}
+	if _, ok := snap.lookup("file-1000"); ok {
+		t.Fatal("looked up a name not listed")
+	}
+}
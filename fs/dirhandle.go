@@ -0,0 +1,189 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// dirSnapshot is a directory listing taken when the directory is opened.
+type dirSnapshot struct {
+	entries   []FilesystemElement
+	truncated bool
+
+	// entries by name, so lookups don't scan the listing
+	byName map[string]FilesystemElement
+
+	// open handles on the snapshot, and if it must be listed again
+	refs  int
+	stale bool
+}
+
+func newDirSnapshot(entries []FilesystemElement, truncated bool) *dirSnapshot {
+	s := &dirSnapshot{
+		entries:   entries,
+		truncated: truncated,
+		byName:    make(map[string]FilesystemElement, len(entries)),
+	}
+	for _, entry := range entries {
+		if _, ok := s.byName[entry.Dirpath()]; !ok {
+			s.byName[entry.Dirpath()] = entry
+		}
+	}
+	return s
+}
+
+// lookup returns the entry named name in the snapshot.
+func (s *dirSnapshot) lookup(name string) (FilesystemElement, bool) {
+	entry, ok := s.byName[name]
+	return entry, ok
+}
+
+// dirSnapshots holds the snapshots of the open directories. A snapshot
+// lives as long as a handle on it is open, with no expiry, and is dropped
+// when the directory or an entry of it changes on the mount. The node
+// cache is refreshed by every scan, so it is never older than a snapshot.
+type dirSnapshots struct {
+	mu sync.Mutex
+
+	open map[nodeKey]*dirSnapshot
+}
+
+func newDirSnapshots() *dirSnapshots {
+	return &dirSnapshots{open: map[nodeKey]*dirSnapshot{}}
+}
+
+// get returns the snapshot of the open directory at path for uid.
+func (s *dirSnapshots) get(uid uint32, path string) (*dirSnapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, ok := s.open[nodeKey{uid, path}]
+	if !ok || snap.stale {
+		return nil, false
+	}
+	return snap, true
+}
+
+// add makes snap the snapshot of the directory at path for uid, subsequent
+// lookups in the directory are served from it.
+func (s *dirSnapshots) add(uid uint32, path string, snap *dirSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap.refs++
+	s.open[nodeKey{uid, path}] = snap
+}
+
+// release drops a handle on snap, the snapshot goes away with its last handle.
+func (s *dirSnapshots) release(uid uint32, path string, snap *dirSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap.refs--
+
+	key := nodeKey{uid, path}
+	if snap.refs <= 0 && s.open[key] == snap {
+		delete(s.open, key)
+	}
+}
+
+// invalidate marks stale the snapshots of the directory holding the entry at
+// p, and of p and everything below it, for every uid.
+func (s *dirSnapshots) invalidate(p string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parent := path.Dir(p)
+	for key, snap := range s.open {
+		if key.path == parent || key.path == p || strings.HasPrefix(key.path, p+"/") {
+			snap.stale = true
+			delete(s.open, key)
+		}
+	}
+}
+
+// isStale returns if the snapshot must be listed again.
+func (s *dirSnapshots) isStale(snap *dirSnapshot) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return snap.stale
+}
+
+// DirHandle is an open directory, serving the listing taken on open.
+type DirHandle struct {
+	dir *Dir
+	uid uint32
+
+	snap *dirSnapshot
+}
+
+// Open scans the directory once, the listing and the lookups in the
+// directory are served from this scan until the handle is released.
+func (dir *Dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	uid := req.Header.Uid
+
+	snap, err := dir.snapshot(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	dir.mfs.snapshots.add(uid, dir.FullPath(), snap)
+	return &DirHandle{dir: dir, uid: uid, snap: snap}, nil
+}
+
+// snapshot scans the directory into a new snapshot.
+func (dir *Dir) snapshot(ctx context.Context, uid uint32) (*dirSnapshot, error) {
+	entries, err := dir.scan(ctx, uid)
+	if err != nil && err != errListTruncated {
+		return nil, err
+	}
+
+	return newDirSnapshot(entries, err == errListTruncated), nil
+}
+
+// ReadDirAll returns the entries of the snapshot, listing the directory
+// again if it changed since it was opened.
+func (dh *DirHandle) ReadDirAll(ctx context.Context, uid uint32) (entries []fuse.Dirent, err error) {
+	if dh.dir.mfs.snapshots.isStale(dh.snap) {
+		snap, err := dh.dir.snapshot(ctx, dh.uid)
+		if err != nil {
+			return nil, err
+		}
+
+		dh.dir.mfs.snapshots.release(dh.uid, dh.dir.FullPath(), dh.snap)
+		dh.dir.mfs.snapshots.add(dh.uid, dh.dir.FullPath(), snap)
+		dh.snap = snap
+	}
+
+	for _, x := range dh.snap.entries {
+		entries = append(entries, x.Dirent())
+	}
+	return entries, nil
+}
+
+// Release drops the snapshot of the handle.
+func (dh *DirHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	dh.dir.mfs.snapshots.release(dh.uid, dh.dir.FullPath(), dh.snap)
+	return nil
+}
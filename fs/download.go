@@ -0,0 +1,141 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// parallelTmpExt is appended to the cache path of an object downloaded by
+// range until it is complete.
+const parallelTmpExt = ".part"
+
+// parallelDownload returns if an object of size bytes is downloaded in
+// ranges fetched concurrently.
+func (mfs *MinFS) parallelDownload(size int64) bool {
+	return mfs.config.downloadConcurrency > 1 && size >= mfs.config.downloadThreshold
+}
+
+// fetchParallel downloads the object to path in chunks, fetched by as many
+// requests at once as the download concurrency. The chunks are written to
+// a sparse file aside, renamed once complete, so a partial download is
+// never served. Every chunk must come from the version stat, the download
+// fails when the object changes meanwhile.
+func (f *File) fetchParallel(ctx context.Context, uid uint32, api *minio.Client, object minio.ObjectInfo, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	tmpPath := path + parallelTmpExt
+	tmp, err := f.mfs.openLocal(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	if err = tmp.Truncate(object.Size); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Each worker stops at its first error, and stops the others.
+	offsets := make(chan int64)
+	errs := make(chan error, f.mfs.config.downloadConcurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < f.mfs.config.downloadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range offsets {
+				end := min64(offset+globalDownloadChunk, object.Size)
+				if err := f.fetchChunk(ctx, uid, api, object, tmp, span{offset, end}); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for offset := int64(0); offset < object.Size; offset += globalDownloadChunk {
+		select {
+		case offsets <- offset:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(offsets)
+	wg.Wait()
+
+	select {
+	case err = <-errs:
+	default:
+		err = ctx.Err()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.mfs.retryLocal(func() error {
+		return os.Rename(tmpPath, path)
+	})
+}
+
+// fetchChunk fetches the span s of the object version into w.
+func (f *File) fetchChunk(ctx context.Context, uid uint32, api *minio.Client, object minio.ObjectInfo, w io.WriterAt, s span) error {
+	opts := f.mfs.getOptions(f.Bucket())
+	if err := opts.SetRange(s.start, s.end-1); err != nil {
+		return err
+	}
+	if err := opts.SetMatchETag(object.ETag); err != nil {
+		return err
+	}
+
+	return f.mfs.retryExpired(ctx, uid, func() error {
+		obj, err := api.GetObject(ctx, f.Bucket(), f.ObjectPath(), opts)
+		if err != nil {
+			return err
+		}
+		defer obj.Close()
+
+		buff := make([]byte, globalRangeChunk)
+		for offset := s.start; offset < s.end; {
+			n, err := io.ReadFull(obj, buff[:min64(int64(len(buff)), s.end-offset)])
+			if err != nil {
+				return err
+			}
+			if _, err = w.WriteAt(buff[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		return nil
+	})
+}
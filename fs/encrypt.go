@@ -0,0 +1,58 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// cacheNameContext derives the key naming cache files from the cache
+// encryption key, so names don't reuse the key sealing the data.
+const cacheNameContext = "minfs cache names"
+
+// parseCacheKey returns the AES-GCM cipher sealing cache files under the
+// hex encoded key, and the key naming them.
+func parseCacheKey(key string) (cipher.AEAD, []byte, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, nil, fmt.Errorf("pass the key hex encoded: %v", err)
+	}
+
+	switch len(raw) {
+	case 16, 24, 32:
+	default:
+		return nil, nil, fmt.Errorf("pass a key of 16, 24 or 32 bytes, not %d", len(raw))
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte(cacheNameContext))
+	return aead, mac.Sum(nil), nil
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// clearFiles returns the files of the cache holding data in the clear.
+func clearFiles(t *testing.T, mfs *MinFS, data string) (paths []string) {
+	err := filepath.Walk(mfs.config.cache, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err == nil && bytes.Contains(content, []byte(data)) {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+// readFile reads the file at name of bucket through a read only open.
+func readFile(t *testing.T, mfs *MinFS, bucket, name string) string {
+	t.Helper()
+
+	ctx := context.Background()
+	node, err := mfs.dirAt(bucket).lookup(ctx, name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := node.(*File).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh := h.(*FileHandle)
+	defer fh.Release(ctx, &fuse.ReleaseRequest{})
+
+	resp := &fuse.ReadResponse{}
+	if err = fh.Read(ctx, &fuse.ReadRequest{Size: 64}, resp); err != nil {
+		t.Fatal(err)
+	}
+	return string(resp.Data)
+}
+
+func TestWrittenFilesSealed(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	mfs := newTestFS(t, s3, CacheEncryptionKey(strings.Repeat("ab", 32)))
+
+	_, h1, h2 := openTwice(t, mfs, "bucket", "file")
+	write(t, h1, 0, "hello ")
+	write(t, h2, 6, "world")
+	if err := closeHandle(h1); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeHandle(h2); err != nil {
+		t.Fatal(err)
+	}
+
+	if paths := clearFiles(t, mfs, "hello world"); len(paths) > 0 {
+		t.Fatalf("written data left in the clear in %v", paths)
+	}
+	if data := readFile(t, mfs, "bucket", "file"); data != "hello world" {
+		t.Fatalf("read %q, expected the written data", data)
+	}
+}
+
+func TestUnchangedWritableOpenSealed(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "file", []byte("the object"))
+	mfs := newTestFS(t, s3, CacheEncryptionKey(strings.Repeat("ab", 32)))
+
+	ctx := context.Background()
+	node, err := mfs.dirAt("bucket").lookup(ctx, "file", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := node.(*File).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = closeHandle(h.(*FileHandle)); err != nil {
+		t.Fatal(err)
+	}
+
+	if paths := clearFiles(t, mfs, "the object"); len(paths) > 0 {
+		t.Fatalf("object left in the clear in %v", paths)
+	}
+	if data := readFile(t, mfs, "bucket", "file"); data != "the object" {
+		t.Fatalf("read %q, expected the object", data)
+	}
+}
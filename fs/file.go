@@ -17,10 +17,11 @@ package minfs
 
 import (
 	"context"
-	"fmt"
+	"net/http"
 	"os"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -57,11 +58,20 @@ type File struct {
 	Flags    uint32 // see chflags(2)
 
 	Hash []byte
+
+	// object metadata, fetched on first use
+	objMeta *objectMeta
+
+	// last modification of the object as listed, zero when not known
+	modified time.Time
 }
 
 func (f *File) store(tx *meta.Tx) error {
-	b := f.bucket(tx)
-	fmt.Printf("Storing %v at %s as %T\n", f, path.Base(f.Path), f)
+	b, err := f.dir.createBucket(tx)
+	if err != nil {
+		return err
+	}
+	f.mfs.log.Debugf("Storing %v at %s as %T", f, path.Base(f.Path), f)
 	return b.Put(path.Base(f.Path), f)
 }
 
@@ -78,6 +88,7 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 		Uid:    f.UID,
 		Gid:    f.GID,
 		Flags:  f.Flags,
+		Valid:  f.mfs.nodes.Valid(f.FullPath()),
 	}
 
 	return nil
@@ -85,6 +96,10 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 
 // Setattr - set attribute.
 func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if f.mfs.config.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+
 	// update cache with new attributes
 	return f.mfs.db.Update(func(tx *meta.Tx) error {
 		if req.Valid.Mode() {
@@ -127,6 +142,9 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 			f.Flags = req.Flags
 		}
 
+		f.objMeta.invalidate()
+		f.mfs.invalidate(f.FullPath())
+
 		return f.store(tx)
 	})
 }
@@ -137,7 +155,7 @@ func (f *File) FullPath() string {
 }
 
 func (f *File) ObjectPath() string {
-	return strings.Replace(f.FullPath(), f.Bucket()+"/", "", 1)
+	return f.mfs.keyPath(strings.TrimPrefix(f.FullPath(), f.Bucket()+"/"))
 }
 
 func (f *File) Bucket() string {
@@ -146,14 +164,32 @@ func (f *File) Bucket() string {
 
 // Saves a new file at cached path and fetches the object based on
 // the incoming fuse request.
-func (f *File) cacheSave(ctx context.Context, path string, req *fuse.OpenRequest, api *minio.Client) error {
+func (f *File) cacheSave(ctx context.Context, path string, req *fuse.OpenRequest, api *minio.Client, object minio.ObjectInfo) error {
 
 	// TODO: This should block if another instance of this function is running for the same path
 
-	if _, err := os.Stat(path); err == nil {
-		currentTime := time.Now().Local()
-		err = os.Chtimes(path, currentTime, currentTime)
-		return err
+	if info, err := f.mfs.statLocal(path); err == nil {
+		// A file cut short by a crash mid download is fetched again. Open
+		// files may be ahead of the object, writes to them aren't
+		// uploaded yet.
+		size, inUse := f.mfs.cachedSize(path, info), f.mfs.cacheInUse(path)
+		if size == object.Size || inUse {
+			// Written in place while open, a file in use may not hold
+			// the version anymore.
+			if !inUse {
+				f.mfs.addContent(object.ETag, path)
+			}
+			f.mfs.metrics.cacheHit()
+			return f.mfs.touchCache(path, info)
+		}
+
+		f.mfs.log.Println("Cache file", path, "has", info.Size(), "bytes of", object.Size, "fetching", f.FullPath(), "again")
+		if err = f.mfs.retryLocal(func() error {
+			return os.Remove(path)
+		}); err != nil {
+			return err
+		}
+		f.mfs.cacheRemoved(path)
 	}
 
 	if req.Flags&fuse.OpenTruncate == fuse.OpenTruncate {
@@ -161,93 +197,360 @@ func (f *File) cacheSave(ctx context.Context, path string, req *fuse.OpenRequest
 		return nil
 	}
 
+	// The version cached for another key is linked instead of fetched, it
+	// takes no room.
+	if f.mfs.linkContent(path, object) {
+		f.Size = uint64(object.Size)
+		f.mfs.recordCache(path, object.Key, object.ETag)
+		f.mfs.metrics.cacheHit()
+		return nil
+	}
+
+	f.mfs.metrics.cacheMiss()
+
+	if err := f.mfs.reserveCache(f.Bucket(), object.Size); err != nil {
+		return err
+	}
+
+	// Downloading can take a while, keep eviction away from the file meanwhile.
+	f.mfs.beginDownload(path)
+	defer f.mfs.endDownload(path)
+
+	// A download stuck on a connection doesn't hold the cache file forever.
+	dctx, cancel := withTimeout(ctx, f.mfs.config.downloadTimeout)
+	defer cancel()
+
+	// A peer having the object cached serves it faster than the servers.
+	// Peers only serve objects cached as is.
+	blocks := isBlockCachePath(path)
+	err := errPeerMiss
+	if len(f.mfs.config.cachePeers) > 0 && !blocks {
+		err = f.mfs.fetchFromPeers(dctx, f.Bucket(), path, object)
+	}
+
 	// FGetObject faster, safer implimentation for large files
 	// mfs.log.Println("FGetObject():", ctx, f.mfs.config.bucket, f.RemotePath(), path, minio.GetObjectOptions{})
-	err := api.FGetObject(ctx, f.Bucket(), f.ObjectPath(), path, minio.GetObjectOptions{})
-	if err != nil {
-		if meta.IsNoSuchObject(err) {
+	fromServer := err != nil
+	start := time.Now()
+	if fromServer && blocks {
+		err = f.fetchBlocks(dctx, req.Uid, api, object, path)
+	} else if fromServer && f.mfs.parallelDownload(object.Size) {
+		err = f.fetchParallel(dctx, req.Uid, api, object, path)
+	} else if fromServer {
+		opts := f.mfs.getOptions(f.Bucket())
+		if err = opts.SetMatchETag(object.ETag); err != nil {
+			return err
+		}
+		err = f.mfs.retryExpired(dctx, req.Uid, func() error {
+			return api.FGetObject(dctx, f.Bucket(), f.ObjectPath(), path, opts)
+		})
+	}
+	if err != nil && timedOut(ctx, dctx) {
+		f.mfs.log.Errorln("Download of", f.FullPath(), "timed out after", f.mfs.config.downloadTimeout)
+		return fuse.EIO
+	} else if archivedObject(err) {
+		// Restoring takes hours, the open fails right away instead.
+		f.mfs.log.Errorln("Object", f.FullPath(), "is archived, it can't be read until restored")
+		return fuse.Errno(syscall.EAGAIN)
+	} else if err != nil {
+		if objectGone(err) {
 			return fuse.ENOENT
 		}
 		return err
 	}
 
-	cachedFile, err := os.Stat(path)
+	cachedFile, err := f.mfs.statLocal(path)
 
 	if err != nil {
 		return err
 	}
 
-	// update actual file size
-	f.Size = uint64(cachedFile.Size())
+	// The object changed while fetched, or the download was cut short
+	// without an error. Not served, the next open fetches it again.
+	size := f.mfs.cachedSize(path, cachedFile)
+	if size != object.Size {
+		f.mfs.log.Errorln("Cache file", path, "has", size, "bytes of", object.Size, "after fetching", f.FullPath())
+		if err = f.mfs.retryLocal(func() error {
+			return os.Remove(path)
+		}); err != nil && !os.IsNotExist(err) {
+			f.mfs.log.Errorln("Unable to remove cache file", path, err)
+		}
+		return fuse.EIO
+	}
+
+	// update actual file size, the quota accounts the file on disk
+	f.Size = uint64(size)
+	f.mfs.cacheAdded(path, cachedFile)
+	f.mfs.recordCache(path, object.Key, object.ETag)
+	f.mfs.addContent(object.ETag, path)
+
+	if fromServer {
+		took := time.Since(start)
+		f.mfs.metrics.downloaded(size, took)
+
+		// Logged with the key and size, to tell slow servers from slow
+		// cache disks.
+		if slow := f.mfs.config.slowDownload; slow > 0 && took > slow {
+			f.mfs.log.Warnln("Slow download of", f.FullPath(), "key", object.Key, "of", humanSize(size), "took", took, "at", humanSize(int64(float64(size)/took.Seconds()))+"/s")
+		}
+	}
 
 	// Success.
 	return nil
 }
 
 // Generates a cache path based on the minio MD5 checksum
-func (f *File) cacheAllocate(ctx context.Context, api *minio.Client) (string, error) {
-
-	object, err := api.StatObject(ctx, f.Bucket(), f.ObjectPath(), minio.GetObjectOptions{})
-
-	if err != nil {
-		if meta.IsNoSuchObject(err) {
-			return "", fuse.ENOENT
+func (f *File) cacheAllocate(ctx context.Context, uid uint32, api *minio.Client) (string, minio.ObjectInfo, error) {
+
+	// The object as just listed or stat is reused, downloads only fetch
+	// that version.
+	object, ok := f.objMeta.recentStat(f.mfs.config.statCacheTTL)
+	if !ok {
+		octx, cancel := withTimeout(ctx, f.mfs.config.opTimeout)
+		defer cancel()
+
+		err := f.mfs.retryExpired(octx, uid, func() (err error) {
+			object, err = api.StatObject(octx, f.Bucket(), f.ObjectPath(), f.mfs.getOptions(f.Bucket()))
+			return err
+		})
+		if err != nil && timedOut(ctx, octx) {
+			f.mfs.log.Errorln("Stat of", f.FullPath(), "timed out after", f.mfs.config.opTimeout)
+			return "", object, fuse.EIO
+		} else if objectGone(err) {
+			// Removed from the server, what is cached of it is stale.
+			f.mfs.log.Println("Object", f.FullPath(), "was removed, dropping its cache files")
+			f.mfs.dropObject(f.Bucket(), f.ObjectPath())
+			f.mfs.invalidate(f.FullPath())
+			return "", object, fuse.ENOENT
+		} else if err != nil {
+			return "", object, err
 		}
-		return "", err
+		f.objMeta.setInfo(object)
 	}
 
-	// Success.
-	cachePath := path.Join(f.mfs.config.cache, object.Key+"-"+object.ETag+".fcache")
+	// Versions cached before the object changed are never read again.
+	cachePath := f.mfs.cachePath(f.Bucket(), object.Key, object.ETag)
+	f.mfs.dropStaleVersions(f.Bucket(), object.Key, cachePath)
 
-	return cachePath, err
+	// Success.
+	return cachePath, object, nil
 }
 
 // Open return a file handle of the opened file
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	// No new file is opened once shutting down.
+	if !f.mfs.ops.begin() {
+		return nil, fuse.EIO
+	}
+	defer f.mfs.ops.end()
+
+	if req.Flags.IsReadOnly() {
+		return f.open(ctx, req, resp)
+	} else if f.mfs.config.readOnly {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+
+	// Writers open the object once an upload of it is done. Appending and
+	// streaming writers take turns when they flush, see flushAppend.
+	unlockObject := f.mfs.lockObject(f.FullPath())
+	defer unlockObject()
+
+	fh, err := f.open(ctx, req, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if fh.appending || fh.upload != nil {
+		return fh, nil
+	}
+
+	// Other writers share the cache file, it is uploaded when the last closes.
+	f.mfs.addWriter(f.FullPath(), fh.cachePath, fh.uid)
+	fh.writer = true
+
+	// Truncated on open, the object changed even without writes.
+	if req.Flags&fuse.OpenTruncate != 0 {
+		fh.dirty = true
+		f.mfs.setDirty(f.FullPath(), true)
+	}
+
+	return fh, nil
+}
+
+// open returns a handle on the cached object, fetching it when needed.
+func (f *File) open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (*FileHandle, error) {
 
 	start := time.Now()
 
 	resp.Flags |= fuse.OpenDirectIO
 
-	api, err := f.mfs.getApi(req.Uid)
+	// A file created through the mount isn't an object yet, it is opened
+	// from the cache file it is written to.
+	if cachePath, ok := f.mfs.createdFile(f.FullPath()); ok {
+		return f.openCreated(req, resp, cachePath)
+	}
+
+	if req.Flags.IsWriteOnly() && req.Flags&fuse.OpenAppend != 0 {
+		return f.openAppend(req, resp)
+	}
+
+	if f.mfs.config.streamPartSize > 0 && req.Flags.IsWriteOnly() && req.Flags&fuse.OpenTruncate != 0 {
+		return f.openUpload(ctx, req, resp)
+	}
+
+	api, err := f.mfs.getBucketApi(ctx, req.Uid, f.Bucket())
 	if err != nil {
-		fmt.Println("Some error with getApi()")
+		f.mfs.log.Errorln("Some error with getApi()", err)
 		return nil, err
 	}
 
-	cachePath, err := f.cacheAllocate(ctx, api)
+	// The object changed since it was listed or stat, it is stat again.
+	fh, err := f.openObject(ctx, req, resp, api, start)
+	if isPreconditionFailed(err) {
+		f.objMeta.invalidate()
+		fh, err = f.openObject(ctx, req, resp, api, start)
+	}
+	return fh, err
+}
+
+// isPreconditionFailed returns if err is a request for a version of an
+// object that isn't the current one anymore.
+func isPreconditionFailed(err error) bool {
+	return minio.ToErrorResponse(err).StatusCode == http.StatusPreconditionFailed
+}
+
+// openObject returns a handle on the object, fetched to the cache unless
+// it is cached already or read otherwise.
+func (f *File) openObject(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse, api *minio.Client, start time.Time) (*FileHandle, error) {
+	cachePath, object, err := f.cacheAllocate(ctx, req.Uid, api)
 	if err != nil {
-		fmt.Println("Some error with cacheAllocate()")
+		f.mfs.log.Errorln("Some error with cacheAllocate()", err)
 		return nil, err
 	}
 
+	// Objects the cache filesystem can't hold are streamed instead.
+	if limit := f.mfs.maxCacheFileSize(f.Bucket()); limit > 0 && object.Size > limit {
+		f.mfs.log.Println("Streaming", f.FullPath(), "of", object.Size, "bytes, larger than the cache file limit of", limit, "bytes")
+		f.Size = uint64(object.Size)
+		return f.openStream(req, resp, api, object)
+	}
+
+	// Objects not cached whole are read by range, when asked to.
+	if f.mfs.config.rangeReads && req.Flags.IsReadOnly() {
+		if _, err = f.mfs.statLocal(cachePath); err != nil {
+			return f.openRange(req, resp, api, object, cachePath)
+		}
+	}
+
+	// Read only opens may be served from a block cache file.
+	if req.Flags.IsReadOnly() {
+		cachePath = f.mfs.readCachePath(cachePath, object)
+	}
+
 	// Once we know the cache path (RESOURCE), we lock it down until the Open request is fully served
 	unlock := f.mfs.km.Lock(cachePath)
 	defer unlock()
 
-	err = f.cacheSave(ctx, cachePath, req, api)
+	err = f.cacheSave(ctx, cachePath, req, api, object)
 	if err != nil {
-		f.mfs.log.Println("Some error with cacheSave", err)
+		f.mfs.log.Errorln("Some error with cacheSave", err)
 		return nil, err
 	}
 
+	// Written in place, a file shared with other objects is copied first.
+	if f.mfs.config.cacheDedup && !req.Flags.IsReadOnly() {
+		if err = f.mfs.unshareCache(cachePath, object.ETag); err != nil {
+			f.mfs.log.Errorln("Unable to unshare cache file", cachePath, err)
+			return nil, fuse.EIO
+		}
+	}
+
 	fh, err := f.mfs.Acquire(f, cachePath)
 	if err != nil {
-		f.mfs.log.Println("Some error with Acquire", err)
+		f.mfs.log.Errorln("Some error with Acquire", err)
 		return nil, err
 	}
 
 	fh.cachePath = cachePath
+	fh.etag = object.ETag
+	fh.uid = req.Uid
 
-	fh.File, err = os.OpenFile(fh.cachePath, int(req.Flags), f.mfs.config.mode)
+	fh.File, err = f.mfs.openLocal(fh.cachePath, int(req.Flags), f.mfs.config.mode)
 	if err != nil {
-		f.mfs.log.Println("Some error with OpenFile", err)
+		f.mfs.log.Errorln("Some error with OpenFile", err)
+		f.mfs.Release(fh)
 		return nil, err
 	}
 
+	if isBlockCachePath(cachePath) {
+		if fh.blocks, err = openBlockFile(fh.File, f.mfs.config.cacheCipher); err != nil {
+			f.mfs.log.Errorln("Unable to read block cache file", cachePath, err)
+			fh.File.Close()
+			f.mfs.Release(fh)
+			return nil, fuse.EIO
+		}
+	}
+
 	resp.Handle = fuse.HandleID(fh.handle)
 
-	f.mfs.log.Println("Serving FH request [", fh.handle, "], acquired file lock on: ", f.FullPath(), " cache resource @", cachePath, "took", time.Since(start))
+	f.mfs.log.Debugln("Serving FH request [", fh.handle, "], acquired file lock on: ", f.FullPath(), " cache resource @", cachePath, "took", time.Since(start))
+
+	return fh, nil
+}
+
+// openCreated returns a handle on the cache file of a file created through
+// the mount, which isn't uploaded yet.
+func (f *File) openCreated(req *fuse.OpenRequest, resp *fuse.OpenResponse, cachePath string) (*FileHandle, error) {
+	fh, err := f.mfs.Acquire(f, cachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fh.cachePath = cachePath
+	fh.uid = req.Uid
+
+	fh.File, err = f.mfs.openLocal(cachePath, int(req.Flags)&^os.O_CREATE, 0600)
+	if err != nil {
+		f.mfs.log.Errorln("Some error with OpenFile", err)
+		f.mfs.Release(fh)
+		return nil, err
+	}
+
+	if info, err := fh.File.Stat(); err == nil {
+		f.Size = uint64(info.Size())
+	}
+
+	resp.Handle = fuse.HandleID(fh.handle)
+	return fh, nil
+}
+
+// openAppend returns a handle staging appended data in a new cache file,
+// without fetching the object. The staged data is appended to the object
+// on flush.
+func (f *File) openAppend(req *fuse.OpenRequest, resp *fuse.OpenResponse) (*FileHandle, error) {
+	stagePath, err := f.mfs.NewCachePath()
+	if err != nil {
+		return nil, err
+	}
+
+	fh, err := f.mfs.Acquire(f, stagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fh.cachePath = stagePath
+	fh.uid = req.Uid
+	fh.appending = true
+
+	fh.File, err = f.mfs.openLocal(fh.cachePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		f.mfs.Release(fh)
+		return nil, err
+	}
+
+	resp.Handle = fuse.HandleID(fh.handle)
+
+	f.mfs.log.Debugln("Serving FH request [", fh.handle, "], appending to: ", f.FullPath(), " staged @", stagePath)
 
 	return fh, nil
 }
@@ -270,6 +573,7 @@ func (f *File) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse
 		Uid:    f.UID,
 		Gid:    f.GID,
 		Flags:  f.Flags,
+		Valid:  f.mfs.nodes.Valid(f.FullPath()),
 	}
 
 	return nil
@@ -277,9 +581,13 @@ func (f *File) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse
 
 // Dirent returns the File object as a fuse.Dirent
 func (f File) Dirent() fuse.Dirent {
-	return fuse.Dirent{
+	dirent := fuse.Dirent{
 		Inode: f.Inode, Name: f.Path, Type: fuse.DT_File,
 	}
+	if f.Mode&os.ModeSymlink != 0 {
+		dirent.Type = fuse.DT_Link
+	}
+	return dirent
 }
 
 // Dirent will return the fuse Dirent for current dir
@@ -0,0 +1,145 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+func TestAppendingWritersTakeTurns(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "log", nil)
+	mfs := newTestFS(t, s3)
+
+	ctx := context.Background()
+	node, err := mfs.dirAt("bucket").lookup(ctx, "log", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := node.(*File)
+
+	const appends = 10
+	var wg sync.WaitGroup
+	for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n"} {
+		wg.Add(1)
+		go func(line string) {
+			defer wg.Done()
+			for i := 0; i < appends; i++ {
+				h, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly | fuse.OpenAppend}, &fuse.OpenResponse{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				fh := h.(*FileHandle)
+
+				// Appended at the end of the object, as the kernel does.
+				for _, c := range []byte(line) {
+					if err = fh.Write(ctx, &fuse.WriteRequest{Offset: int64(f.Size), Data: []byte{c}}, &fuse.WriteResponse{}); err != nil {
+						t.Error(err)
+					}
+				}
+				if err = closeHandle(fh); err != nil {
+					t.Error(err)
+				}
+			}
+		}(line)
+	}
+	wg.Wait()
+
+	data, _ := s3.object("bucket", "log")
+	lines := strings.SplitAfter(string(data), "\n")
+	if len(lines) != 2*appends+1 {
+		t.Fatalf("object has %d lines, expected %d: %q", len(lines)-1, 2*appends, data)
+	}
+	for _, line := range lines[:2*appends] {
+		if line != "aaaaaaa\n" && line != "bbbbbbb\n" {
+			t.Fatalf("appends interleaved in line %q", line)
+		}
+	}
+	if a := bytes.Count(data, []byte("aaaaaaa\n")); a != appends {
+		t.Fatalf("object has %d appends of the first writer, expected %d", a, appends)
+	}
+}
+
+// within fails t when fn doesn't return in time.
+func within(t *testing.T, what string, fn func() error) {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s blocked by an appending handle", what)
+	}
+}
+
+func TestAppendingHandleDoesntBlock(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	s3.put("bucket", "log", []byte("start\n"))
+	mfs := newTestFS(t, s3)
+
+	ctx := context.Background()
+	node, err := mfs.dirAt("bucket").lookup(ctx, "log", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := node.(*File)
+
+	var first, second *FileHandle
+	open := func(fh **FileHandle) func() error {
+		return func() error {
+			h, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly | fuse.OpenAppend}, &fuse.OpenResponse{})
+			if err == nil {
+				*fh = h.(*FileHandle)
+			}
+			return err
+		}
+	}
+
+	within(t, "an append", open(&first))
+	write(t, first, int64(f.Size), "first\n")
+	within(t, "fsync", func() error { return f.Fsync(ctx, &fuse.FsyncRequest{}) })
+
+	within(t, "a second append", open(&second))
+	write(t, second, int64(f.Size), "second\n")
+	if err = closeHandle(second); err != nil {
+		t.Fatal(err)
+	}
+	if err = closeHandle(first); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := s3.object("bucket", "log"); string(data) != "start\nsecond\nfirst\n" {
+		t.Fatalf("object holds %q, expected both appends", data)
+	}
+
+	within(t, "an append", open(&first))
+	within(t, "rm", func() error {
+		return mfs.dirAt("bucket").Remove(ctx, &fuse.RemoveRequest{Name: "log"})
+	})
+	first.Release(ctx, &fuse.ReleaseRequest{})
+}
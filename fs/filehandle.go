@@ -21,8 +21,7 @@ import (
 	"os"
 
 	"bazil.org/fuse"
-
-	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
 )
 
 // FileHandle - Contains an opened file which can be read from and written to
@@ -39,13 +38,51 @@ type FileHandle struct {
 	cachePath string
 
 	handle uint64
+
+	// uid of the opening process
+	uid uint32
+
+	// client of a streamed object, which has no cache file
+	api *minio.Client
+
+	// version of the object opened
+	etag string
+
+	// the handle is a writable handle of the object, see writeState
+	writer bool
+
+	// streams the written data to the object, see streamUpload
+	upload *streamUpload
+
+	// ranges of a sparse cache file fetched, nil unless read by range
+	ranges *rangeSet
+
+	// reads a block cache file, nil for others
+	blocks *blockFile
+
+	// prefetches ahead of sequential reads by range, nil without readahead
+	readahead *readahead
+
+	// the cache file stages data appended to the end of the object
+	appending bool
 }
 
 // Read from the file handle
 func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if fh.File == nil {
+		return fh.readStream(ctx, req, resp)
+	} else if fh.ranges != nil {
+		return fh.readRange(ctx, req, resp)
+	}
+
 	// mfs.log.Debug("Reading for", fh.handle, fh.cachePath, req.Offset, req.Size/1024, "kB")
+	var r io.ReaderAt = fh.File
+	if fh.blocks != nil {
+		r = fh.blocks
+	}
+
 	buff := make([]byte, req.Size)
-	n, err := fh.File.ReadAt(buff, req.Offset)
+	n, err := r.ReadAt(buff, req.Offset)
 	if err != nil && err != io.EOF {
 		return err
 	}
@@ -55,68 +92,189 @@ func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fus
 
 // Write to the file handle
 func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	if _, err := fh.File.Seek(req.Offset, 0); err != nil {
-		return err
+	var (
+		n   int
+		err error
+	)
+	if fh.upload != nil {
+		n, err = fh.writeUpload(ctx, req)
+	} else if fh.appending {
+		// As with O_APPEND, every write goes to the end, whatever other
+		// writers appended meanwhile. Only the appended data is staged.
+		if _, err = fh.File.Seek(0, io.SeekEnd); err == nil {
+			n, err = fh.File.Write(req.Data)
+		}
+	} else if _, err = fh.File.Seek(req.Offset, 0); err == nil {
+		n, err = fh.File.Write(req.Data)
 	}
-	n, err := fh.File.Write(req.Data)
 	if err != nil {
 		return err
 	}
 	// Writes that grow the file are expected to update the file size
 	// (as seen through Attr). Note that file size changes are
 	// communicated also through Setattr.
-	if fh.f.Size < uint64(req.Offset)+uint64(n) {
+	if fh.appending {
+		fh.f.Size += uint64(n)
+	} else if fh.f.Size < uint64(req.Offset)+uint64(n) {
 		fh.f.Size = uint64(req.Offset) + uint64(n)
 	}
 	resp.Size = n
 	fh.dirty = true
+	if fh.writer {
+		fh.f.mfs.setDirty(fh.f.FullPath(), true)
+	}
 	return nil
 }
 
 // Fsync because of bug in fuse lib, this is on file. -- FIXME - needs more context (y4m4).
+//
+// The object is uploaded right away when dirty, without waiting for its
+// handles to close, and fsync returns once the server has it. The cache
+// file is flushed to disk first, and isn't evicted during the upload.
 func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	f.mfs.ops.track()
+	defer f.mfs.ops.end()
+
 	// mfs.log.Debug("fsync", f.FullPath())
-	return nil
+	return f.upload()
 }
 
 // Release the file handle
 func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	fh.f.mfs.ops.track()
+	defer fh.f.mfs.ops.end()
+
+	if fh.File == nil {
+		return fh.f.mfs.Release(fh)
+	}
+
+	// The file is closed once nothing prefetches to it anymore.
+	if fh.readahead != nil {
+		fh.readahead.stop()
+	}
+
 	if err := fh.Close(); err != nil {
 		return err
 	}
 
 	defer fh.f.mfs.Release(fh)
 
+	// The last handle uploads what a failed or skipped flush left dirty.
+	if fh.writer && fh.f.mfs.removeWriter(fh.f.FullPath()) {
+		if err := fh.f.upload(); err != nil {
+			fh.f.uploadLater()
+			return err
+		}
+	}
+
+	// Uploaded, the last handle leaves nothing in the clear with a cache key.
+	if fh.writer && !fh.f.mfs.writing(fh.f.FullPath()) {
+		fh.sealWritten()
+	}
+
+	// Staged appends and uploads have been flushed, the staging file is of
+	// no further use.
+	if fh.appending || fh.upload != nil {
+		os.Remove(fh.cachePath)
+	}
+
+	if fh.upload != nil {
+		fh.abortUpload()
+	}
+
 	// TODO: We were removing the cached file... we can be smarter about cache management...
 	// os.Remove(fh.cachePath)
 	return nil
 }
 
-// Flush - experimenting with uploading at flush, this slows operations down till it has been
-// completely flushed
+// sealWritten seals the cache file the writable handle fh wrote, under its
+// name since an upload of it, with the version it holds.
+func (fh *FileHandle) sealWritten() {
+	fh.f.mfs.m.Lock()
+	cachePath, ok := fh.f.mfs.openfds[fh.handle]
+	fh.f.mfs.m.Unlock()
+	if !ok {
+		return
+	}
+
+	etag := fh.etag
+	if cachePath == fh.f.mfs.cachePath(fh.f.Bucket(), fh.f.ObjectPath(), fh.f.ETag) {
+		etag = fh.f.ETag
+	}
+	fh.f.mfs.sealCache(cachePath, fh.f.ObjectPath(), etag)
+}
+
+// Flush - uploads the object when the last writable handle is closed, this slows
+// operations down till it has been completely flushed. Flushes of the other
+// handles are coalesced into that upload.
 func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	if !fh.dirty {
+	fh.f.mfs.ops.track()
+	defer fh.f.mfs.ops.end()
+
+	if fh.appending {
+		if !fh.dirty {
+			return nil
+		}
+		return fh.flushAppend()
+	}
+
+	if fh.upload != nil {
+		if !fh.dirty {
+			return nil
+		}
+
+		// Completed once other writers are done with the object.
+		unlock := fh.f.mfs.lockObject(fh.f.FullPath())
+		err := fh.flushUpload(ctx)
+		unlock()
+		if err != nil {
+			fh.f.mfs.log.Errorln("Error uploading", fh.f.FullPath(), err)
+			return fuse.EIO
+		}
+		fh.f.objMeta.invalidate()
+		fh.f.mfs.invalidate(fh.f.FullPath())
+		fh.dirty = false
 		return nil
 	}
 
-	sr := newPutOp(fh.Name(), fh.f.FullPath(), int64(fh.f.Size))
-	if err := fh.f.mfs.sync(&sr); err != nil {
-		return err
+	if !fh.writer || !fh.f.mfs.lastWriter(fh.f.FullPath()) {
+		return nil
 	}
 
 	// we'll wait for the request to be uploaded and synced, before
 	// releasing the file
-	if err := <-sr.Error; err != nil {
+	if err := fh.f.upload(); err != nil {
 		return err
 	}
 
-	// update cache
-	if err := fh.f.mfs.db.Update(func(tx *meta.Tx) error {
-		return fh.f.store(tx)
-	}); err != nil {
+	fh.dirty = false
+	return nil
+}
+
+// flushAppend appends the staged data to the object, and restarts staging.
+// Appending writers take turns, each appends what it staged as a whole
+// once the previous is done, and neither races an upload, a rename or a
+// removal of the object.
+func (fh *FileHandle) flushAppend() error {
+	unlock := fh.f.mfs.lockObject(fh.f.FullPath())
+	defer unlock()
+
+	ar := newAppendOp(fh.cachePath, fh.f.Bucket(), fh.f.ObjectPath(), fh.uid)
+	if err := fh.f.mfs.sync(&ar); err != nil {
+		return err
+	}
+
+	if err := <-ar.Error; err != nil {
+		fh.f.mfs.log.Errorln("Error appending to", fh.f.FullPath(), err)
+		return fuse.EIO
+	}
+
+	if err := fh.File.Truncate(0); err != nil {
 		return err
 	}
 
+	fh.f.objMeta.invalidate()
+	fh.f.mfs.invalidate(fh.f.FullPath())
 	fh.dirty = false
 	return nil
 }
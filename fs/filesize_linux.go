@@ -0,0 +1,77 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package minfs
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	// msdosSuperMagic is the statfs type of FAT filesystems.
+	msdosSuperMagic = 0x4d44
+
+	// rlimInfinity is RLIM_INFINITY as an unsigned limit.
+	rlimInfinity = ^uint64(0)
+)
+
+// maxFileSize returns the largest file that can be written in dir, or 0
+// when there is no known limit.
+// diskSize returns the bytes the file takes on disk, less than its size
+// for sparse files.
+func diskSize(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return info.Size()
+}
+
+func maxFileSize(dir string) int64 {
+	var limit int64
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err == nil && st.Type == msdosSuperMagic {
+		limit = 1<<32 - 1
+	}
+
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &rlim); err == nil && rlim.Cur != rlimInfinity {
+		if cur := int64(rlim.Cur); limit == 0 || cur < limit {
+			limit = cur
+		}
+	}
+
+	return limit
+}
+
+// fileKeyOf identifies the file of info across its links.
+func fileKeyOf(info os.FileInfo) (fileKey, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fileKey{uint64(st.Dev), uint64(st.Ino)}, true
+	}
+	return fileKey{}, false
+}
+
+// linkCount returns the number of paths the file of info is linked at.
+func linkCount(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
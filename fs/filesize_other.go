@@ -0,0 +1,41 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package minfs
+
+import "os"
+
+// maxFileSize returns the largest file that can be written in dir, the
+// limit is only detected on linux.
+func diskSize(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+func maxFileSize(dir string) int64 {
+	return 0
+}
+
+// fileKeyOf identifies the file of info across its links, links are only
+// told apart on linux.
+func fileKeyOf(info os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
+
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
@@ -17,14 +17,16 @@
 package minfs
 
 import (
+	"container/list"
 	"context"
-	"crypto/tls"
 	"fmt"
-	"log"
-	"net"
+	"io"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -32,7 +34,6 @@ import (
 
 	"github.com/minio/minfs/meta"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -65,7 +66,7 @@ type MinFS struct {
 	db *meta.DB
 
 	// Logger instance.
-	log *log.Logger
+	log *logger
 
 	// contains all open handles
 	handles []*FileHandle
@@ -76,6 +77,75 @@ type MinFS struct {
 	locks   map[string]bool
 	openfds map[uint64]string
 
+	// cache paths being downloaded to, by number of downloads
+	downloads map[string]int
+
+	// recently resolved nodes
+	nodes *nodeCache
+
+	// recently listed directories, nil when disabled
+	listings *listingCache
+
+	// buckets recently listed at the root, nil when disabled
+	buckets *listingCache
+
+	// listings of the open directories
+	snapshots *dirSnapshots
+
+	// inodes by full path
+	inodes *inodeTable
+
+	// set to 1 once mounted
+	mounted int32
+
+	// reads the canary object, nil without a canary
+	canary *canary
+
+	// indexes of the archives read, by object version
+	archives map[string]*archiveIndex
+
+	// keys of the archive indexes, by last use
+	archiveUse *list.List
+
+	// translates key segments to names on the mount
+	names nameMapper
+
+	// objects open for writing, by full path
+	writers map[string]*writeState
+
+	// directories made without a marker, by full path
+	dirs map[string]bool
+
+	// parts of the appends in progress, by bucket and key
+	appendParts map[string]bool
+
+	// accounting of the cache directories, by directory
+	caches map[string]*cacheIndex
+
+	// ranges fetched of the sparse cache files, by cache path
+	ranges map[string]*rangeSet
+
+	// cache path of the version of each object opened last, by bucket and key
+	versions map[string]string
+
+	// cache files kept from eviction, by cache path
+	pinned map[string]bool
+
+	// bucket of the cache files of buckets with a cache quota, by cache path
+	cacheBuckets map[string]string
+
+	// cache file holding each version cached, by etag, for deduplication
+	contents map[string]string
+
+	// endpoints denying the listing of their buckets, by endpoint key
+	deniedLists map[string]bool
+
+	// newest object of each directory when last listed, by full path
+	dirTimes map[string]time.Time
+
+	// directories not listed yet date from the start of the mount
+	started time.Time
+
 	// Global openfd map lock
 	m sync.Mutex
 
@@ -85,6 +155,34 @@ type MinFS struct {
 
 	// Keyed cache resource lock
 	km KeyedMutex
+
+	// Limits S3 requests across all clients, nil when unlimited
+	limiter *rateLimiter
+
+	// Budget paying for the retries of all clients
+	retries *retryBudget
+
+	// Credentials requests are signed with, per uid
+	provider CredentialProvider
+
+	// Metrics of the mount, noMetrics unless served
+	metrics metrics
+
+	// Transport to the servers, shared by all clients
+	transport *http.Transport
+
+	// Client of the cache peers, over the transport to the servers
+	peerClient *http.Client
+
+	// operations in progress, drained on shutdown
+	ops opTracker
+
+	// closed once Serve returned
+	served chan struct{}
+
+	// minio clients per endpoint and uid, guarded by cm
+	clients map[clientKey]cachedClient
+	cm      sync.Mutex
 }
 
 // New will return a new MinFS client
@@ -95,6 +193,12 @@ func New(options ...func(*Config)) (*MinFS, error) {
 		return nil, err
 	}
 
+	// Options set in the environment come first, so options override them.
+	envOptions, err := EnvOptions()
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize log file.
 	logW, err := os.OpenFile(globalLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 	if err != nil {
@@ -109,22 +213,55 @@ func New(options ...func(*Config)) (*MinFS, error) {
 		accountID: fmt.Sprintf("%d", time.Now().UTC().Unix()),
 		gid:       0,
 		uid:       0,
-		accessKey: ac.AccessKey,
-		secretKey: ac.SecretKey,
-		mode:      os.FileMode(0444),
+		mode:      globalFileMode,
+		dirMode:   globalDirMode,
+
+		localRetries: globalLocalRetries,
+		dirMarkers:   true,
+		delimiter:    "/",
+
+		maxRetries:   globalRetries,
+		retryBackoff: globalMaxRetryBackoff,
+
+		opTimeout:       globalOpTimeout,
+		downloadTimeout: globalDownloadTimeout,
+		slowDownload:    globalSlowDownload,
+		presignExpiry:   globalPresignExpiry,
+
+		nodeCacheSize:   globalNodeCacheSize,
+		listingCacheTTL: globalListingCacheTTL,
+		statCacheTTL:    globalStatCacheTTL,
+		tagCacheTTL:     globalTagCacheTTL,
+		bucketListTTL:   globalBucketListTTL,
+
+		highWatermark: globalCacheHighWatermark,
+		lowWatermark:  globalCacheLowWatermark,
+
+		downloadThreshold: globalDownloadThreshold,
+
+		accessKey:   ac.AccessKey,
+		secretKey:   ac.SecretKey,
+		secretToken: ac.SecretToken,
 	}
 
-	for _, optionFn := range options {
+	for _, optionFn := range append(envOptions, options...) {
 		optionFn(cfg)
 	}
 
-	// Create db directory.
-	if err := os.MkdirAll(cfg.cache, 0777); err != nil {
+	// Validating makes the cache directories.
+	if err := cfg.validate(); err != nil {
 		return nil, err
 	}
 
-	if err := cfg.validate(); err != nil {
-		return nil, err
+	for _, bc := range cfg.bucketCaches {
+		bc.maxFileSize = cfg.maxCacheFileSize
+		if bc.maxFileSize == 0 {
+			bc.maxFileSize = maxFileSize(bc.dir)
+		}
+	}
+
+	if cfg.maxCacheFileSize == 0 {
+		cfg.maxCacheFileSize = maxFileSize(cfg.cache)
 	}
 
 	// Initialize MinFS.
@@ -133,8 +270,60 @@ func New(options ...func(*Config)) (*MinFS, error) {
 		syncChan:       make(chan interface{}),
 		locks:          map[string]bool{},
 		openfds:        map[uint64]string{},
-		log:            log.New(logW, "MinFS ", log.Ldate|log.Ltime|log.Lshortfile),
+		downloads:      map[string]int{},
+		dirs:           map[string]bool{},
+		appendParts:    map[string]bool{},
+		caches:         map[string]*cacheIndex{},
+		ranges:         map[string]*rangeSet{},
+		versions:       map[string]string{},
+		dirTimes:       map[string]time.Time{},
+		pinned:         map[string]bool{},
+		cacheBuckets:   map[string]string{},
+		contents:       map[string]string{},
+		deniedLists:    map[string]bool{},
+		started:        time.Now(),
+		archives:       map[string]*archiveIndex{},
+		archiveUse:     list.New(),
+		writers:        map[string]*writeState{},
+		names:          keyNames{},
+		nodes:          newNodeCache(cfg.nodeCacheSize, globalNodeCacheTTL),
+		listings:       newListingCache(cfg.listingCacheTTL),
+		buckets:        newListingCache(cfg.bucketListTTL),
+		snapshots:      newDirSnapshots(),
+		inodes:         newInodeTable(cfg.root, globalInodeTableSize),
+		clients:        map[clientKey]cachedClient{},
+		log:            newLogger(logW, cfg.debug),
 		listenerDoneCh: make(chan struct{}),
+		served:         make(chan struct{}),
+		metrics:        noMetrics{},
+	}
+
+	if cfg.windowsNames {
+		fs.names = windowsNames{}
+	} else if cfg.delimiter != "/" {
+		fs.names = flatNames{}
+	}
+
+	fs.transport = fs.newTransport()
+	fs.peerClient = &http.Client{Transport: fs.transport}
+
+	fs.provider = cfg.provider
+	if fs.provider == nil {
+		fs.provider = newConfigCredentials(cfg, fs.transport)
+	}
+
+	if cfg.canary != nil {
+		fs.canary = &canary{mfs: fs, cfg: *cfg.canary}
+	}
+
+	if cfg.maxRequests > 0 {
+		fs.limiter = newRateLimiter(cfg.maxRequests)
+	}
+
+	fs.retries = newRetryBudget(cfg.retryBudget)
+
+	if cfg.metricsAddr != "" {
+		fs.metrics = newMetrics(fs)
 	}
 
 	// Success..
@@ -143,68 +332,37 @@ func New(options ...func(*Config)) (*MinFS, error) {
 
 func (mfs *MinFS) mount() (*fuse.Conn, error) {
 	mfs.log.Println("Mounting target...", mfs.config.mountpoint)
-	return fuse.Mount(
-		mfs.config.mountpoint,
+
+	options := []fuse.MountOption{
 		fuse.FSName("mskvfs"),
 		fuse.Subtype("mskvfs"),
 		fuse.AllowOther(),
-	)
-}
-
-func (mfs *MinFS) getApi(uid uint32) (api *minio.Client, err error) {
-
-	var (
-		host   = mfs.config.target.Host
-		access = mfs.config.accessKey
-		secret = mfs.config.secretKey
-		token  = mfs.config.secretToken
-		secure = mfs.config.target.Scheme == "https"
-	)
-
-	var transport http.RoundTripper = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: false,
-		},
-		// Set this value so that the underlying transport round-tripper
-		// doesn't try to auto decode the body of objects with
-		// content-encoding set to `gzip`.
-		//
-		// Refer:
-		//    https://golang.org/src/net/http/transport.go?h=roundTrip#L1843
-		DisableCompression: true,
 	}
 
-	creds := credentials.NewStaticV4(access, secret, token)
-	options := &minio.Options{
-		Creds:     creds,
-		Secure:    secure,
-		Transport: transport,
+	// The kernel refuses writes to a read only mount itself.
+	if mfs.config.readOnly {
+		options = append(options, fuse.ReadOnly())
 	}
 
-	api, err = minio.New(host, options)
-
-	return api, err
+	return fuse.Mount(mfs.config.mountpoint, options...)
 }
 
 // Serve starts the MinFS client
 func (mfs *MinFS) Serve() (err error) {
 	if mfs.config.debug {
 		fuse.Debug = func(msg interface{}) {
-			mfs.log.Printf("%#v\n", msg)
+			mfs.log.Debugf("%#v", msg)
 		}
 	}
 
+	// Closed last, once the database is closed and the mount is gone.
+	defer close(mfs.served)
+
 	defer mfs.shutdown()
 
+	// Stops the goroutines serving the mount.
+	defer close(mfs.listenerDoneCh)
+
 	// mount the drive
 	var c *fuse.Conn
 	c, err = mfs.mount()
@@ -222,8 +380,12 @@ func (mfs *MinFS) Serve() (err error) {
 
 		mfs.log.Println("Intercepted trapChannel signal, attempting graceful shutdown")
 
-		mfs.shutdown()
+		ctx, cancel := context.WithTimeout(context.Background(), globalShutdownTimeout)
+		defer cancel()
 
+		if err := mfs.Shutdown(ctx); err != nil {
+			mfs.log.Errorln("Unable to shut down gracefully", err)
+		}
 	}()
 
 	// Initialize database.
@@ -232,57 +394,49 @@ func (mfs *MinFS) Serve() (err error) {
 	if err != nil {
 		return err
 	}
-	defer mfs.db.Close()
+	defer func() {
+		// The next mount accounts the cache from the index instead of
+		// walking it, once shut down cleanly.
+		for _, dir := range mfs.cacheDirs() {
+			mfs.saveCacheIndex(dir, true)
+		}
+		mfs.db.Close()
+	}()
 
 	mfs.log.Println("Initializing cache database")
 	if err = mfs.db.Update(func(tx *meta.Tx) error {
-		_, berr := tx.CreateBucketIfNotExists([]byte("minio/"))
+		if _, berr := tx.CreateBucketIfNotExists([]byte("minio/")); berr != nil {
+			return berr
+		}
+		_, berr := tx.CreateBucketIfNotExists([]byte(globalCacheIndexBucket))
 		return berr
 	}); err != nil {
 		return err
 	}
 
 	mfs.log.Println("Initializing minio client:")
-	var (
-		host   = mfs.config.target.Host
-		access = mfs.config.accessKey
-		secret = mfs.config.secretKey
-		token  = mfs.config.secretToken
-		secure = mfs.config.target.Scheme == "https"
-	)
 
-	go mfs.MonitorCache()
-
-	var transport http.RoundTripper = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: mfs.config.insecure,
-		},
-		// Set this value so that the underlying transport round-tripper
-		// doesn't try to auto decode the body of objects with
-		// content-encoding set to `gzip`.
-		//
-		// Refer:
-		//    https://golang.org/src/net/http/transport.go?h=roundTrip#L1843
-		DisableCompression: true,
-	}
-
-	creds := credentials.NewStaticV4(access, secret, token)
-	options := &minio.Options{
-		Creds:     creds,
-		Secure:    secure,
-		Transport: transport,
-	}
-
-	mfs.api, err = minio.New(host, options)
+	// Nothing is served yet, what crashed downloads left can go. What is
+	// left is accounted from the start, Statfs reports it. After a clean
+	// shutdown the index left is trusted instead. Until the mount shuts
+	// down cleanly again the index isn't.
+	for _, dir := range mfs.cacheDirs() {
+		if mfs.config.sweepOrphans || !mfs.loadCacheIndex(dir) {
+			mfs.sweepCache(dir)
+			if _, _, err := mfs.cacheItems(dir); err != nil && !os.IsNotExist(err) {
+				mfs.log.Errorln("Unable to account cache directory", dir, err)
+			}
+		}
+		mfs.saveCacheIndex(dir, false)
+	}
+
+	go mfs.MonitorCache(mfs.listenerDoneCh)
+
+	if mfs.config.reconcileInterval > 0 {
+		go mfs.reconcileCache(mfs.listenerDoneCh, mfs.config.reconcileInterval)
+	}
+
+	mfs.api, err = mfs.getApi(context.Background(), mfs.config.uid)
 	if err != nil {
 		return err
 	}
@@ -291,16 +445,34 @@ func (mfs *MinFS) Serve() (err error) {
 		return err
 	}
 
+	if mfs.config.healthAddr != "" {
+		mfs.serveHealth(mfs.config.healthAddr)
+	}
+
+	if mfs.config.metricsAddr != "" {
+		mfs.serveMetrics(mfs.config.metricsAddr)
+	}
+
+	if mfs.config.peerAddr != "" {
+		mfs.serveCachePeer(mfs.config.peerAddr)
+	}
+
+	atomic.StoreInt32(&mfs.mounted, 1)
+
+	if mfs.canary != nil {
+		go mfs.canary.run(mfs.listenerDoneCh)
+	}
+
 	mfs.log.Println("Serving... Have fun!")
 	// Serve the filesystem
 	if err = fs.Serve(c, mfs); err != nil {
-		mfs.log.Println("Error while serving the file system.", err)
+		mfs.log.Errorln("Error while serving the file system.", err)
 		return err
 	}
 
 	<-c.Ready
 
-	fmt.Println("\nMount process complete, graceful shutdown")
+	mfs.log.Println("Mount process complete, graceful shutdown")
 	return c.MountError
 }
 
@@ -318,16 +490,182 @@ func (mfs *MinFS) sync(req interface{}) error {
 	return nil
 }
 
-func (mfs *MinFS) moveOp(req *MoveOperation) {
-	fmt.Println("moveOp() removed")
+// moveOp copies the source object to the target server side, then removes
+// the source. Both are on the same endpoint. Objects too large for a single
+// copy are copied by part.
+func (mfs *MinFS) moveOp(req *MoveOperation) error {
+	ctx := context.Background()
+
+	src, dst := strings.SplitN(req.Source, "/", 2), strings.SplitN(req.Target, "/", 2)
+	if len(src) != 2 || len(dst) != 2 {
+		return fmt.Errorf("%s or %s is not an object", req.Source, req.Target)
+	}
+
+	api, err := mfs.getBucketApi(ctx, req.UID, src[0])
+	if err != nil {
+		return err
+	}
+
+	srcOpts := mfs.copySrc(src[0], mfs.keyPath(src[1]))
+	srcOpts.MatchETag = req.SourceETag
+	dstOpts := mfs.copyDest(dst[0], mfs.keyPath(dst[1]))
+
+	object, err := api.StatObject(ctx, srcOpts.Bucket, srcOpts.Object, mfs.getOptions(srcOpts.Bucket))
+	if err != nil {
+		return err
+	}
+
+	var info minio.UploadInfo
+	if object.Size > maxCopySize {
+		info, err = api.ComposeObject(ctx, dstOpts, srcOpts)
+	} else {
+		info, err = api.CopyObject(ctx, dstOpts, srcOpts)
+	}
+	if err != nil {
+		return err
+	}
+	req.TargetETag = info.ETag
+
+	return api.RemoveObject(ctx, srcOpts.Bucket, srcOpts.Object, minio.RemoveObjectOptions{})
 }
 
 func (mfs *MinFS) copyOp(req *CopyOperation) {
-	fmt.Println("copyOp() removed")
+	mfs.log.Errorln("copyOp() removed")
+}
+
+// putOp uploads the source file to the target, the full path of the object.
+func (mfs *MinFS) putOp(req *PutOperation) error {
+	parts := strings.SplitN(req.Target, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%s is not an object", req.Target)
+	}
+
+	ctx := context.Background()
+
+	api, err := mfs.getBucketApi(ctx, req.UID, parts[0])
+	if err != nil {
+		return err
+	}
+
+	info, err := api.FPutObject(ctx, parts[0], mfs.keyPath(parts[1]), req.Source, mfs.putOptions(parts[0]))
+	if err != nil {
+		return err
+	}
+	req.ETag = info.ETag
+	return nil
 }
 
-func (mfs *MinFS) putOp(req *PutOperation) {
-	fmt.Println("putOp() removed")
+// appendOp appends the source file to the object. The existing object is
+// combined server side with the appended part when it is large enough to be
+// a multipart source, otherwise it is copied up and uploaded again.
+func (mfs *MinFS) appendOp(req *AppendOperation) error {
+	ctx := context.Background()
+
+	api, err := mfs.getBucketApi(ctx, req.UID, req.Bucket)
+	if err != nil {
+		return err
+	}
+
+	object, err := api.StatObject(ctx, req.Bucket, req.Object, mfs.getOptions(req.Bucket))
+	if err != nil {
+		return err
+	}
+
+	if object.Size >= minPartSize {
+		if err = mfs.composeAppend(ctx, api, req); err == nil {
+			return nil
+		}
+		mfs.log.Println("Compose of", req.Bucket+"/"+req.Object, "failed, copying up instead:", err)
+	}
+
+	return mfs.copyUpAppend(ctx, api, req)
+}
+
+// appendPartInfix names the part objects appends compose objects with, as
+// key.mskvfs-append-<suffix>.
+const appendPartInfix = ".mskvfs-append-"
+
+// isAppendPart returns if key is the part of an append in progress through
+// the mount, it isn't listed.
+func (mfs *MinFS) isAppendPart(bucket, key string) bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	return mfs.appendParts[path.Join(bucket, key)]
+}
+
+// removeAppendPart removes the part of an append once composed, retrying
+// transient failures. A part that can't be removed is listed again, and
+// logged to be removed by hand.
+func (mfs *MinFS) removeAppendPart(ctx context.Context, api *minio.Client, bucket, part string) {
+	err := mfs.retryTransient(ctx, func() error {
+		return api.RemoveObject(ctx, bucket, part, minio.RemoveObjectOptions{})
+	})
+	if err != nil {
+		mfs.log.Errorln("Unable to remove the append part", bucket+"/"+part, err)
+	}
+
+	mfs.m.Lock()
+	delete(mfs.appendParts, path.Join(bucket, part))
+	mfs.m.Unlock()
+}
+
+// composeAppend uploads the source as a part object and composes the
+// object with it, removing the part afterwards.
+func (mfs *MinFS) composeAppend(ctx context.Context, api *minio.Client, req *AppendOperation) error {
+	part := req.Object + appendPartInfix + nextSuffix()
+
+	mfs.m.Lock()
+	mfs.appendParts[path.Join(req.Bucket, part)] = true
+	mfs.m.Unlock()
+	defer mfs.removeAppendPart(ctx, api, req.Bucket, part)
+
+	if _, err := api.FPutObject(ctx, req.Bucket, part, req.Source, mfs.putOptions(req.Bucket)); err != nil {
+		return err
+	}
+
+	_, err := api.ComposeObject(ctx,
+		mfs.copyDest(req.Bucket, req.Object),
+		mfs.copySrc(req.Bucket, req.Object),
+		mfs.copySrc(req.Bucket, part),
+	)
+	return err
+}
+
+// copyUpAppend downloads the object, appends the source and uploads the result.
+func (mfs *MinFS) copyUpAppend(ctx context.Context, api *minio.Client, req *AppendOperation) error {
+	stagePath, err := mfs.NewCachePath()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stagePath)
+
+	if err = api.FGetObject(ctx, req.Bucket, req.Object, stagePath, mfs.getOptions(req.Bucket)); err != nil {
+		return err
+	}
+
+	src, err := os.Open(req.Source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(stagePath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err = dst.Close(); err != nil {
+		return err
+	}
+
+	_, err = api.FPutObject(ctx, req.Bucket, req.Object, stagePath, mfs.putOptions(req.Bucket))
+	return err
 }
 
 func (mfs *MinFS) startSync() error {
@@ -335,11 +673,13 @@ func (mfs *MinFS) startSync() error {
 		for req := range mfs.syncChan {
 			switch req := req.(type) {
 			case *MoveOperation:
-				mfs.moveOp(req)
+				req.Error <- mfs.moveOp(req)
 			case *CopyOperation:
 				mfs.copyOp(req)
 			case *PutOperation:
-				mfs.putOp(req)
+				req.Error <- mfs.putOp(req)
+			case *AppendOperation:
+				req.Error <- mfs.appendOp(req)
 			default:
 				panic("Unknown type")
 			}
@@ -348,13 +688,34 @@ func (mfs *MinFS) startSync() error {
 	return nil
 }
 
-// Statfs will return meta information on the minio filesystem
+// Statfs will return meta information on the minio filesystem. The mount
+// is as large as the cache quota, what is written is staged in the cache
+// before the upload, and as full as the cache files accounted. A file
+// takes up at least a block, so there are as many inodes as blocks.
 func (mfs *MinFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
-	resp.Blocks = 0x1000000000
-	resp.Bfree = 0x1000000000
-	resp.Bavail = 0x1000000000
+	quota, used, files := mfs.cacheUsage()
+
+	blocks := uint64(quota) / globalStatfsBlock
+	usedBlocks := (uint64(used) + globalStatfsBlock - 1) / globalStatfsBlock
+
+	var free uint64
+	if usedBlocks < blocks {
+		free = blocks - usedBlocks
+	}
+
+	var freeFiles uint64
+	if uint64(files) < blocks {
+		freeFiles = blocks - uint64(files)
+	}
+
+	resp.Blocks = blocks
+	resp.Bfree = free
+	resp.Bavail = free
+	resp.Files = blocks
+	resp.Ffree = freeFiles
 	resp.Namelen = 32768
-	resp.Bsize = 1024
+	resp.Bsize = globalStatfsBlock
+	resp.Frsize = globalStatfsBlock
 	return nil
 }
 
@@ -376,6 +737,14 @@ func (mfs *MinFS) Acquire(f *File, resourceKey string) (*FileHandle, error) {
 	return fh, nil
 }
 
+// openFiles returns the number of open file handles.
+func (mfs *MinFS) openFiles() int {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	return len(mfs.openfds)
+}
+
 // Release release the filehandle, removes from openfd map
 func (mfs *MinFS) Release(fh *FileHandle) error {
 
@@ -386,6 +755,96 @@ func (mfs *MinFS) Release(fh *FileHandle) error {
 	return nil
 }
 
+// addVirtualDir registers a directory made without a marker.
+func (mfs *MinFS) addVirtualDir(fullPath string) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	mfs.dirs[fullPath] = true
+}
+
+// removeVirtualDir drops a directory made without a marker, returns if it was one.
+func (mfs *MinFS) removeVirtualDir(fullPath string) bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	ok := mfs.dirs[fullPath]
+	delete(mfs.dirs, fullPath)
+	return ok
+}
+
+// virtualDirs returns the names of the directories in parent that aren't
+// backed by objects: directories made without a marker and unions.
+func (mfs *MinFS) virtualDirs(parent string) (names []string) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	for fullPath := range mfs.dirs {
+		if path.Dir(fullPath) == parent {
+			names = append(names, path.Base(fullPath))
+		}
+	}
+	for fullPath := range mfs.config.unions {
+		if path.Dir(fullPath) == parent && !mfs.dirs[fullPath] {
+			names = append(names, path.Base(fullPath))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dirAt returns the directory node at fullPath, a bucket and the key of a
+// directory below it, split on the delimiter.
+func (mfs *MinFS) dirAt(fullPath string) *Dir {
+	dir := &Dir{
+		mfs:  mfs,
+		Mode: os.ModeDir | mfs.config.dirMode,
+		UID:  mfs.config.uid,
+		GID:  mfs.config.gid,
+	}
+
+	parts := strings.SplitN(strings.Trim(fullPath, "/"), "/", 2)
+	if len(parts) == 2 {
+		parts = append(parts[:1], strings.Split(strings.TrimSuffix(parts[1], mfs.keyDelimiter()), mfs.keyDelimiter())...)
+	}
+
+	for i, name := range parts {
+		if i > 0 {
+			name = mfs.names.present(name)
+		}
+
+		dir = &Dir{
+			dir:  dir,
+			mfs:  mfs,
+			Path: name,
+			Mode: mfs.config.dirMode | os.ModeDir,
+			UID:  mfs.config.uid,
+			GID:  mfs.config.gid,
+		}
+	}
+	return dir
+}
+
+// beginDownload marks the cache path as being downloaded to, it can't be
+// evicted until endDownload.
+func (mfs *MinFS) beginDownload(cachePath string) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	mfs.downloads[filepath.Clean(cachePath)]++
+}
+
+// endDownload marks a download to the cache path as done.
+func (mfs *MinFS) endDownload(cachePath string) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	cachePath = filepath.Clean(cachePath)
+	if mfs.downloads[cachePath]--; mfs.downloads[cachePath] <= 0 {
+		delete(mfs.downloads, cachePath)
+	}
+}
+
 // NextSequence will return the next free iNode
 func (mfs *MinFS) NextSequence(tx *meta.Tx) (sequence uint64, err error) {
 	bucket := tx.Bucket("minio/")
@@ -394,14 +853,17 @@ func (mfs *MinFS) NextSequence(tx *meta.Tx) (sequence uint64, err error) {
 
 // Root is the root folder of the MinFS mountpoint
 func (mfs *MinFS) Root() (fs.Node, error) {
+	// A mount rooted at a bucket or prefix has it as the path of the root,
+	// so the paths below are the same as when mounted with every bucket.
 	return &Dir{
-		dir:  nil,
-		mfs:  mfs,
-		Path: "",
+		dir:   nil,
+		mfs:   mfs,
+		Path:  mfs.config.root,
+		Inode: rootInode,
 
 		UID:  mfs.config.uid,
 		GID:  mfs.config.gid,
-		Mode: os.ModeDir | 0750,
+		Mode: os.ModeDir | mfs.config.dirMode,
 	}, nil
 }
 
@@ -410,11 +872,61 @@ type Storer interface {
 	store(tx *meta.Tx)
 }
 
+// invalidate drops what is kept in memory about the node at fullPath, after
+// it changed on the mount.
+func (mfs *MinFS) invalidate(fullPath string) {
+	mfs.nodes.Invalidate(fullPath)
+	mfs.listings.Invalidate(fullPath)
+	mfs.buckets.Invalidate(fullPath)
+	mfs.snapshots.invalidate(fullPath)
+}
+
+// cacheDir returns the directory bucket is cached in.
+func (mfs *MinFS) cacheDir(bucket string) string {
+	if bc, ok := mfs.config.bucketCaches[bucket]; ok {
+		return bc.dir
+	}
+	return mfs.config.cache
+}
+
+// cacheQuota returns the quota of the directory bucket is cached in.
+func (mfs *MinFS) cacheQuota(bucket string) int64 {
+	if bc, ok := mfs.config.bucketCaches[bucket]; ok && bc.quota > 0 {
+		return bc.quota
+	}
+	return mfs.config.quota
+}
+
+// maxCacheFileSize returns the largest object of bucket that is cached, 0
+// is unlimited.
+func (mfs *MinFS) maxCacheFileSize(bucket string) int64 {
+	if bc, ok := mfs.config.bucketCaches[bucket]; ok {
+		return bc.maxFileSize
+	}
+	return mfs.config.maxCacheFileSize
+}
+
+// cachePath returns the cache path of the object version with etag.
+func (mfs *MinFS) cachePath(bucket, key, etag string) string {
+	cachePath := path.Join(mfs.cacheDir(bucket), mfs.cacheName(key, etag))
+
+	// Cache names don't hold the bucket, it's remembered to account the
+	// buckets with a quota of their own.
+	if _, ok := mfs.config.bucketQuotas[bucket]; ok {
+		mfs.m.Lock()
+		for _, p := range versionPaths(cachePath) {
+			mfs.cacheBuckets[p] = bucket
+		}
+		mfs.m.Unlock()
+	}
+	return cachePath
+}
+
 // NewCachePath -
 func (mfs *MinFS) NewCachePath() (string, error) {
 	cachePath := path.Join(mfs.config.cache, nextSuffix())
 	for {
-		if _, err := os.Stat(cachePath); err == nil {
+		if _, err := mfs.statLocal(cachePath); err == nil {
 		} else if os.IsNotExist(err) {
 			return cachePath, nil
 		} else {
@@ -15,12 +15,104 @@
 
 package minfs
 
+import (
+	"os"
+	"time"
+)
+
 // Package cmd contains all the global variables and constants.
 
 // TODO: make this configurable
 // TODO: use existing file caching
 const (
 	globalDBDir   = "/tmp/db"
-	globalQuota   = 60
+	globalQuota   = 60 << 30
 	globalLogFile = "/var/log/minfs.log"
+
+	// globalMinQuota is the smallest cache quota, holding a few files.
+	globalMinQuota = 64 << 20
+
+	// globalStatfsBlock is the block size Statfs reports the cache in.
+	globalStatfsBlock = 4096
+
+	globalFileMode os.FileMode = 0444
+	globalDirMode  os.FileMode = 0755
+
+	globalLocalRetries = 3
+
+	globalRetries         = 3
+	globalRetryBackoff    = 200 * time.Millisecond
+	globalMaxRetryBackoff = 10 * globalRetryBackoff
+
+	// requests given up on fail without being sent for this long, while
+	// minio-go sends them again
+	globalFailedRequestTTL = time.Minute
+
+	globalNodeCacheSize = 10000
+	globalNodeCacheTTL  = 5 * time.Second
+
+	// paths the inodes are kept of, about 200 MiB of paths
+	globalInodeTableSize = 1 << 20
+
+	globalListingCacheTTL     = 5 * time.Second
+	globalListingCacheEntries = 100000
+	globalBucketListTTL       = 5 * time.Minute
+
+	globalStatCacheTTL = 5 * time.Second
+	globalTagCacheTTL  = time.Minute
+
+	globalOpTimeout       = time.Minute
+	globalDownloadTimeout = time.Hour
+	globalSlowDownload    = 30 * time.Second
+
+	// presigned urls expire after globalPresignExpiry, S3 signs them for
+	// at most globalMaxPresignExpiry
+	globalPresignExpiry    = time.Hour
+	globalMaxPresignExpiry = 7 * 24 * time.Hour
+
+	// requests between cache peers are refused once signed longer ago
+	globalPeerSkew = 5 * time.Minute
+
+	globalCacheReconcile = time.Hour
+
+	globalCacheHighWatermark = 1.0
+	globalCacheLowWatermark  = 0.8
+
+	globalMaxConnsPerHost = 256
+	globalMaxIdleConns    = 256
+
+	// globalShutdownTimeout bounds the wait for operations on a signal.
+	globalShutdownTimeout = 30 * time.Second
+)
+
+const (
+	// globalCacheExt is the extension of objects cached whole.
+	globalCacheExt = ".fcache"
+
+	// globalRangeCacheExt is the extension of the sparse files of objects
+	// read by range.
+	globalRangeCacheExt = ".rcache"
+
+	// globalBlockCacheExt is the extension of objects cached whole in
+	// blocks compressed or sealed, see blockFile.
+	globalBlockCacheExt = ".zcache"
+)
+
+const (
+	// minPartSize is the smallest object S3 accepts as a source for any
+	// but the last part of a multipart compose.
+	minPartSize = 5 * 1024 * 1024
+
+	// maxCopySize is the largest object S3 copies in a single request.
+	maxCopySize = 5 * 1024 * 1024 * 1024
+
+	// globalRangeChunk is the unit range reads are fetched in.
+	globalRangeChunk int64 = 1024 * 1024
+
+	// globalDownloadChunk is the unit parallel downloads are fetched in.
+	globalDownloadChunk int64 = 64 * 1024 * 1024
+
+	// globalDownloadThreshold is the smallest object downloaded in parallel
+	// by default.
+	globalDownloadThreshold int64 = 256 * 1024 * 1024
 )
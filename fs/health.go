@@ -0,0 +1,79 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// healthStatus is the json served by the health endpoints.
+type healthStatus struct {
+	Mounted bool          `json:"mounted"`
+	Ready   bool          `json:"ready"`
+	Canary  *canaryStatus `json:"canary,omitempty"`
+}
+
+// health returns the current health of the mount, it is ready once mounted
+// and while the canary, if any, succeeds.
+func (mfs *MinFS) health() healthStatus {
+	status := healthStatus{
+		Mounted: atomic.LoadInt32(&mfs.mounted) == 1,
+	}
+	status.Ready = status.Mounted
+
+	if mfs.canary != nil {
+		canary := mfs.canary.status()
+		status.Canary = &canary
+		status.Ready = status.Ready && canary.OK
+	}
+
+	return status
+}
+
+// serveHealth serves the liveness probe at /healthz and the readiness
+// probe at /readyz, which fails while the mount isn't ready.
+func (mfs *MinFS) serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, mfs.health(), true)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := mfs.health()
+		writeHealth(w, status, status.Ready)
+	})
+
+	mfs.listenHTTP(addr, mux)
+}
+
+func writeHealth(w http.ResponseWriter, status healthStatus, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// listenHTTP serves handler at addr in the background, logging when it fails.
+func (mfs *MinFS) listenHTTP(addr string, handler http.Handler) {
+	go func() {
+		mfs.log.Println("Listening on", addr)
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			mfs.log.Errorln("Error while listening on", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+)
+
+// rootInode is the inode of the mount root.
+const rootInode = 1
+
+// inodeTable hands out inodes by full path. The inode of a path is the 64 bit
+// FNV-1a hash of the path, so a path has the same inode on every scan and
+// across remounts. Hashes collide with a chance of about n²/2⁶⁵ for n paths,
+// a path whose hash is taken by another path seen before takes the next free
+// inode instead, so two paths never share one. The table holds the size
+// paths used last, a path dropped gets its hash again when seen next, the
+// same inode unless it collided.
+type inodeTable struct {
+	mu sync.Mutex
+
+	size int
+
+	// paths by last use, the root isn't in it and is never dropped
+	ll *list.List
+
+	byPath  map[string]*list.Element
+	byInode map[uint64]string
+
+	rootPath string
+}
+
+type inodeEntry struct {
+	path  string
+	inode uint64
+}
+
+// newInodeTable returns the table of a mount whose root is at rootPath,
+// holding size paths besides the root.
+func newInodeTable(rootPath string, size int) *inodeTable {
+	return &inodeTable{
+		size:     size,
+		ll:       list.New(),
+		byPath:   map[string]*list.Element{},
+		byInode:  map[uint64]string{rootInode: rootPath},
+		rootPath: rootPath,
+	}
+}
+
+// inode returns the inode of fullPath.
+func (t *inodeTable) inode(fullPath string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if fullPath == t.rootPath {
+		return rootInode
+	}
+
+	if e, ok := t.byPath[fullPath]; ok {
+		t.ll.MoveToFront(e)
+		return e.Value.(*inodeEntry).inode
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(fullPath))
+
+	// 0 isn't an inode, and the root has its own.
+	inode := h.Sum64()
+	for {
+		if _, taken := t.byInode[inode]; !taken && inode > rootInode {
+			break
+		}
+		inode++
+	}
+
+	t.byPath[fullPath] = t.ll.PushFront(&inodeEntry{fullPath, inode})
+	t.byInode[inode] = fullPath
+
+	if t.ll.Len() > t.size {
+		entry := t.ll.Remove(t.ll.Back()).(*inodeEntry)
+		delete(t.byPath, entry.path)
+		delete(t.byInode, entry.inode)
+	}
+	return inode
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"testing"
+)
+
+func TestInodeTableBounded(t *testing.T) {
+	const size = 1000
+	table := newInodeTable("", size)
+
+	first := table.inode("bucket/first")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 10*size; i++ {
+				table.inode(fmt.Sprintf("bucket/%d/%d", g, i))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if n := len(table.byPath); n != size {
+		t.Fatalf("table holds %d paths, expected %d", n, size)
+	}
+	if n := len(table.byInode); n != size+1 {
+		t.Fatalf("table holds %d inodes, expected %d with the root", n, size+1)
+	}
+	if inode := table.inode(""); inode != rootInode {
+		t.Fatalf("root has inode %d after the table was full", inode)
+	}
+
+	// Dropped, a path gets the inode it had again.
+	if inode := table.inode("bucket/first"); inode != first {
+		t.Fatalf("inode %d of a dropped path, had %d", inode, first)
+	}
+}
+
+func TestInodeTableKeepsUsed(t *testing.T) {
+	table := newInodeTable("", 2)
+
+	a := table.inode("a")
+	table.inode("b")
+	table.inode("a")
+	table.inode("c")
+
+	if _, ok := table.byPath["a"]; !ok {
+		t.Fatal("path used last dropped")
+	}
+	if _, ok := table.byPath["b"]; ok {
+		t.Fatal("path used least kept")
+	}
+	if inode := table.inode("a"); inode != a {
+		t.Fatalf("inode of a changed from %d to %d", a, inode)
+	}
+}
+
+func TestInodesDistinct(t *testing.T) {
+	const n = 1 << 20
+	if testing.Short() {
+		t.Skip("assigns a million inodes")
+	}
+	table := newInodeTable("", n)
+
+	seen := make(map[uint64]string, n)
+	for i := 0; i < n; i++ {
+		fullPath := fmt.Sprintf("bucket/%d/%d/object-%d", i%97, i%1013, i)
+		inode := table.inode(fullPath)
+		if inode <= rootInode {
+			t.Fatalf("%s has inode %d", fullPath, inode)
+		}
+		if other, ok := seen[inode]; ok {
+			t.Fatalf("%s and %s share inode %d", fullPath, other, inode)
+		}
+		seen[inode] = fullPath
+	}
+}
+
+func TestInodeCollisionTakesNextFree(t *testing.T) {
+	table := newInodeTable("", 10)
+
+	h := fnv.New64a()
+	h.Write([]byte("bucket/b"))
+	hash := h.Sum64()
+
+	// Another path holds the hash, the next inode is taken too.
+	table.byInode[hash] = "bucket/a"
+	table.byInode[hash+1] = "bucket/c"
+
+	if inode := table.inode("bucket/b"); inode != hash+2 {
+		t.Fatalf("colliding path has inode %d, expected the next free %d", inode, hash+2)
+	}
+	if inode := table.inode("bucket/b"); inode != hash+2 {
+		t.Fatalf("colliding path has inode %d on its second lookup, had %d", inode, hash+2)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// versionPaths returns the cache files of the version cached at cachePath,
+// whole, sparse or in blocks.
+func versionPaths(cachePath string) []string {
+	return []string{
+		filepath.Clean(cachePath),
+		filepath.Clean(rangeCachePath(cachePath)),
+		filepath.Clean(blockCachePath(cachePath)),
+	}
+}
+
+// cacheVersions returns the cache files of the versions of key cached for
+// bucket, whole or sparse. With hashed names only the version the mount
+// opened last is known, versions cached before a restart are left to be
+// evicted as any unused file.
+func (mfs *MinFS) cacheVersions(bucket, key string) []string {
+	var paths []string
+
+	mfs.m.Lock()
+	if last, ok := mfs.versions[path.Join(bucket, key)]; ok {
+		paths = append(paths, last, rangeCachePath(last), blockCachePath(last))
+	}
+	mfs.m.Unlock()
+
+	dir, prefix, ok := mfs.cacheNamePrefix(key)
+	if !ok {
+		return paths
+	}
+
+	dir = path.Join(mfs.cacheDir(bucket), dir)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return paths
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		// Keys are escaped, no other key has names with the prefix.
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !isCacheFile(name) {
+			continue
+		}
+		paths = append(paths, path.Join(dir, name))
+	}
+	return paths
+}
+
+// stagedCachePaths returns the cache files of the objects open for writing,
+// they hold data not uploaded yet.
+func (mfs *MinFS) stagedCachePaths() map[string]bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	staged := map[string]bool{}
+	for _, ws := range mfs.writers {
+		staged[filepath.Clean(ws.cachePath)] = true
+	}
+	return staged
+}
+
+// dropStaleVersions purges the cache files of the versions of key other
+// than the one cached at cachePath, when the object changed since the
+// mount last opened it. Stale versions in use are evicted once unused.
+func (mfs *MinFS) dropStaleVersions(bucket, key, cachePath string) {
+	mfs.m.Lock()
+	last, ok := mfs.versions[path.Join(bucket, key)]
+	mfs.versions[path.Join(bucket, key)] = cachePath
+	if ok && last != cachePath {
+		mfs.movePin(last, cachePath)
+	}
+	mfs.m.Unlock()
+
+	if ok && last == cachePath {
+		return
+	}
+
+	keep := mfs.stagedCachePaths()
+	keep[filepath.Clean(cachePath)] = true
+	keep[filepath.Clean(rangeCachePath(cachePath))] = true
+	keep[filepath.Clean(blockCachePath(cachePath))] = true
+
+	for _, p := range mfs.cacheVersions(bucket, key) {
+		if !keep[filepath.Clean(p)] {
+			mfs.purgeCache(p)
+		}
+	}
+}
+
+// Invalidate drops every cached version of the file at fullPath, the
+// bucket followed by the path of the file, and what is known about it in
+// memory. The next open fetches the object again. Versions in use are
+// evicted once unused, a file written and not uploaded yet is kept.
+func (mfs *MinFS) Invalidate(fullPath string) {
+	fullPath = strings.Trim(fullPath, "/")
+	i := strings.IndexByte(fullPath, '/')
+	if i < 0 {
+		return
+	}
+	bucket, key := fullPath[:i], mfs.keyPath(fullPath[i+1:])
+
+	mfs.dropObject(bucket, key)
+	mfs.invalidate(fullPath)
+}
+
+// dropObject purges every cached version of the object key of bucket but
+// a file written and not uploaded yet, and forgets the version opened last.
+func (mfs *MinFS) dropObject(bucket, key string) {
+	staged := mfs.stagedCachePaths()
+	for _, p := range mfs.cacheVersions(bucket, key) {
+		if !staged[filepath.Clean(p)] {
+			mfs.purgeCache(p)
+		}
+	}
+
+	mfs.m.Lock()
+	delete(mfs.versions, path.Join(bucket, key))
+	mfs.m.Unlock()
+}
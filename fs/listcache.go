@@ -0,0 +1,117 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type listingEntry struct {
+	fsElements []FilesystemElement
+	listed     time.Time
+}
+
+// listingCache keeps the listings of directories for a short while, per
+// uid since visibility depends on the credentials, so lookups of names
+// that aren't in a directory just listed don't list it again. A nil
+// listingCache caches nothing.
+type listingCache struct {
+	mu sync.Mutex
+
+	ttl      time.Duration
+	listings map[nodeKey]listingEntry
+}
+
+func newListingCache(ttl time.Duration) *listingCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &listingCache{
+		ttl:      ttl,
+		listings: map[nodeKey]listingEntry{},
+	}
+}
+
+// Get returns the listing of the directory at path for uid, if it was
+// listed within the ttl.
+func (c *listingCache) Get(uid uint32, path string) ([]FilesystemElement, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := nodeKey{uid, path}
+	entry, ok := c.listings[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Since(entry.listed) > c.ttl {
+		delete(c.listings, key)
+		return nil, false
+	}
+	return entry.fsElements, true
+}
+
+// Add stores the complete listing of the directory at path for uid.
+// Listings that expired are dropped meanwhile, so the cache only holds
+// the directories listed within the ttl. Listings of more than
+// globalListingCacheEntries entries aren't kept, names in such
+// directories are looked up one by one.
+func (c *listingCache) Add(uid uint32, path string, fsElements []FilesystemElement) {
+	if c == nil || len(fsElements) > globalListingCacheEntries {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.listings {
+		if time.Since(entry.listed) > c.ttl {
+			delete(c.listings, key)
+		}
+	}
+
+	c.listings[nodeKey{uid, path}] = listingEntry{fsElements, time.Now()}
+}
+
+// Invalidate drops the listings holding fullPath: its parent's, its own
+// and those below it, for every uid.
+func (c *listingCache) Invalidate(fullPath string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	parent := path.Dir(fullPath)
+	if parent == "." {
+		parent = ""
+	}
+
+	for key := range c.listings {
+		if key.path == parent || key.path == fullPath || strings.HasPrefix(key.path, fullPath+"/") {
+			delete(c.listings, key)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// isTransientLocal returns if a local filesystem error is expected to
+// clear up by itself, such as running out of file descriptors for a moment.
+func isTransientLocal(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		isOutOfFiles(err)
+}
+
+// isOutOfFiles returns if a local filesystem error is running out of file
+// descriptors.
+func isOutOfFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// retryLocal runs fn, retrying a bounded number of times with a short
+// backoff on transient local errors. Any other error is returned right away.
+// Out of file descriptors, the idle connections to the servers are closed
+// before retrying, to free theirs.
+func (mfs *MinFS) retryLocal(fn func() error) error {
+	backoff := 10 * time.Millisecond
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || !isTransientLocal(err) || i >= mfs.config.localRetries {
+			return err
+		}
+
+		mfs.log.Println("Transient cache error, retrying:", err)
+		if isOutOfFiles(err) && mfs.transport != nil {
+			mfs.transport.CloseIdleConnections()
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// statLocal is os.Stat with retries on transient errors.
+func (mfs *MinFS) statLocal(path string) (fi os.FileInfo, err error) {
+	err = mfs.retryLocal(func() error {
+		fi, err = os.Stat(path)
+		return err
+	})
+	return fi, err
+}
+
+// openLocal is os.OpenFile with retries on transient errors.
+func (mfs *MinFS) openLocal(path string, flag int, perm os.FileMode) (f *os.File, err error) {
+	err = mfs.retryLocal(func() error {
+		f, err = os.OpenFile(path, flag, perm)
+		return err
+	})
+	return f, err
+}
+
+// syncLocal flushes the file at path to disk, with retries on transient
+// errors.
+func (mfs *MinFS) syncLocal(path string) error {
+	return mfs.retryLocal(func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return f.Sync()
+	})
+}
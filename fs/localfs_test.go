@@ -0,0 +1,84 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// reusedConn returns if a request over the transport of mfs reused an idle
+// connection.
+func reusedConn(t *testing.T, mfs *MinFS, url string) (reused bool) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}))
+
+	resp, err := mfs.transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return reused
+}
+
+func TestOutOfFilesClosesIdleConns(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	mfs := newTestFS(t, s3, LocalRetries(1))
+
+	reusedConn(t, mfs, s3.URL+"/bucket")
+	if !reusedConn(t, mfs, s3.URL+"/bucket") {
+		t.Fatal("idle connection not reused")
+	}
+
+	failed := false
+	err := mfs.retryLocal(func() error {
+		if !failed {
+			failed = true
+			return &os.PathError{Op: "open", Path: "cache", Err: syscall.EMFILE}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reusedConn(t, mfs, s3.URL+"/bucket") {
+		t.Fatal("idle connection kept out of file descriptors")
+	}
+}
+
+func TestPermanentLocalErrorNotRetried(t *testing.T) {
+	mfs := newTestFS(t, newFakeS3(t, "bucket"), LocalRetries(3))
+
+	calls := 0
+	err := mfs.retryLocal(func() error {
+		calls++
+		return &os.PathError{Op: "open", Path: "cache", Err: syscall.EACCES}
+	})
+	if !os.IsPermission(err) || calls != 1 {
+		t.Fatalf("%d calls failing with %v, expected a single EACCES", calls, err)
+	}
+}
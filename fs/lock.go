@@ -48,6 +48,12 @@ func (mfs *MinFS) IsLocked(path string) bool {
 	return ok
 }
 
+// lockObject - acquires the writer lock of the object at path, returns the
+// function releasing it.
+func (mfs *MinFS) lockObject(path string) func() {
+	return mfs.km.Lock("object:" + path)
+}
+
 // wait for the file lock to be unlocked
 func (mfs *MinFS) wait(path string) error {
 	// check if the file is locked, and wait for max 5 seconds for the file to be
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"fmt"
+	"io"
+	"log"
+)
+
+// logger is the log of the mount. Println logs as info, Warnln marks what
+// is degraded, Errorln failures, Debugln and Debugf log only with debug on.
+type logger struct {
+	*log.Logger
+
+	debug bool
+}
+
+func newLogger(w io.Writer, debug bool) *logger {
+	return &logger{
+		Logger: log.New(w, "MinFS ", log.Ldate|log.Ltime|log.Lshortfile),
+		debug:  debug,
+	}
+}
+
+// Errorln logs a failure.
+func (l *logger) Errorln(v ...interface{}) {
+	l.Output(2, "ERROR "+fmt.Sprintln(v...))
+}
+
+// Warnln logs what works, but not as it should.
+func (l *logger) Warnln(v ...interface{}) {
+	l.Output(2, "WARN "+fmt.Sprintln(v...))
+}
+
+// Debugln logs with debug on.
+func (l *logger) Debugln(v ...interface{}) {
+	if l.debug {
+		l.Output(2, "DEBUG "+fmt.Sprintln(v...))
+	}
+}
+
+// Debugf logs with debug on.
+func (l *logger) Debugf(format string, v ...interface{}) {
+	if l.debug {
+		l.Output(2, "DEBUG "+fmt.Sprintf(format, v...))
+	}
+}
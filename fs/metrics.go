@@ -0,0 +1,111 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// metrics records what the mount does, for monitoring. It is only
+// collected when served, noMetrics records nothing otherwise.
+type metrics interface {
+	// cacheHit records an open served from a cache file, cacheMiss one
+	// fetching the object.
+	cacheHit()
+	cacheMiss()
+
+	// downloaded records the bytes of an object downloaded to the cache
+	// from the servers, and how long it took.
+	downloaded(bytes int64, d time.Duration)
+
+	// evicted records a cache file of bytes removed to stay in the quota.
+	evicted(bytes int64)
+
+	// cacheSize records the size and files of the cache directory dir.
+	cacheSize(dir string, bytes int64, files int)
+
+	// openFiles records the number of open file handles.
+	openFiles(n int)
+
+	// request records how long an S3 request took, and its status code or
+	// 0 when it failed without a response.
+	request(op string, code int, d time.Duration)
+}
+
+// noMetrics is the metrics of a mount not serving them.
+type noMetrics struct{}
+
+func (noMetrics) cacheHit()                          {}
+func (noMetrics) cacheMiss()                         {}
+func (noMetrics) downloaded(int64, time.Duration)    {}
+func (noMetrics) evicted(int64)                      {}
+func (noMetrics) cacheSize(string, int64, int)       {}
+func (noMetrics) openFiles(int)                      {}
+func (noMetrics) request(string, int, time.Duration) {}
+
+// metricsTransport records the latency of every request, retries included.
+type metricsTransport struct {
+	http.RoundTripper
+
+	metrics metrics
+}
+
+// RoundTrip sends the request and records how long it took.
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+
+	code := 0
+	if err == nil {
+		code = resp.StatusCode
+	}
+	t.metrics.request(s3Operation(req), code, time.Since(start))
+	return resp, err
+}
+
+// s3Operation names the S3 operation of a request, by its method and
+// query.
+func s3Operation(req *http.Request) string {
+	query := req.URL.Query()
+	switch req.Method {
+	case http.MethodHead:
+		return "stat"
+	case http.MethodGet:
+		if _, ok := query["list-type"]; ok || req.URL.Path == "/" || query.Get("delimiter") != "" {
+			return "list"
+		} else if _, ok := query["location"]; ok {
+			return "location"
+		}
+		return "get"
+	case http.MethodPut:
+		if query.Get("partNumber") != "" {
+			return "put_part"
+		} else if req.Header.Get("X-Amz-Copy-Source") != "" {
+			return "copy"
+		}
+		return "put"
+	case http.MethodPost:
+		if _, ok := query["delete"]; ok {
+			return "delete"
+		}
+		return "multipart"
+	case http.MethodDelete:
+		return "delete"
+	}
+	return strings.ToLower(req.Method)
+}
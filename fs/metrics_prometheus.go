@@ -0,0 +1,176 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !nometrics
+// +build !nometrics
+
+package minfs
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// promMetrics collects the metrics in a registry of their own, so only the
+// metrics of the mount are served.
+type promMetrics struct {
+	registry *prometheus.Registry
+
+	hits, misses            prometheus.Counter
+	downloadedBytes         prometheus.Counter
+	evictions, evictedBytes prometheus.Counter
+	size, files             *prometheus.GaugeVec
+	open                    prometheus.Gauge
+	requests                *prometheus.HistogramVec
+
+	// latency and throughput of downloads from the servers to the cache
+	downloads, throughput prometheus.Histogram
+}
+
+// newMetrics returns the metrics of mfs, served by serveMetrics.
+func newMetrics(mfs *MinFS) metrics {
+	m := &promMetrics{
+		registry: prometheus.NewRegistry(),
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minfs_cache_hits_total",
+			Help: "Opens served from a cache file.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minfs_cache_misses_total",
+			Help: "Opens fetching the object to the cache.",
+		}),
+		downloadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minfs_cache_downloaded_bytes_total",
+			Help: "Bytes of objects downloaded from the servers to the cache.",
+		}),
+		evictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minfs_cache_evictions_total",
+			Help: "Cache files evicted to stay in the quota.",
+		}),
+		evictedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minfs_cache_evicted_bytes_total",
+			Help: "Bytes of the cache files evicted to stay in the quota.",
+		}),
+		size: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "minfs_cache_size_bytes",
+			Help: "Size of the cache directory, as of the last check.",
+		}, []string{"dir"}),
+		files: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "minfs_cache_files",
+			Help: "Files in the cache directory, as of the last check.",
+		}, []string{"dir"}),
+		open: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "minfs_open_files",
+			Help: "Open file handles, as of the last check.",
+		}),
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "minfs_s3_request_duration_seconds",
+			Help:    "Latency of the S3 requests, retries included.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, []string{"op", "code"}),
+		downloads: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "minfs_cache_download_duration_seconds",
+			Help:    "Duration of the downloads of objects from the servers to the cache.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+		}),
+		throughput: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "minfs_cache_download_throughput_bytes_per_second",
+			Help:    "Throughput of the downloads of objects from the servers to the cache.",
+			Buckets: prometheus.ExponentialBuckets(64*1024, 2, 16),
+		}),
+	}
+
+	m.registry.MustRegister(m.hits, m.misses, m.downloadedBytes, m.evictions, m.evictedBytes, m.size, m.files, m.open, m.requests, m.downloads, m.throughput)
+
+	m.registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "minfs_s3_retries_total",
+			Help: "Failed requests retried.",
+		}, func() float64 {
+			retried, _ := mfs.retries.Stats()
+			return float64(retried)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "minfs_s3_retries_refused_total",
+			Help: "Failed requests not retried as the retry budget was spent.",
+		}, func() float64 {
+			_, shed := mfs.retries.Stats()
+			return float64(shed)
+		}),
+	)
+
+	if mfs.limiter != nil {
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "minfs_s3_request_rate",
+			Help: "Requests per second let through by the rate limit recently.",
+		}, mfs.limiter.Rate))
+	}
+
+	if mfs.canary != nil {
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "minfs_canary_ok",
+			Help: "1 if the last canary read succeeded.",
+		}, func() float64 {
+			if mfs.canary.status().OK {
+				return 1
+			}
+			return 0
+		}))
+	}
+
+	return m
+}
+
+func (m *promMetrics) cacheHit()       { m.hits.Inc() }
+func (m *promMetrics) cacheMiss()      { m.misses.Inc() }
+func (m *promMetrics) openFiles(n int) { m.open.Set(float64(n)) }
+
+func (m *promMetrics) downloaded(bytes int64, d time.Duration) {
+	m.downloadedBytes.Add(float64(bytes))
+	m.downloads.Observe(d.Seconds())
+	if d > 0 {
+		m.throughput.Observe(float64(bytes) / d.Seconds())
+	}
+}
+
+func (m *promMetrics) evicted(bytes int64) {
+	m.evictions.Inc()
+	m.evictedBytes.Add(float64(bytes))
+}
+
+func (m *promMetrics) cacheSize(dir string, bytes int64, files int) {
+	m.size.WithLabelValues(dir).Set(float64(bytes))
+	m.files.WithLabelValues(dir).Set(float64(files))
+}
+
+func (m *promMetrics) request(op string, code int, d time.Duration) {
+	m.requests.WithLabelValues(op, strconv.Itoa(code)).Observe(d.Seconds())
+}
+
+// serveMetrics serves the metrics at /metrics on addr.
+func (mfs *MinFS) serveMetrics(addr string) {
+	m, ok := mfs.metrics.(*promMetrics)
+	if !ok {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	mfs.listenHTTP(addr, mux)
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nameMapper translates between the names of key segments and the names
+// presented on the mount. Bucket names are presented as is.
+type nameMapper interface {
+	// present returns the name a key segment is presented as.
+	present(segment string) string
+
+	// segment returns the key segment a presented name stands for.
+	segment(name string) string
+}
+
+// keyNames presents key segments as they are.
+type keyNames struct{}
+
+func (keyNames) present(segment string) string { return segment }
+func (keyNames) segment(name string) string    { return name }
+
+// windowsNames presents key segments that are illegal on Windows with the
+// offending characters percent encoded, reversibly:
+//
+//   - % itself, the characters <>:"\|?* and control characters anywhere
+//   - the slashes of keys presented as one name, in a flat listing
+//   - the last character of a reserved device name, such as con or lpt1.txt
+//   - trailing dots and spaces
+//
+// So `con` is presented as `co%6E`, `a?` as `a%3F` and `100%` as `100%25`.
+type windowsNames struct{}
+
+// windowsReserved are the device names Windows reserves, with or without
+// an extension.
+var windowsReserved = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+func percentEncode(c byte) string {
+	return fmt.Sprintf("%%%02X", c)
+}
+
+func (windowsNames) present(segment string) string {
+	var b strings.Builder
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+		if c < 0x20 || strings.IndexByte(`%<>:"\|?*/`, c) >= 0 {
+			b.WriteString(percentEncode(c))
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	name := b.String()
+
+	// Trailing dots and spaces are dropped by Windows.
+	trailing := ""
+	for len(name) > 0 && (name[len(name)-1] == '.' || name[len(name)-1] == ' ') {
+		trailing = percentEncode(name[len(name)-1]) + trailing
+		name = name[:len(name)-1]
+	}
+
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if windowsReserved[strings.ToLower(base)] {
+		name = base[:len(base)-1] + percentEncode(base[len(base)-1]) + name[len(base):]
+	}
+
+	return name + trailing
+}
+
+func (windowsNames) segment(name string) string { return percentDecode(name) }
+
+// flatNames presents whole keys as one name, for a flat listing, with the
+// slashes and % percent encoded. So `a/b` is presented as `a%2Fb`. Keys
+// split on another delimiter than / are presented with it too, as their
+// segments may hold slashes.
+type flatNames struct{}
+
+func (flatNames) present(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; c == '%' || c == '/' {
+			b.WriteString(percentEncode(c))
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (flatNames) segment(name string) string { return percentDecode(name) }
+
+// percentDecode returns name with the percent encoded characters decoded.
+func percentDecode(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && i+2 < len(name) {
+			if c, err := strconv.ParseUint(name[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// keyDelimiter returns the delimiter keys are split into directories on,
+// / for a flat listing, whose keys are only split below the root.
+func (mfs *MinFS) keyDelimiter() string {
+	if mfs.flatListing() {
+		return "/"
+	}
+	return mfs.config.delimiter
+}
+
+// keyPath returns the key of the presented path p below a bucket.
+func (mfs *MinFS) keyPath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, name := range segments {
+		segments[i] = mfs.names.segment(name)
+	}
+	return strings.Join(segments, mfs.keyDelimiter())
+}
+
+// presentKey returns the path below a bucket key is presented at.
+func (mfs *MinFS) presentKey(key string) string {
+	if mfs.flatListing() {
+		// Below the prefix of the root the key is one name.
+		root := strings.SplitN(mfs.config.root, "/", 2)
+		if len(root) == 2 && strings.HasPrefix(key, root[1]+"/") {
+			return root[1] + "/" + mfs.names.present(key[len(root[1])+1:])
+		}
+		return mfs.names.present(key)
+	}
+
+	segments := strings.Split(key, mfs.keyDelimiter())
+	for i, segment := range segments {
+		segments[i] = mfs.names.present(segment)
+	}
+	return strings.Join(segments, "/")
+}
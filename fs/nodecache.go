@@ -0,0 +1,204 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeKey identifies a node as seen by a uid, since visibility depends
+// on the credentials.
+type nodeKey struct {
+	uid  uint32
+	path string
+}
+
+type nodeEntry struct {
+	key   nodeKey
+	node  FilesystemElement
+	added time.Time
+}
+
+// nodeCache keeps the most recently resolved nodes for a short while, so
+// lookups of nodes just listed don't need another scan. It sits above the
+// meta cache, a nil nodeCache caches nothing.
+type nodeCache struct {
+	mu sync.Mutex
+
+	size int
+	ttl  time.Duration
+
+	ll    *list.List
+	items map[nodeKey]*list.Element
+
+	// the nodes of each path for every uid, and the number of nodes below
+	// each directory, so invalidating a path doesn't walk the whole cache
+	byPath map[string]map[uint32]*list.Element
+	below  map[string]int
+
+	// when each path was last resolved, for any uid
+	resolved map[string]time.Time
+}
+
+func newNodeCache(size int, ttl time.Duration) *nodeCache {
+	if size <= 0 {
+		return nil
+	}
+
+	return &nodeCache{
+		size:     size,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    map[nodeKey]*list.Element{},
+		byPath:   map[string]map[uint32]*list.Element{},
+		below:    map[string]int{},
+		resolved: map[string]time.Time{},
+	}
+}
+
+// Get returns the node at path for uid, if it was resolved recently.
+func (c *nodeCache) Get(uid uint32, path string) (FilesystemElement, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[nodeKey{uid, path}]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*nodeEntry)
+	if time.Since(entry.added) > c.ttl {
+		c.remove(e)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(e)
+	return entry.node, true
+}
+
+// Add stores the node at path for uid, evicting the least recently used
+// node when full.
+func (c *nodeCache) Add(uid uint32, path string, node FilesystemElement) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.resolved[path] = time.Now()
+
+	key := nodeKey{uid, path}
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value = &nodeEntry{key, node, time.Now()}
+		return
+	}
+
+	e := c.ll.PushFront(&nodeEntry{key, node, time.Now()})
+	c.items[key] = e
+	if c.byPath[path] == nil {
+		c.byPath[path] = map[uint32]*list.Element{}
+	}
+	c.byPath[path][uid] = e
+	for dir := parentPath(path); dir != ""; dir = parentPath(dir) {
+		c.below[dir]++
+	}
+
+	if c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Invalidate drops the node at path and everything below it, for every uid.
+func (c *nodeCache) Invalidate(path string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.byPath[path] {
+		c.remove(e)
+	}
+
+	if c.below[path] == 0 {
+		return
+	}
+	for key, e := range c.items {
+		if strings.HasPrefix(key.path, path+"/") {
+			c.remove(e)
+		}
+	}
+}
+
+// Valid returns how long the attributes of the node at path stay fresh, the
+// rest of its ttl when it was resolved recently and 0 otherwise. A node
+// that changed was invalidated, so it is 0 until resolved again.
+func (c *nodeCache) Valid(path string) time.Duration {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resolved, ok := c.resolved[path]
+	if !ok {
+		return 0
+	}
+
+	valid := c.ttl - time.Since(resolved)
+	if valid <= 0 {
+		delete(c.resolved, path)
+		return 0
+	}
+	return valid
+}
+
+func (c *nodeCache) remove(e *list.Element) {
+	c.ll.Remove(e)
+
+	key := e.Value.(*nodeEntry).key
+	delete(c.items, key)
+	delete(c.resolved, key.path)
+
+	if delete(c.byPath[key.path], key.uid); len(c.byPath[key.path]) == 0 {
+		delete(c.byPath, key.path)
+	}
+	for dir := parentPath(key.path); dir != ""; dir = parentPath(dir) {
+		if c.below[dir]--; c.below[dir] <= 0 {
+			delete(c.below, dir)
+		}
+	}
+}
+
+// parentPath returns the path of the directory holding the node at path,
+// empty for the nodes at the root.
+func parentPath(path string) string {
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNodeCacheInvalidate(t *testing.T) {
+	c := newNodeCache(100, time.Minute)
+	for _, p := range []string{"bucket/dir", "bucket/dir/file", "bucket/dir2", "bucket/other"} {
+		c.Add(0, p, File{Path: p})
+		c.Add(1, p, File{Path: p})
+	}
+
+	c.Invalidate("bucket/dir")
+
+	for _, p := range []string{"bucket/dir", "bucket/dir/file"} {
+		for uid := uint32(0); uid < 2; uid++ {
+			if _, ok := c.Get(uid, p); ok {
+				t.Fatalf("%s of uid %d kept after its directory was invalidated", p, uid)
+			}
+		}
+	}
+	for _, p := range []string{"bucket/dir2", "bucket/other"} {
+		if _, ok := c.Get(0, p); !ok {
+			t.Fatalf("%s dropped with bucket/dir", p)
+		}
+	}
+
+	c.Invalidate("bucket")
+	if len(c.items) != 0 || len(c.byPath) != 0 || len(c.below) != 0 {
+		t.Fatalf("%d nodes, %d paths and %d directories left after the bucket was invalidated", len(c.items), len(c.byPath), len(c.below))
+	}
+}
+
+// BenchmarkNodeCacheInvalidate invalidates a file in a full cache of the
+// default size, as every change through the mount does.
+func BenchmarkNodeCacheInvalidate(b *testing.B) {
+	c := newNodeCache(globalNodeCacheSize, time.Minute)
+	for i := 0; i < globalNodeCacheSize; i++ {
+		p := fmt.Sprintf("bucket/%d/%d", i/100, i)
+		c.Add(0, p, File{Path: p})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Invalidate(fmt.Sprintf("bucket/%d/%d", i%100, i))
+	}
+}
@@ -24,14 +24,22 @@ type Operation struct {
 type MoveOperation struct {
 	*Operation
 
+	UID uint32
+
 	Source string
 	Target string
+
+	// version of the source moved, and of the target once moved
+	SourceETag string
+	TargetETag string
 }
 
-func newMoveOp(sourcePath, targetPath string) MoveOperation {
+func newMoveOp(sourcePath, targetPath, etag string, uid uint32) MoveOperation {
 	return MoveOperation{
-		Source: sourcePath,
-		Target: targetPath,
+		UID:        uid,
+		Source:     sourcePath,
+		Target:     targetPath,
+		SourceETag: etag,
 		Operation: &Operation{
 			Error: make(chan error),
 		},
@@ -52,12 +60,18 @@ type PutOperation struct {
 
 	Length int64
 
+	UID uint32
+
 	Source string
 	Target string
+
+	// version of the target once uploaded
+	ETag string
 }
 
-func newPutOp(sourcePath string, targetPath string, length int64) PutOperation {
+func newPutOp(sourcePath string, targetPath string, length int64, uid uint32) PutOperation {
 	return PutOperation{
+		UID:    uid,
 		Source: sourcePath,
 		Target: targetPath,
 		Length: int64(length),
@@ -66,3 +80,26 @@ func newPutOp(sourcePath string, targetPath string, length int64) PutOperation {
 		},
 	}
 }
+
+// AppendOperation - Append source file to the end of the target object.
+type AppendOperation struct {
+	*Operation
+
+	UID uint32
+
+	Source string
+	Bucket string
+	Object string
+}
+
+func newAppendOp(sourcePath, bucket, object string, uid uint32) AppendOperation {
+	return AppendOperation{
+		UID:    uid,
+		Source: sourcePath,
+		Bucket: bucket,
+		Object: object,
+		Operation: &Operation{
+			Error: make(chan error),
+		},
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// peerCachePath is the endpoint serving cached objects to peers.
+const peerCachePath = "/fcache"
+
+// peerDateHeader carries when a request between peers was signed, and
+// peerSignatureHeader its signature with the secret of the peers.
+const (
+	peerDateHeader      = "X-Minfs-Peer-Date"
+	peerSignatureHeader = "X-Minfs-Peer-Signature"
+)
+
+// peerTmpExt is appended to the cache path of an object fetched from a
+// peer until it is complete.
+const peerTmpExt = ".peer"
+
+// serveCachePeer serves the cached objects at addr, so peers can fetch a
+// cache miss from us instead of the servers. A cached object is requested
+// by bucket, key and etag, a peer holding a different version answers 404.
+// Requests not signed with the secret of the peers are refused, objects
+// are served to peers only, which checked the object can be read by their
+// uid before asking.
+//
+// Only complete versions of objects are served: files in use, which may
+// be written in place, files holding writes not uploaded yet and pinned
+// files, which are kept for the uses of this mount, answer 404.
+func (mfs *MinFS) serveCachePeer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(peerCachePath, func(w http.ResponseWriter, r *http.Request) {
+		if !mfs.peerSigned(r) {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+
+		bucket := r.URL.Query().Get("bucket")
+		cachePath := mfs.cachePath(bucket, r.URL.Query().Get("key"), r.URL.Query().Get("etag"))
+
+		// Only serve cache files, keys can't climb out of the cache.
+		if !strings.HasPrefix(cachePath, filepath.Clean(mfs.cacheDir(bucket))+string(filepath.Separator)) {
+			http.Error(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+
+		// Hold the resource while opening, so it isn't opened half evicted
+		// or while a writer opens it.
+		unlock := mfs.km.Lock(cachePath)
+		if mfs.cacheInUse(cachePath) || mfs.stagedCachePaths()[filepath.Clean(cachePath)] || mfs.cachePinned(cachePath) {
+			unlock()
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(cachePath)
+		unlock()
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Serving a peer is a hit like any other.
+		if err := mfs.touchCache(cachePath, fi); err != nil {
+			mfs.log.Errorln("Unable to update access time of", cachePath, err)
+		}
+
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		io.Copy(w, f)
+	})
+
+	mfs.listenHTTP(addr, mux)
+}
+
+// errPeerMiss is returned when no peer has the object cached.
+var errPeerMiss = errors.New("Not cached by any peer")
+
+// fetchFromPeers saves the object at cachePath from the first peer that
+// has it cached.
+func (mfs *MinFS) fetchFromPeers(ctx context.Context, bucket, cachePath string, object minio.ObjectInfo) error {
+	for _, peer := range mfs.config.cachePeers {
+		err := mfs.fetchFromPeer(ctx, peer, bucket, cachePath, object)
+		if err == nil {
+			mfs.log.Debugln("Fetched", object.Key, "from peer", peer)
+			return nil
+		}
+		if err != errPeerMiss {
+			mfs.log.Errorln("Unable to fetch", object.Key, "from peer", peer, err)
+		}
+	}
+	return errPeerMiss
+}
+
+func (mfs *MinFS) fetchFromPeer(ctx context.Context, peer, bucket, cachePath string, object minio.ObjectInfo) error {
+	query := url.Values{}
+	query.Set("bucket", bucket)
+	query.Set("key", object.Key)
+	query.Set("etag", object.ETag)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(peer, "/")+peerCachePath+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	mfs.signPeerRequest(req)
+
+	resp, err := mfs.peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errPeerMiss
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer answered %s", resp.Status)
+	}
+
+	// Download aside and rename, so a partial copy is never served.
+	if err = os.MkdirAll(filepath.Dir(cachePath), 0777); err != nil {
+		return err
+	}
+
+	tmpPath := cachePath + peerTmpExt
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	n, err := io.Copy(tmp, resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if n != object.Size {
+		return fmt.Errorf("peer sent %d bytes of %d", n, object.Size)
+	}
+
+	return os.Rename(tmpPath, cachePath)
+}
+
+// peerSignature signs the request for the object in query at date with the
+// secret of the peers.
+func (mfs *MinFS) peerSignature(query, date string) []byte {
+	mac := hmac.New(sha256.New, mfs.config.peerSecret)
+	mac.Write([]byte(peerCachePath + "?" + query + "\n" + date))
+	return mac.Sum(nil)
+}
+
+// signPeerRequest signs req for the peer it is sent to.
+func (mfs *MinFS) signPeerRequest(req *http.Request) {
+	date := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(peerDateHeader, date)
+	req.Header.Set(peerSignatureHeader, hex.EncodeToString(mfs.peerSignature(req.URL.RawQuery, date)))
+}
+
+// peerSigned returns if r was signed by a peer lately, requests signed
+// longer ago than globalPeerSkew are refused so they can't be replayed.
+func (mfs *MinFS) peerSigned(r *http.Request) bool {
+	date := r.Header.Get(peerDateHeader)
+	unix, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > globalPeerSkew || skew < -globalPeerSkew {
+		return false
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(peerSignatureHeader))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(signature, mfs.peerSignature(r.URL.RawQuery, date))
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// xattrPin is set on a file to keep its cache file from eviction, and
+// removed to let it go.
+const xattrPin = "user.minfs.pin"
+
+// Pin keeps the cache file at path from eviction, open or not, until
+// unpinned. A file not cached yet is kept once fetched. The pin moves to
+// the new version when the object changes.
+func (mfs *MinFS) Pin(path string) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	for _, p := range versionPaths(path) {
+		mfs.pinned[p] = true
+	}
+}
+
+// Unpin lets the cache file at path be evicted again.
+func (mfs *MinFS) Unpin(path string) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	for _, p := range versionPaths(path) {
+		delete(mfs.pinned, p)
+	}
+}
+
+// cachePinned returns if the cache file at path is pinned.
+func (mfs *MinFS) cachePinned(path string) bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	return mfs.pinned[filepath.Clean(path)]
+}
+
+// movePin moves the pin of the version cached at from to the one at to,
+// callers hold m.
+func (mfs *MinFS) movePin(from, to string) {
+	if !mfs.pinned[filepath.Clean(from)] {
+		return
+	}
+
+	for _, p := range versionPaths(from) {
+		delete(mfs.pinned, p)
+	}
+	for _, p := range versionPaths(to) {
+		mfs.pinned[p] = true
+	}
+}
+
+// pinCachePath returns the cache path of the version of the file pins
+// apply to.
+func (f *File) pinCachePath(ctx context.Context, uid uint32) (string, error) {
+	api, err := f.mfs.getBucketApi(ctx, uid, f.Bucket())
+	if err != nil {
+		return "", err
+	}
+
+	cachePath, _, err := f.cacheAllocate(ctx, uid, api)
+	return cachePath, err
+}
+
+// getPin reads xattrPin, set on pinned files only.
+func (f *File) getPin(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	cachePath, err := f.pinCachePath(ctx, req.Header.Uid)
+	if err != nil {
+		return err
+	}
+
+	if !f.mfs.cachePinned(cachePath) {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte("1")
+	return nil
+}
+
+// Setxattr pins the cache file of the file, when setting xattrPin, and
+// requests a restore of the object when setting xattrRestore. Other
+// attributes can't be set.
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if req.Name == xattrRestore {
+		return f.setRestore(ctx, req)
+	} else if req.Name != xattrPin {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+
+	cachePath, err := f.pinCachePath(ctx, req.Header.Uid)
+	if err != nil {
+		f.mfs.log.Errorln("Unable to pin", f.FullPath(), err)
+		return err
+	}
+
+	f.mfs.log.Println("Pinning", f.FullPath(), "cached @", cachePath)
+	f.mfs.Pin(cachePath)
+	return nil
+}
+
+// Removexattr unpins the cache file of the file, when removing xattrPin.
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if req.Name != xattrPin {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+
+	cachePath, err := f.pinCachePath(ctx, req.Header.Uid)
+	if err != nil {
+		f.mfs.log.Errorln("Unable to unpin", f.FullPath(), err)
+		return err
+	}
+
+	if !f.mfs.cachePinned(cachePath) {
+		return fuse.ErrNoXattr
+	}
+
+	f.mfs.log.Println("Unpinning", f.FullPath(), "cached @", cachePath)
+	f.mfs.Unpin(cachePath)
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// metaCrtime is the user metadata archival tools store the creation time in.
+const metaCrtime = "crtime"
+
+// userMeta returns the user metadata value of name. Keys are matched without
+// case and with or without the x-amz-meta- prefix, as listings and stats
+// present them differently.
+func userMeta(objInfo minio.ObjectInfo, name string) (string, bool) {
+	for key, value := range objInfo.UserMetadata {
+		key = strings.ToLower(key)
+		if strings.TrimPrefix(key, "x-amz-meta-") == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// parseMetaTime parses a time stored in metadata, either as seconds since
+// the epoch, possibly fractional, or as RFC 3339.
+func parseMetaTime(value string) (time.Time, bool) {
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*1e9)), true
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// objectCrtime returns the creation time of the object, the last
+// modification when none was stored with it.
+func objectCrtime(objInfo minio.ObjectInfo) time.Time {
+	if value, ok := userMeta(objInfo, metaCrtime); ok {
+		if t, ok := parseMetaTime(value); ok {
+			return t
+		}
+	}
+	return objInfo.LastModified
+}
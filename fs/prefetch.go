@@ -0,0 +1,110 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// PrefetchErrors holds the error of each path prefetched, nil for the paths
+// that were cached.
+type PrefetchErrors []error
+
+func (errs PrefetchErrors) Error() string {
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	return fmt.Sprintf("%d of %d paths not prefetched: %s", len(msgs), len(errs), strings.Join(msgs, "; "))
+}
+
+// Prefetch caches the objects at paths, given as bucket/key, with the
+// credentials of uid, so their first open doesn't wait for the download.
+// Objects cached already are only marked used. A path failing doesn't stop
+// the others, the error returned is a PrefetchErrors then.
+func (mfs *MinFS) Prefetch(ctx context.Context, paths []string, uid uint32) error {
+	errs := make(PrefetchErrors, len(paths))
+
+	failed := false
+	for i, p := range paths {
+		if errs[i] = mfs.prefetch(ctx, strings.Trim(p, "/"), uid); errs[i] != nil {
+			errs[i] = fmt.Errorf("%s: %v", p, errs[i])
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// prefetch caches the object at fullPath, as an open would.
+func (mfs *MinFS) prefetch(ctx context.Context, fullPath string, uid uint32) error {
+	if !mfs.ops.begin() {
+		return fuse.EIO
+	}
+	defer mfs.ops.end()
+
+	// The object is named by the last segment of its key.
+	parent, name := fullPath, ""
+	if i := strings.Index(fullPath, "/"); i >= 0 {
+		parent, name = fullPath[:i], fullPath[i+1:]
+	}
+	if i := strings.LastIndex(name, mfs.keyDelimiter()); i >= 0 {
+		parent, name = parent+"/"+name[:i], name[i+len(mfs.keyDelimiter()):]
+	}
+
+	dir := mfs.dirAt(parent)
+	node, err := dir.lookup(ctx, mfs.names.present(name), uid)
+	if err != nil {
+		return err
+	}
+
+	f, ok := node.(*File)
+	if !ok {
+		return fuse.Errno(syscall.EISDIR)
+	}
+
+	api, err := mfs.getBucketApi(ctx, uid, f.Bucket())
+	if err != nil {
+		return err
+	}
+
+	cachePath, object, err := f.cacheAllocate(ctx, uid, api)
+	if err != nil {
+		return err
+	}
+
+	// Objects the cache filesystem can't hold are streamed when opened.
+	if limit := mfs.maxCacheFileSize(f.Bucket()); limit > 0 && object.Size > limit {
+		return fuse.Errno(syscall.EFBIG)
+	}
+
+	// Opens of the object wait for the download, as for any other.
+	cachePath = mfs.readCachePath(cachePath, object)
+	unlock := mfs.km.Lock(cachePath)
+	defer unlock()
+
+	return f.cacheSave(ctx, cachePath, &fuse.OpenRequest{Header: fuse.Header{Uid: uid}, Flags: fuse.OpenReadOnly}, api, object)
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// CredentialProvider provides the credentials the requests made for a uid
+// are signed with. Clients are cached per endpoint and credentials, so a
+// provider returns the same credentials for a uid until they change, and
+// refreshes them itself when they expire. An error fails the operation of
+// the uid, a fuse.Errno is returned as is.
+type CredentialProvider interface {
+	Credentials(ctx context.Context, uid uint32) (*credentials.Credentials, error)
+}
+
+// configCredentials is the default provider, serving the credentials of the
+// config: the keys of the environment, temporary credentials from STS or
+// the IAM role of the node, the keys of uids with credentials of their
+// own, and no credentials at all for anonymous requests.
+type configCredentials struct {
+	cfg *Config
+
+	// transport to the STS endpoint
+	transport http.RoundTripper
+
+	mu    sync.Mutex
+	creds *credentials.Credentials
+	anon  *credentials.Credentials
+	users map[uint32]*credentials.Credentials
+}
+
+func newConfigCredentials(cfg *Config, transport http.RoundTripper) *configCredentials {
+	return &configCredentials{
+		cfg:       cfg,
+		transport: transport,
+		users:     map[uint32]*credentials.Credentials{},
+	}
+}
+
+// Credentials returns the credentials of uid.
+//
+// A uid without credentials of its own uses the mount credentials, unless
+// unknown users are denied, then it gets EACCES, or are anonymous, then its
+// requests aren't signed. The uid of the mount always uses the mount
+// credentials, background work runs as it.
+func (p *configCredentials) Credentials(ctx context.Context, uid uint32) (*credentials.Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ac, ok := p.cfg.users[uid]
+	if !ok {
+		if p.cfg.denyUnknownUsers && uid != p.cfg.uid {
+			return nil, fuse.Errno(syscall.EACCES)
+		} else if p.cfg.anonymous && uid != p.cfg.uid {
+			return p.anonymous(), nil
+		}
+		return p.mount(), nil
+	}
+
+	creds, ok := p.users[uid]
+	if !ok {
+		creds = credentials.NewStaticV4(ac.AccessKey, ac.SecretKey, ac.SecretToken)
+		p.users[uid] = creds
+	}
+	return creds, nil
+}
+
+// mount returns the mount credentials, creating them on first use. Callers
+// hold mu.
+//
+// Temporary credentials are fetched on first use and fetched again shortly
+// before they expire, so long running mounts keep working across sessions.
+// Static keys are fetched again through the refresh of the config once the
+// servers reject them. A mount without keys is anonymous.
+//
+// The credentials of an IAM role are fetched from the platform the mount
+// runs on, and fetched again before they expire like those of STS.
+func (p *configCredentials) mount() *credentials.Credentials {
+	if p.creds != nil {
+		return p.creds
+	}
+
+	if p.cfg.iam {
+		// Fetched as the AWS SDKs do, the metadata endpoints are local to
+		// the node and not reached through any proxy.
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		p.creds = credentials.New(&credentials.IAM{
+			Client:   &http.Client{Transport: transport},
+			Endpoint: p.cfg.iamEndpoint,
+		})
+		return p.creds
+	}
+
+	cfg := p.cfg.sts
+	if cfg == nil && p.cfg.accessKey == "" && p.cfg.secretKey == "" {
+		p.creds = p.anonymous()
+		return p.creds
+	} else if cfg == nil {
+		refresh := p.cfg.refresh
+		if refresh == nil {
+			refresh = refreshFromEnv
+		}
+
+		p.creds = credentials.New(&refreshProvider{
+			refresh: refresh,
+			value: credentials.Value{
+				AccessKeyID:     p.cfg.accessKey,
+				SecretAccessKey: p.cfg.secretKey,
+				SessionToken:    p.cfg.secretToken,
+				SignerType:      credentials.SignatureV4,
+			},
+		})
+		return p.creds
+	}
+
+	// The STS endpoint is trusted like the storage servers.
+	client := &http.Client{Transport: p.transport}
+
+	if cfg.tokenFile != "" {
+		p.creds = credentials.New(&credentials.STSWebIdentity{
+			Client:      client,
+			STSEndpoint: cfg.endpoint.String(),
+			// The token is read again on every refresh, as it is rotated
+			// in place by whoever issued it.
+			GetWebIDTokenExpiry: func() (*credentials.WebIdentityToken, error) {
+				token, err := ioutil.ReadFile(cfg.tokenFile)
+				if err != nil {
+					return nil, err
+				}
+				return &credentials.WebIdentityToken{Token: string(bytes.TrimSpace(token))}, nil
+			},
+		})
+		return p.creds
+	}
+
+	p.creds = credentials.New(&credentials.STSAssumeRole{
+		Client:      client,
+		STSEndpoint: cfg.endpoint.String(),
+		Options: credentials.STSAssumeRoleOptions{
+			AccessKey:       p.cfg.accessKey,
+			SecretKey:       p.cfg.secretKey,
+			Location:        p.cfg.region,
+			RoleARN:         cfg.roleARN,
+			RoleSessionName: globalSTSSessionName,
+		},
+	})
+	return p.creds
+}
+
+// anonymous returns the credentials of anonymous requests, sent unsigned
+// so only public buckets and objects can be read. Callers hold mu.
+func (p *configCredentials) anonymous() *credentials.Credentials {
+	if p.anon == nil {
+		p.anon = credentials.NewStatic("", "", "", credentials.SignatureAnonymous)
+	}
+	return p.anon
+}
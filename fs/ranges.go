@@ -0,0 +1,262 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// span is the byte range [start, end) of an object.
+type span struct {
+	start, end int64
+}
+
+// rangeSet tracks the ranges of a sparse cache file fetched so far, shared
+// by the handles reading the file. Ranges are fetched under fetch, so
+// reads of overlapping ranges fetch them once, and reads of ranges fetched
+// don't wait for a fetch.
+type rangeSet struct {
+	fetch sync.Mutex
+
+	mu sync.Mutex
+
+	// sorted, neither overlapping nor adjacent
+	spans []span
+}
+
+// add records s as fetched, merging it with the spans it overlaps or
+// touches.
+func (rs *rangeSet) add(s span) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	i := sort.Search(len(rs.spans), func(i int) bool { return rs.spans[i].end >= s.start })
+
+	j := i
+	for ; j < len(rs.spans) && rs.spans[j].start <= s.end; j++ {
+		if rs.spans[j].start < s.start {
+			s.start = rs.spans[j].start
+		}
+		if rs.spans[j].end > s.end {
+			s.end = rs.spans[j].end
+		}
+	}
+
+	rs.spans = append(rs.spans[:i], append([]span{s}, rs.spans[j:]...)...)
+}
+
+// missing returns the parts of s that weren't fetched.
+func (rs *rangeSet) missing(s span) (gaps []span) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, have := range rs.spans {
+		if have.end <= s.start {
+			continue
+		} else if have.start >= s.end {
+			break
+		}
+
+		if have.start > s.start {
+			gaps = append(gaps, span{s.start, have.start})
+		}
+		s.start = have.end
+		if s.start >= s.end {
+			return gaps
+		}
+	}
+	return append(gaps, s)
+}
+
+// rangeCachePath returns the sparse cache file of a range read object.
+func rangeCachePath(cachePath string) string {
+	return strings.TrimSuffix(cachePath, globalCacheExt) + globalRangeCacheExt
+}
+
+// openRange returns a handle reading the object by range into a sparse
+// cache file, only the ranges read are fetched.
+func (f *File) openRange(req *fuse.OpenRequest, resp *fuse.OpenResponse, api *minio.Client, object minio.ObjectInfo, cachePath string) (*FileHandle, error) {
+	rangePath := rangeCachePath(cachePath)
+
+	// Hold the resource while opening, so it isn't opened half evicted.
+	unlock := f.mfs.km.Lock(rangePath)
+	defer unlock()
+
+	f.mfs.m.Lock()
+	ranges, ok := f.mfs.ranges[rangePath]
+	if !ok {
+		ranges = &rangeSet{}
+		f.mfs.ranges[rangePath] = ranges
+	}
+	f.mfs.m.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(rangePath), 0777); err != nil {
+		return nil, err
+	}
+
+	fh, err := f.mfs.Acquire(f, rangePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fh.cachePath = rangePath
+	fh.uid = req.Uid
+	fh.api = api
+	fh.etag = object.ETag
+	fh.ranges = ranges
+	if window := f.mfs.config.readahead; window > 0 {
+		fh.readahead = newReadahead(window)
+	}
+
+	fh.File, err = f.mfs.openLocal(rangePath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		f.mfs.Release(fh)
+		return nil, err
+	}
+
+	// A file left by an earlier mount holds ranges nobody knows of, it is
+	// started over.
+	if ok {
+		if info, err := fh.File.Stat(); err == nil {
+			f.mfs.touchCache(rangePath, info)
+		}
+	} else {
+		if err = fh.File.Truncate(0); err == nil {
+			err = fh.File.Truncate(object.Size)
+		}
+		if err != nil {
+			fh.File.Close()
+			f.mfs.Release(fh)
+			return nil, err
+		}
+	}
+
+	f.Size = uint64(object.Size)
+	resp.Handle = fuse.HandleID(fh.handle)
+
+	f.mfs.log.Debugln("Serving FH request [", fh.handle, "], reading by range: ", f.FullPath(), " cache resource @", rangePath)
+
+	return fh, nil
+}
+
+// readRange serves the requested range from the sparse cache file,
+// fetching the parts of it that weren't read before.
+func (fh *FileHandle) readRange(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	size := int64(fh.f.Size)
+	if req.Offset >= size {
+		return nil
+	}
+
+	end := req.Offset + int64(req.Size)
+	if end > size {
+		end = size
+	}
+
+	if err := fh.fetchRange(ctx, span{req.Offset, end}); err != nil {
+		fh.f.mfs.log.Errorln("Error fetching range of", fh.f.FullPath(), err)
+		return fuse.EIO
+	}
+
+	if fh.readahead != nil {
+		if ahead, ok := fh.readahead.advance(span{req.Offset, end}, size); ok {
+			go fh.prefetch(ahead)
+		}
+	}
+
+	buff := make([]byte, end-req.Offset)
+	n, err := fh.File.ReadAt(buff, req.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	resp.Data = buff[:n]
+	return nil
+}
+
+// fetchRange fetches the parts of s not fetched yet. Reads are widened to
+// whole chunks, and the gaps are coalesced into a single request from the
+// first to the end of the last.
+func (fh *FileHandle) fetchRange(ctx context.Context, s span) error {
+	size := int64(fh.f.Size)
+
+	s.start -= s.start % globalRangeChunk
+	if s.end += globalRangeChunk - 1 - (s.end-1)%globalRangeChunk; s.end > size {
+		s.end = size
+	}
+
+	if len(fh.ranges.missing(s)) == 0 {
+		return nil
+	}
+
+	fh.ranges.fetch.Lock()
+	defer fh.ranges.fetch.Unlock()
+
+	gaps := fh.ranges.missing(s)
+	if len(gaps) == 0 {
+		return nil
+	}
+	fetch := span{gaps[0].start, gaps[len(gaps)-1].end}
+
+	opts := fh.f.mfs.getOptions(fh.f.Bucket())
+	if err := opts.SetRange(fetch.start, fetch.end-1); err != nil {
+		return err
+	}
+
+	// Every range must come from the version that was opened.
+	if err := opts.SetMatchETag(fh.etag); err != nil {
+		return err
+	}
+
+	object, err := fh.api.GetObject(ctx, fh.f.Bucket(), fh.f.ObjectPath(), opts)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	buff := make([]byte, globalRangeChunk)
+	for offset := fetch.start; offset < fetch.end; {
+		n, err := io.ReadFull(object, buff[:min64(int64(len(buff)), fetch.end-offset)])
+		if err != nil {
+			return err
+		}
+		if _, err = fh.File.WriteAt(buff[:n], offset); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+
+	fh.ranges.add(fetch)
+
+	if info, err := fh.File.Stat(); err == nil {
+		fh.f.mfs.cacheAdded(fh.cachePath, info)
+	}
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket allowing rate requests per second, with
+// bursts of up to one second worth of requests.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	// requests let through since windowStart, and the rate of the last window
+	count       int
+	windowStart time.Time
+	observed    float64
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	now := time.Now()
+	return &rateLimiter{
+		rate:        float64(rate),
+		tokens:      float64(rate),
+		last:        now,
+		windowStart: now,
+	}
+}
+
+// Wait blocks until a request is allowed, or ctx is done.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		l.refill()
+
+		if l.tokens >= 1 {
+			l.tokens--
+			l.count++
+			l.mu.Unlock()
+			return nil
+		}
+
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// refill adds the tokens accrued since the last refill, callers hold mu.
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+}
+
+// Allow takes a token if one is available, without waiting.
+func (l *rateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	l.count++
+	return true
+}
+
+// Rate returns the requests per second let through recently.
+func (l *rateLimiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elapsed := time.Since(l.windowStart); elapsed >= time.Second {
+		l.observed = float64(l.count) / elapsed.Seconds()
+		l.count = 0
+		l.windowStart = time.Now()
+	}
+	return l.observed
+}
+
+// limitedTransport passes every request through the rate limiter.
+type limitedTransport struct {
+	http.RoundTripper
+
+	limiter *rateLimiter
+}
+
+// RoundTrip waits for the limiter before sending the request, a request
+// whose context is done while waiting is never sent.
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
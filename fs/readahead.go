@@ -0,0 +1,117 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"sync"
+)
+
+// readahead prefetches the ranges ahead of a sequential reader of a handle
+// read by range, so they are cached by the time they are read. A read that
+// doesn't start near where the last one ended stops the readahead, until
+// the reads are sequential again.
+type readahead struct {
+	mu sync.Mutex
+
+	window int64
+
+	// end of the last read, and of the ranges prefetched
+	next  int64
+	ahead int64
+
+	// stops the prefetch running, if any, once the handle is released
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+	busy    bool
+}
+
+func newReadahead(window int64) *readahead {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &readahead{window: window, ctx: ctx, cancel: cancel}
+}
+
+// advance records a read of s from an object of size bytes, and returns the
+// span to prefetch when the read is sequential and the reader got past
+// the first half of the prefetched ranges.
+func (ra *readahead) advance(s span, size int64) (span, bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	// Reads may be served slightly out of order, a chunk is still sequential.
+	sequential := s.start >= ra.next-globalRangeChunk && s.start <= ra.next+globalRangeChunk
+	ra.next = s.end
+	if !sequential {
+		ra.ahead = 0
+		return span{}, false
+	}
+
+	if ra.busy || ra.ahead-s.end > ra.window/2 {
+		return span{}, false
+	}
+
+	ahead := span{s.end, min64(s.end+ra.window, size)}
+	if ra.ahead > ahead.start {
+		ahead.start = ra.ahead
+	}
+	if ahead.start >= ahead.end {
+		return span{}, false
+	}
+
+	ra.ahead = ahead.end
+	ra.busy = true
+	ra.running.Add(1)
+	return ahead, true
+}
+
+// done marks the prefetch returned by advance as done.
+func (ra *readahead) done() {
+	ra.mu.Lock()
+	ra.busy = false
+	ra.mu.Unlock()
+
+	ra.running.Done()
+}
+
+// stop cancels the prefetch running and waits for it to return.
+func (ra *readahead) stop() {
+	ra.cancel()
+	ra.running.Wait()
+}
+
+// prefetch fetches the span s ahead of the reader. The sparse file isn't
+// evicted while fetched, and is marked used once fetched, so ranges
+// prefetched aren't evicted before they are read.
+func (fh *FileHandle) prefetch(s span) {
+	defer fh.readahead.done()
+
+	fh.f.mfs.beginDownload(fh.cachePath)
+	defer fh.f.mfs.endDownload(fh.cachePath)
+
+	if err := fh.fetchRange(fh.readahead.ctx, s); err != nil {
+		if fh.readahead.ctx.Err() == nil {
+			fh.f.mfs.log.Errorln("Error prefetching range of", fh.f.FullPath(), err)
+		}
+		return
+	}
+
+	if info, err := fh.File.Stat(); err == nil {
+		if err = fh.f.mfs.touchCache(fh.cachePath, info); err != nil {
+			fh.f.mfs.log.Errorln("Unable to update access time of", fh.cachePath, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// objectGone returns if err tells the object doesn't exist on the server.
+func objectGone(err error) bool {
+	if meta.IsNoSuchObject(err) {
+		return true
+	}
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// reconcileCache drops the cache files of objects removed from the servers
+// every interval, until done is closed. Only the objects the mount opened
+// are known, the files cached before it started are left to eviction.
+func (mfs *MinFS) reconcileCache(done <-chan struct{}, interval time.Duration) {
+	mfs.log.Println("Starting cache reconciliation: interval =", interval)
+
+	for {
+		select {
+		case <-done:
+			mfs.log.Println("Stopping cache reconciliation")
+			return
+		case <-time.After(interval):
+			mfs.dropRemoved(done)
+		}
+	}
+}
+
+// dropRemoved stats every object whose version the mount cached, and drops
+// the cache files of those gone. Objects that can't be stat are kept.
+func (mfs *MinFS) dropRemoved(done <-chan struct{}) {
+	mfs.m.Lock()
+	objects := make([]string, 0, len(mfs.versions))
+	for object := range mfs.versions {
+		objects = append(objects, object)
+	}
+	mfs.m.Unlock()
+	sort.Strings(objects)
+
+	var dropped int
+	for _, object := range objects {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		i := strings.IndexByte(object, '/')
+		bucket, key := object[:i], object[i+1:]
+
+		gone, err := mfs.objectRemoved(bucket, key)
+		if err != nil {
+			mfs.log.Debugln("Unable to reconcile", object, err)
+			continue
+		} else if !gone {
+			continue
+		}
+
+		mfs.log.Println("Object", object, "was removed, dropping its cache files")
+		mfs.dropObject(bucket, key)
+		mfs.invalidate(path.Join(bucket, mfs.presentKey(key)))
+		dropped++
+	}
+
+	if dropped > 0 {
+		mfs.log.Println("Dropped the cache files of", dropped, "removed objects")
+	}
+}
+
+// objectRemoved returns if the object key of bucket is gone from the server.
+func (mfs *MinFS) objectRemoved(bucket, key string) (bool, error) {
+	_, err := mfs.objectETag(bucket, key)
+	if objectGone(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// sweepBuckets returns the buckets whose objects may be cached in the cache
+// directory dir: its bucket for the cache directory of a bucket, else every
+// bucket presented without a cache directory of its own.
+func (mfs *MinFS) sweepBuckets(dir string) ([]string, error) {
+	for bucket, bc := range mfs.config.bucketCaches {
+		if filepath.Clean(bc.dir) == filepath.Clean(dir) {
+			return []string{bucket}, nil
+		}
+	}
+
+	if mfs.config.root != "" {
+		return strings.SplitN(mfs.config.root, "/", 2)[:1], nil
+	}
+
+	entries, err := (&Dir{mfs: mfs}).scanRoot(context.Background(), mfs.config.uid)
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets []string
+	for _, entry := range entries {
+		if d, ok := entry.(Dir); ok {
+			if _, ok := mfs.config.bucketCaches[d.Path]; !ok {
+				buckets = append(buckets, d.Path)
+			}
+		}
+	}
+	return buckets, nil
+}
+
+// cacheOrphaned returns if the cache file at rel, relative to its cache
+// directory, holds a version no bucket has anymore: the object is gone from
+// each of buckets, or has another etag. Files whose key can't be told from
+// their name, or whose object can't be stat, aren't. Neither are files
+// staged by writes, they hold data that may never have been uploaded.
+func (mfs *MinFS) cacheOrphaned(buckets []string, rel string) bool {
+	key, etag, hashed, ok := parseCacheName(rel)
+	if !ok || hashed || etag == "" {
+		return false
+	}
+
+	for _, bucket := range buckets {
+		current, err := mfs.objectETag(bucket, key)
+		if err == nil && current == etag {
+			return false
+		} else if err != nil && !objectGone(err) {
+			mfs.log.Debugln("Unable to check", rel, "in", bucket, err)
+			return false
+		}
+	}
+	return true
+}
+
+// objectETag returns the etag of the object key of bucket on the server.
+func (mfs *MinFS) objectETag(bucket, key string) (string, error) {
+	ctx, cancel := withTimeout(context.Background(), mfs.config.opTimeout)
+	defer cancel()
+
+	api, err := mfs.getBucketApi(ctx, mfs.config.uid, bucket)
+	if err != nil {
+		return "", err
+	}
+
+	var objInfo minio.ObjectInfo
+	err = mfs.retryExpired(ctx, mfs.config.uid, func() (err error) {
+		objInfo, err = api.StatObject(ctx, bucket, key, mfs.getOptions(bucket))
+		return err
+	})
+	return objInfo.ETag, err
+}
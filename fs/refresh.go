@@ -0,0 +1,97 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// refreshProvider serves the static keys of the mount, fetching them again
+// through refresh once they're expired. Static keys never expire by
+// themselves, they're expired when the servers reject them.
+type refreshProvider struct {
+	refresh func() (AccessConfig, error)
+
+	value   credentials.Value
+	fetched bool
+}
+
+// Retrieve returns the keys of the config first, and the refreshed keys
+// after that. It is called with the credentials locked.
+func (p *refreshProvider) Retrieve() (credentials.Value, error) {
+	if p.fetched {
+		ac, err := p.refresh()
+		if err != nil {
+			return credentials.Value{}, err
+		}
+
+		p.value = credentials.Value{
+			AccessKeyID:     ac.AccessKey,
+			SecretAccessKey: ac.SecretKey,
+			SessionToken:    ac.SecretToken,
+			SignerType:      credentials.SignatureV4,
+		}
+	}
+
+	p.fetched = true
+	return p.value, nil
+}
+
+// IsExpired returns false, the keys are only refreshed once rejected.
+func (p *refreshProvider) IsExpired() bool {
+	return false
+}
+
+// refreshFromEnv reads the keys from the environment again, like on start.
+func refreshFromEnv() (AccessConfig, error) {
+	ac, err := InitMinFSConfig()
+	if err != nil {
+		return AccessConfig{}, err
+	}
+	return *ac, nil
+}
+
+// isExpiredCredentials returns if err is a request rejected for expired
+// credentials.
+func isExpiredCredentials(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "ExpiredToken", "ExpiredTokenException", "InvalidToken", "TokenRefreshRequired":
+		return true
+	}
+	return false
+}
+
+// retryExpired runs op, and once more with the credentials of uid fetched
+// again when it was rejected for expired credentials. Transient failures
+// are retried, see retryTransient.
+func (mfs *MinFS) retryExpired(ctx context.Context, uid uint32, op func() error) error {
+	err := mfs.retryTransient(ctx, op)
+	if !isExpiredCredentials(err) {
+		return err
+	}
+
+	creds, cerr := mfs.provider.Credentials(ctx, uid)
+	if cerr != nil {
+		return err
+	}
+
+	mfs.log.Println("Credentials expired, refreshing them:", err)
+	creds.Expire()
+	return mfs.retryTransient(ctx, op)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// xattrRestore reads as the restore status of an archived object, and is
+// set to the days to restore it for to request a restore.
+const xattrRestore = "user.s3.restore"
+
+// globalRestoreDays is how long an object is restored for by default.
+const globalRestoreDays = 1
+
+// archivedObject returns if err tells the object is archived, as in the
+// GLACIER or DEEP_ARCHIVE storage classes, and must be restored to be read.
+func archivedObject(err error) bool {
+	return minio.ToErrorResponse(err).Code == "InvalidObjectState"
+}
+
+// getRestore reads xattrRestore, the x-amz-restore header of the object as
+// stat now: `ongoing-request="true"` while restoring, and the expiry of
+// the restored copy once done. Objects never restored don't have it.
+func (f *File) getRestore(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	api, err := f.mfs.getBucketApi(ctx, req.Header.Uid, f.Bucket())
+	if err != nil {
+		return err
+	}
+
+	octx, cancel := withTimeout(ctx, f.mfs.config.opTimeout)
+	defer cancel()
+
+	var info minio.ObjectInfo
+	err = f.mfs.retryExpired(octx, req.Header.Uid, func() (err error) {
+		info, err = api.StatObject(octx, f.Bucket(), f.ObjectPath(), f.mfs.getOptions(f.Bucket()))
+		return err
+	})
+	if err != nil {
+		f.mfs.log.Errorln("Unable to get restore status of", f.FullPath(), err)
+		return fuse.EIO
+	}
+
+	status := info.Metadata.Get("X-Amz-Restore")
+	if status == "" {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(status)
+	return nil
+}
+
+// setRestore requests a restore of the archived object for the days set,
+// by default globalRestoreDays. It returns once the server accepted the
+// request, the restore itself takes hours: the status is polled reading
+// xattrRestore. A restore already in progress is left to complete.
+func (f *File) setRestore(ctx context.Context, req *fuse.SetxattrRequest) error {
+	days := globalRestoreDays
+	if value := strings.TrimSpace(string(req.Xattr)); value != "" {
+		var err error
+		if days, err = strconv.Atoi(value); err != nil || days <= 0 {
+			return fuse.Errno(syscall.EINVAL)
+		}
+	}
+
+	api, err := f.mfs.getBucketApi(ctx, req.Header.Uid, f.Bucket())
+	if err != nil {
+		return err
+	}
+
+	var restore minio.RestoreRequest
+	restore.SetDays(days)
+
+	octx, cancel := withTimeout(ctx, f.mfs.config.opTimeout)
+	defer cancel()
+
+	err = f.mfs.retryExpired(octx, req.Header.Uid, func() error {
+		return api.RestoreObject(octx, f.Bucket(), f.ObjectPath(), "", restore)
+	})
+	if err == nil {
+		f.mfs.log.Println("Restoring", f.FullPath(), "for", days, "days")
+		return nil
+	}
+
+	switch minio.ToErrorResponse(err).Code {
+	case "RestoreAlreadyInProgress":
+		return nil
+	case "InvalidObjectState":
+		// Not archived, there is nothing to restore.
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	f.mfs.log.Errorln("Unable to restore", f.FullPath(), err)
+	return fuse.EIO
+}
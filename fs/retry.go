@@ -0,0 +1,297 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// retryBudget caps the retries of all requests of the mount, so a failing
+// server isn't flooded with retries. A nil limiter is an unlimited budget.
+type retryBudget struct {
+	limiter *rateLimiter
+
+	// retries done and retries refused as the budget was spent
+	retried uint64
+	shed    uint64
+}
+
+func newRetryBudget(rate int) *retryBudget {
+	b := &retryBudget{}
+	if rate > 0 {
+		b.limiter = newRateLimiter(rate)
+	}
+	return b
+}
+
+// take pays for one retry, false when the budget is spent.
+func (b *retryBudget) take() bool {
+	if b.limiter != nil && !b.limiter.Allow() {
+		atomic.AddUint64(&b.shed, 1)
+		return false
+	}
+
+	atomic.AddUint64(&b.retried, 1)
+	return true
+}
+
+// Stats returns the number of retries done and refused so far.
+func (b *retryBudget) Stats() (retried, shed uint64) {
+	return atomic.LoadUint64(&b.retried), atomic.LoadUint64(&b.shed)
+}
+
+// retryTransport retries requests failing with a network error or a
+// retryable status, with exponential backoff and jitter. Every retry is
+// paid from the budget, once it is spent requests fail right away.
+// Requests with a body that can't be replayed, like uploads, aren't retried.
+//
+// minio-go retries failed requests on its own too, as sent again they pass
+// the transport as new requests. A request the transport gave up on fails
+// the same way when minio-go sends it again, without being sent, so those
+// aren't retried again past the retries and the budget of the transport.
+// minio-go still retries what the transport doesn't, as requests sent to
+// the wrong region or signed with an expired token.
+type retryTransport struct {
+	http.RoundTripper
+
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	budget     *retryBudget
+
+	mu     sync.Mutex
+	failed map[failedKey]*failedRequest
+}
+
+func newRetryTransport(rt http.RoundTripper, retries int, backoff, maxBackoff time.Duration, budget *retryBudget) *retryTransport {
+	return &retryTransport{
+		RoundTripper: rt,
+		retries:      retries,
+		backoff:      backoff,
+		maxBackoff:   maxBackoff,
+		budget:       budget,
+		failed:       map[failedKey]*failedRequest{},
+	}
+}
+
+// failedKey identifies the requests minio-go sends again for one call,
+// they share the context of the call.
+type failedKey struct {
+	ctx    context.Context
+	method string
+	url    string
+}
+
+// failedRequest is how a request the transport gave up on failed, its
+// error or the response of the server, and when.
+type failedRequest struct {
+	err    error
+	status int
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// response returns the failure again, as a response of its own for req.
+func (f *failedRequest) response(req *http.Request) (*http.Response, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &http.Response{
+		Status:        http.StatusText(f.status),
+		StatusCode:    f.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        f.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(f.body)),
+		ContentLength: int64(len(f.body)),
+		Request:       req,
+	}, nil
+}
+
+// keyOf returns the key of req, false for requests whose context is never
+// done: unrelated calls share such contexts, their requests aren't told
+// apart.
+func keyOf(req *http.Request) (failedKey, bool) {
+	ctx := req.Context()
+	if ctx.Done() == nil {
+		return failedKey{}, false
+	}
+	return failedKey{ctx, req.Method, req.URL.String()}, true
+}
+
+// lastFailure returns how the request at key failed, if the transport
+// gave up on it lately.
+func (t *retryTransport) lastFailure(key failedKey) (*failedRequest, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failed[key]
+	if !ok || time.Since(f.at) > globalFailedRequestTTL {
+		return nil, false
+	}
+	return f, true
+}
+
+// giveUp remembers how the request at key failed, reading the error
+// response whole, and returns the failure as it is returned. Failures of
+// calls done meanwhile are dropped.
+func (t *retryTransport) giveUp(key failedKey, req *http.Request, resp *http.Response, err error) (*http.Response, error) {
+	f := &failedRequest{err: err, at: time.Now()}
+	if err == nil {
+		body, rerr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if rerr != nil {
+			return nil, rerr
+		}
+		f.status, f.header, f.body = resp.StatusCode, resp.Header, body
+	}
+
+	t.mu.Lock()
+	for k, old := range t.failed {
+		if k.ctx.Err() != nil || time.Since(old.at) > globalFailedRequestTTL {
+			delete(t.failed, k)
+		}
+	}
+	t.failed[key] = f
+	t.mu.Unlock()
+
+	return f.response(req)
+}
+
+// retryableStatus is true for the statuses of a server being unavailable
+// or throttling requests.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// replayable returns if the request can be sent again.
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// RoundTrip sends the request, retrying while it fails transiently. A
+// request given up on already fails again without being sent.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, tracked := keyOf(req)
+	if tracked {
+		if f, ok := t.lastFailure(key); ok {
+			return f.response(req)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.RoundTripper.RoundTrip(req)
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return resp, err
+		}
+		if attempt >= t.retries || !replayable(req) || !t.budget.take() {
+			if !tracked {
+				return resp, err
+			}
+			return t.giveUp(key, req, resp, err)
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		if err := sleepBackoff(req.Context(), attempt, t.backoff, t.maxBackoff); err != nil {
+			return nil, err
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// sleepBackoff sleeps a random time up to the exponential backoff of the
+// attempt, capped at max, or until ctx is done.
+func sleepBackoff(ctx context.Context, attempt int, backoff, max time.Duration) error {
+	if backoff > max {
+		backoff = max
+	}
+	backoff <<= uint(attempt)
+	if backoff > max || backoff <= 0 {
+		backoff = max
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(mathrand.Int63n(int64(backoff) + 1))):
+		return nil
+	}
+}
+
+// isTransientError returns if err is a connection failing midway, as a
+// body cut short while read. The transport retries requests failing to
+// get a response, or getting a retryable status, but can't see these.
+// Missing objects and denied requests never are.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryTransient runs op, running it again with exponential backoff and
+// jitter while it fails transiently, until the retries are spent or ctx
+// is done. The retries are paid from the budget like those of requests.
+func (mfs *MinFS) retryTransient(ctx context.Context, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if !isTransientError(err) || attempt >= mfs.config.maxRetries || !mfs.retries.take() {
+			return err
+		}
+
+		mfs.log.Debugln("Retrying after a transient error:", err)
+		if serr := sleepBackoff(ctx, attempt, globalRetryBackoff, mfs.config.retryBackoff); serr != nil {
+			return err
+		}
+	}
+}
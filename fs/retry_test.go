@@ -0,0 +1,161 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// failingServer answers status to the first fails requests and 200 after,
+// counting the requests it got.
+func failingServer(t *testing.T, fails int32, status int) (*httptest.Server, *int32) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) <= fails {
+			w.WriteHeader(status)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func get(t *testing.T, ctx context.Context, rt http.RoundTripper, url string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestRetryTransportRetries(t *testing.T) {
+	srv, hits := failingServer(t, 2, http.StatusServiceUnavailable)
+	rt := newRetryTransport(http.DefaultTransport, 3, time.Millisecond, time.Millisecond, newRetryBudget(0))
+
+	if resp := get(t, context.Background(), rt, srv.URL); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+	if *hits != 3 {
+		t.Fatalf("server got %d requests, want 3", *hits)
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	srv, hits := failingServer(t, 10, http.StatusServiceUnavailable)
+	rt := newRetryTransport(http.DefaultTransport, 2, time.Millisecond, time.Millisecond, newRetryBudget(0))
+
+	if resp := get(t, context.Background(), rt, srv.URL); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", resp.StatusCode)
+	}
+	if *hits != 3 {
+		t.Fatalf("server got %d requests, want 3", *hits)
+	}
+}
+
+func TestRetryBudgetSheds(t *testing.T) {
+	srv, hits := failingServer(t, 10, http.StatusServiceUnavailable)
+	budget := newRetryBudget(1)
+	rt := newRetryTransport(http.DefaultTransport, 3, time.Millisecond, time.Millisecond, budget)
+
+	// The budget holds one retry, the second request isn't retried.
+	get(t, context.Background(), rt, srv.URL)
+	get(t, context.Background(), rt, srv.URL)
+
+	if *hits != 3 {
+		t.Fatalf("server got %d requests, want 3", *hits)
+	}
+	if retried, shed := budget.Stats(); retried != 1 || shed != 2 {
+		t.Fatalf("got %d retried and %d shed, want 1 and 2", retried, shed)
+	}
+}
+
+func TestRetryTransportPassesLimiter(t *testing.T) {
+	srv, hits := failingServer(t, 2, http.StatusServiceUnavailable)
+	limiter := newRateLimiter(1000)
+	rt := newRetryTransport(&limitedTransport{http.DefaultTransport, limiter}, 3, time.Millisecond, time.Millisecond, newRetryBudget(0))
+
+	get(t, context.Background(), rt, srv.URL)
+
+	if limiter.count != int(*hits) {
+		t.Fatalf("limiter let %d requests through, server got %d", limiter.count, *hits)
+	}
+}
+
+func TestRetryTransportFailsResent(t *testing.T) {
+	srv, hits := failingServer(t, 10, http.StatusServiceUnavailable)
+	rt := newRetryTransport(http.DefaultTransport, 1, time.Millisecond, time.Millisecond, newRetryBudget(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	get(t, ctx, rt, srv.URL)
+	resp := get(t, ctx, rt, srv.URL)
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", resp.StatusCode)
+	}
+	if *hits != 2 {
+		t.Fatalf("server got %d requests, want 2", *hits)
+	}
+
+	// Another call is sent.
+	get(t, context.Background(), rt, srv.URL)
+	if *hits != 4 {
+		t.Fatalf("server got %d requests, want 4", *hits)
+	}
+}
+
+func TestMinioDoesNotRetryGivenUp(t *testing.T) {
+	srv, hits := failingServer(t, 100, http.StatusServiceUnavailable)
+	rt := newRetryTransport(http.DefaultTransport, 2, time.Millisecond, time.Millisecond, newRetryBudget(0))
+
+	api, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:     credentials.NewStaticV4("access", "secret", ""),
+		Transport: rt,
+		Region:    "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if _, err = api.StatObject(ctx, "bucket", "object", minio.StatObjectOptions{}); err == nil {
+		t.Fatal("stat succeeded")
+	}
+	if *hits != 3 {
+		t.Fatalf("server got %d requests, want 3", *hits)
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+// fakeS3 is an S3 server keeping its objects in memory. It serves the
+// requests of the mount to a single endpoint, unsigned.
+type fakeS3 struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeObject
+
+	// regions buckets were made in, by bucket
+	regions map[string]string
+
+	// uploads of each object, by bucket/key
+	puts map[string]int
+
+	// keys listed per page, 1000 unless set
+	page int
+
+	// answers the request with the status returned instead, unless 0. The
+	// connection is closed without an answer for -1.
+	fail func(r *http.Request) int
+}
+
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+// newFakeS3 starts a fake S3 server holding the buckets named, closed
+// when the test ends.
+func newFakeS3(t *testing.T, buckets ...string) *fakeS3 {
+	s3 := newFakeS3Objects(buckets)
+	s3.Server = httptest.NewServer(s3)
+	t.Cleanup(s3.Close)
+	return s3
+}
+
+// newFakeS3TLS starts a fake S3 server over TLS, with a certificate of its
+// own. Handshakes of clients not trusting it aren't logged.
+func newFakeS3TLS(t *testing.T, buckets ...string) *fakeS3 {
+	s3 := newFakeS3Objects(buckets)
+	s3.Server = httptest.NewUnstartedServer(s3)
+	s3.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s3.StartTLS()
+	t.Cleanup(s3.Close)
+	return s3
+}
+
+func newFakeS3Objects(buckets []string) *fakeS3 {
+	s3 := &fakeS3{
+		buckets: map[string]map[string]*fakeObject{},
+		regions: map[string]string{},
+		puts:    map[string]int{},
+	}
+	for _, bucket := range buckets {
+		s3.buckets[bucket] = map[string]*fakeObject{}
+	}
+	return s3
+}
+
+// put stores data as the object key of bucket.
+func (s3 *fakeS3) put(bucket, key string, data []byte) {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	sum := md5.Sum(data)
+	s3.buckets[bucket][key] = &fakeObject{data: data, etag: hex.EncodeToString(sum[:]), modified: time.Now().UTC()}
+}
+
+// object returns the data of the object key of bucket.
+func (s3 *fakeS3) object(bucket, key string) ([]byte, bool) {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	o, ok := s3.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// uploads returns the number of uploads of the object key of bucket.
+func (s3 *fakeS3) uploads(bucket, key string) int {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	return s3.puts[bucket+"/"+key]
+}
+
+var fakeS3Codes = map[int]string{
+	http.StatusForbidden:           "AccessDenied",
+	http.StatusNotFound:            "NoSuchKey",
+	http.StatusPreconditionFailed:  "PreconditionFailed",
+	http.StatusInternalServerError: "InternalError",
+	http.StatusServiceUnavailable:  "SlowDown",
+}
+
+func (s3 *fakeS3) error(w http.ResponseWriter, r *http.Request, status int) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, fakeS3Codes[status], http.StatusText(status))
+	}
+}
+
+func (s3 *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s3.fail != nil {
+		if status := s3.fail(r); status < 0 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		} else if status != 0 {
+			s3.error(w, r, status)
+			return
+		}
+	}
+
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	switch {
+	case bucket == "":
+		s3.listBuckets(w)
+	case key == "":
+		s3.serveBucket(w, r, bucket)
+	default:
+		s3.serveObject(w, r, bucket, key)
+	}
+}
+
+func (s3 *fakeS3) writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s3 *fakeS3) listBuckets(w http.ResponseWriter) {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	var result struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}
+	for name := range s3.buckets {
+		result.Buckets = append(result.Buckets, bucket{Name: name, CreationDate: time.Now().UTC().Format(time.RFC3339)})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool { return result.Buckets[i].Name < result.Buckets[j].Name })
+	s3.writeXML(w, result)
+}
+
+func (s3 *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	objects, ok := s3.buckets[bucket]
+
+	switch {
+	case r.Method == http.MethodPut:
+		var config struct {
+			Location string `xml:"LocationConstraint"`
+		}
+		if body, _ := ioutil.ReadAll(r.Body); len(body) > 0 {
+			xml.Unmarshal(body, &config)
+		}
+		s3.buckets[bucket] = map[string]*fakeObject{}
+		s3.regions[bucket] = config.Location
+	case !ok:
+		s3.error(w, r, http.StatusNotFound)
+	case r.Method == http.MethodHead:
+	case r.URL.Query().Get("list-type") == "2":
+		s3.listObjects(w, r, bucket, objects)
+	case r.URL.Query()["location"] != nil:
+		s3.writeXML(w, struct {
+			XMLName  xml.Name `xml:"LocationConstraint"`
+			Location string   `xml:",chardata"`
+		}{Location: s3.regions[bucket]})
+	default:
+		s3.error(w, r, http.StatusForbidden)
+	}
+}
+
+func (s3 *fakeS3) listObjects(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*fakeObject) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+
+	after := q.Get("start-after")
+	if token := q.Get("continuation-token"); token != "" {
+		after = token
+	}
+
+	maxKeys := 1000
+	if s3.page > 0 {
+		maxKeys = s3.page
+	}
+	if n, err := strconv.Atoi(q.Get("max-keys")); err == nil && n > 0 && n < maxKeys {
+		maxKeys = n
+	}
+
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+		StorageClass string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		Delimiter             string
+		MaxKeys               int
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+	}
+	result.Name, result.Prefix, result.Delimiter, result.MaxKeys = bucket, prefix, delimiter, maxKeys
+
+	last := ""
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+
+		// The keys below a common prefix listed already are part of it.
+		if last != "" && strings.HasSuffix(last, delimiter) && delimiter != "" && strings.HasPrefix(key, last) {
+			continue
+		}
+		if strings.HasSuffix(after, delimiter) && delimiter != "" && strings.HasPrefix(key, after) {
+			continue
+		}
+
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			last = key[:len(prefix)+i+len(delimiter)]
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: last})
+		} else {
+			last = key
+			o := objects[key]
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				LastModified: o.modified.Format("2006-01-02T15:04:05.000Z"),
+				ETag:         `"` + o.etag + `"`,
+				Size:         int64(len(o.data)),
+				StorageClass: "STANDARD",
+			})
+		}
+		result.KeyCount++
+	}
+	s3.writeXML(w, result)
+}
+
+func (s3 *fakeS3) serveObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	objects, ok := s3.buckets[bucket]
+	if !ok {
+		s3.error(w, r, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var data []byte
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			parts := strings.SplitN(strings.TrimPrefix(path.Clean("/"+source), "/"), "/", 2)
+			o, ok := s3.buckets[parts[0]][parts[1]]
+			if !ok || len(parts) != 2 {
+				s3.error(w, r, http.StatusNotFound)
+				return
+			}
+			data = o.data
+		} else {
+			data, _ = ioutil.ReadAll(r.Body)
+		}
+
+		sum := md5.Sum(data)
+		o := &fakeObject{data: data, etag: hex.EncodeToString(sum[:]), modified: time.Now().UTC()}
+		objects[key] = o
+		s3.puts[bucket+"/"+key]++
+
+		w.Header().Set("ETag", `"`+o.etag+`"`)
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><CopyObjectResult><ETag>"%s"</ETag><LastModified>%s</LastModified></CopyObjectResult>`, o.etag, o.modified.Format("2006-01-02T15:04:05.000Z"))
+		}
+	case http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		o, ok := objects[key]
+		if !ok {
+			s3.error(w, r, http.StatusNotFound)
+			return
+		}
+		if match := strings.Trim(r.Header.Get("If-Match"), `"`); match != "" && match != o.etag {
+			s3.error(w, r, http.StatusPreconditionFailed)
+			return
+		}
+
+		data := o.data
+		status := http.StatusOK
+		if rng := strings.TrimPrefix(r.Header.Get("Range"), "bytes="); rng != r.Header.Get("Range") {
+			bounds := strings.SplitN(rng, "-", 2)
+			start, _ := strconv.Atoi(bounds[0])
+			end := len(data) - 1
+			if n, err := strconv.Atoi(bounds[1]); err == nil && n < end {
+				end = n
+			}
+			if start > end {
+				data = nil
+			} else {
+				data = data[start : end+1]
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.data)))
+			status = http.StatusPartialContent
+		}
+
+		w.Header().Set("ETag", `"`+o.etag+`"`)
+		w.Header().Set("Last-Modified", o.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		s3.error(w, r, http.StatusForbidden)
+	}
+}
+
+// newTestFS returns a mount of s3 ready to serve requests, without
+// mounting it. Its cache is removed when the test ends.
+func newTestFS(t *testing.T, s3 *fakeS3, options ...func(*Config)) *MinFS {
+	t.Helper()
+
+	dir := t.TempDir()
+	options = append([]func(*Config){
+		Mountpoint(path.Join(dir, "mnt")),
+		Target(s3.URL),
+		CacheDir(path.Join(dir, "cache")),
+		Region("us-east-1"),
+	}, options...)
+
+	mfs, err := New(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mfs.db, err = meta.Open(path.Join(mfs.config.cache, "meta", "cache.db"), 0600, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mfs.db.Close() })
+
+	// Stops what runs in the background, as unmounting does.
+	t.Cleanup(func() { close(mfs.listenerDoneCh) })
+
+	if err = mfs.db.Update(func(tx *meta.Tx) error {
+		if _, berr := tx.CreateBucketIfNotExists([]byte("minio/")); berr != nil {
+			return berr
+		}
+		_, berr := tx.CreateBucketIfNotExists([]byte(globalCacheIndexBucket))
+		return berr
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if mfs.api, err = mfs.getApi(context.Background(), mfs.config.uid); err != nil {
+		t.Fatal(err)
+	}
+	if err = mfs.startSync(); err != nil {
+		t.Fatal(err)
+	}
+	return mfs
+}
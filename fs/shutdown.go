@@ -0,0 +1,121 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"bazil.org/fuse"
+)
+
+// opTracker counts the operations in progress, such as opens downloading
+// objects and closes uploading them, so a shutdown can wait for them.
+type opTracker struct {
+	mu sync.Mutex
+
+	ops      int
+	draining bool
+
+	// closed once draining and no operation is in progress
+	idle chan struct{}
+}
+
+// begin counts an operation starting, unless draining: a new operation is
+// refused then.
+func (t *opTracker) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return false
+	}
+	t.ops++
+	return true
+}
+
+// track counts an operation starting even while draining, for operations
+// finishing what was started before, as the upload of a file closed.
+func (t *opTracker) track() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ops++
+}
+
+// end counts an operation done.
+func (t *opTracker) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ops--; t.draining && t.ops == 0 {
+		close(t.idle)
+	}
+}
+
+// drain refuses new operations, and returns a channel closed once the
+// operations in progress are done.
+func (t *opTracker) drain() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.draining {
+		t.draining = true
+		t.idle = make(chan struct{})
+		if t.ops == 0 {
+			close(t.idle)
+		}
+	}
+	return t.idle
+}
+
+// Shutdown unmounts once the operations in progress are done, new opens
+// fail with EIO meanwhile, and returns once Serve returned and the
+// database is closed. When ctx is done before the operations, or files are
+// still open on the mount, the mount is detached lazily instead: it is
+// gone for new accesses, and unmounted once the last file is closed.
+func (mfs *MinFS) Shutdown(ctx context.Context) error {
+	// Not ready anymore, so no more work is sent here.
+	atomic.StoreInt32(&mfs.mounted, 0)
+
+	mfs.log.Println("Shutting down, waiting for the operations in progress")
+
+	drained := true
+	select {
+	case <-mfs.ops.drain():
+	case <-ctx.Done():
+		mfs.log.Errorln("Operations still in progress, unmounting anyway:", ctx.Err())
+		drained = false
+	}
+
+	err := fuse.Unmount(mfs.config.mountpoint)
+	if err != nil || !drained {
+		if err != nil {
+			mfs.log.Println("Unable to unmount", mfs.config.mountpoint, err, "detaching it")
+		}
+		if err = forceUnmount(mfs.config.mountpoint); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-mfs.served:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
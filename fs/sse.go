@@ -0,0 +1,56 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// sse returns the server side encryption of the objects of bucket, nil for
+// buckets encrypted without keys from the client or not at all.
+func (mfs *MinFS) sse(bucket string) encrypt.ServerSide {
+	return mfs.config.sse[bucket]
+}
+
+// getOptions returns the options reading or stating an object of bucket.
+// They only carry the key of an SSE-C bucket, the server decrypts objects
+// encrypted with other keys on its own.
+func (mfs *MinFS) getOptions(bucket string) minio.GetObjectOptions {
+	return minio.GetObjectOptions{ServerSideEncryption: mfs.sse(bucket)}
+}
+
+// putOptions returns the options writing an object of bucket, encrypted as
+// the bucket is.
+func (mfs *MinFS) putOptions(bucket string) minio.PutObjectOptions {
+	return minio.PutObjectOptions{ServerSideEncryption: mfs.sse(bucket)}
+}
+
+// copySrc returns the options reading the object of bucket as the source
+// of a copy, only SSE-C sources need their key.
+func (mfs *MinFS) copySrc(bucket, object string) minio.CopySrcOptions {
+	opts := minio.CopySrcOptions{Bucket: bucket, Object: object}
+	if sse := mfs.sse(bucket); sse != nil && sse.Type() == encrypt.SSEC {
+		opts.Encryption = sse
+	}
+	return opts
+}
+
+// copyDest returns the options writing the object of bucket as the target
+// of a copy.
+func (mfs *MinFS) copyDest(bucket, object string) minio.CopyDestOptions {
+	return minio.CopyDestOptions{Bucket: bucket, Object: object, Encryption: mfs.sse(bucket)}
+}
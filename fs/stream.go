@@ -0,0 +1,88 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io"
+	"syscall"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// openStream returns a handle reading the object straight from the server
+// by range, without caching it.
+func (f *File) openStream(req *fuse.OpenRequest, resp *fuse.OpenResponse, api *minio.Client, object minio.ObjectInfo) (*FileHandle, error) {
+	// Data written can't be staged without a cache file.
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EFBIG)
+	}
+
+	fh, err := f.mfs.Acquire(f, "")
+	if err != nil {
+		return nil, err
+	}
+
+	fh.uid = req.Uid
+	fh.api = api
+	fh.etag = object.ETag
+
+	resp.Handle = fuse.HandleID(fh.handle)
+
+	f.mfs.log.Debugln("Serving FH request [", fh.handle, "], streaming: ", f.FullPath())
+
+	return fh, nil
+}
+
+// readStream reads the requested range from the server.
+func (fh *FileHandle) readStream(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	size := int64(fh.f.Size)
+	if req.Offset >= size {
+		return nil
+	}
+
+	end := req.Offset + int64(req.Size) - 1
+	if end >= size {
+		end = size - 1
+	}
+
+	opts := fh.f.mfs.getOptions(fh.f.Bucket())
+	if err := opts.SetRange(req.Offset, end); err != nil {
+		return err
+	}
+
+	// Every range must come from the version that was opened.
+	if err := opts.SetMatchETag(fh.etag); err != nil {
+		return err
+	}
+
+	object, err := fh.api.GetObject(ctx, fh.f.Bucket(), fh.f.ObjectPath(), opts)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	buff := make([]byte, end-req.Offset+1)
+	n, err := io.ReadFull(object, buff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		fh.f.mfs.log.Errorln("Error streaming", fh.f.FullPath(), err)
+		return fuse.EIO
+	}
+
+	resp.Data = buff[:n]
+	return nil
+}
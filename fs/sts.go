@@ -0,0 +1,80 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// stsConfig selects temporary credentials from an STS endpoint instead of
+// the static keys. With a token file the web identity in it is exchanged,
+// else the mount keys assume the role, roleARN is only sent then.
+type stsConfig struct {
+	endpoint  *url.URL
+	roleARN   string
+	tokenFile string
+}
+
+// globalSTSSessionName names the role sessions of the mount.
+const globalSTSSessionName = "minfs"
+
+// expiryTransport expires the credentials when a request is rejected for
+// an expired token. minio retries ExpiredToken, the retry is signed with
+// credentials fetched again, so a session ending mid-operation only costs
+// one request. Rejections minio doesn't retry are retried by the callers,
+// see retryExpired.
+type expiryTransport struct {
+	http.RoundTripper
+
+	creds *credentials.Credentials
+}
+
+// expiredTokenCodes are the error codes of requests signed with expired
+// temporary credentials.
+var expiredTokenCodes = [][]byte{
+	[]byte("<Code>ExpiredToken</Code>"),
+	[]byte("<Code>ExpiredTokenException</Code>"),
+}
+
+// RoundTrip sends the request, and looks for an expired token in the error
+// of rejected requests.
+func (t *expiryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusForbidden) {
+		return resp, err
+	}
+
+	// Error documents are small, the body is read whole and put back.
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	for _, code := range expiredTokenCodes {
+		if bytes.Contains(body, code) {
+			t.creds.Expire()
+			break
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// globalMaxSymlinkSize is the longest target of a symlink object, as the
+// longest path Linux resolves.
+const globalMaxSymlinkSize = 4096
+
+// objectContentType returns the content type of a listed object. Listings
+// with metadata hold it with the user metadata.
+func objectContentType(objInfo minio.ObjectInfo) string {
+	if objInfo.ContentType != "" {
+		return objInfo.ContentType
+	}
+	value, _ := userMeta(objInfo, "content-type")
+	return value
+}
+
+// isSymlinkObject returns if the listed object is presented as a symlink:
+// it has the symlink content type, and is small enough to be a target.
+func (mfs *MinFS) isSymlinkObject(objInfo minio.ObjectInfo) bool {
+	return mfs.config.symlinkType != "" &&
+		objInfo.Size <= globalMaxSymlinkSize &&
+		objectContentType(objInfo) == mfs.config.symlinkType
+}
+
+// listMetadata returns if listings ask for the metadata of the objects.
+func (mfs *MinFS) listMetadata() bool {
+	return mfs.config.preservePOSIXMeta || mfs.config.symlinkType != ""
+}
+
+// Readlink returns the target of a symlink, the body of its object.
+func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	if f.Mode&os.ModeSymlink == 0 {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+
+	api, err := f.mfs.getBucketApi(ctx, req.Uid, f.Bucket())
+	if err != nil {
+		return "", err
+	}
+
+	var target []byte
+	err = f.mfs.retryExpired(ctx, req.Uid, func() error {
+		object, err := api.GetObject(ctx, f.Bucket(), f.ObjectPath(), f.mfs.getOptions(f.Bucket()))
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		// Never more than a target is read, whatever the object became.
+		target, err = ioutil.ReadAll(io.LimitReader(object, globalMaxSymlinkSize+1))
+		return err
+	})
+	if err != nil {
+		if meta.IsNoSuchObject(err) {
+			return "", fuse.ENOENT
+		}
+		f.mfs.log.Errorln("Unable to read target of", f.FullPath(), err)
+		return "", fuse.EIO
+	}
+
+	if len(target) == 0 {
+		f.mfs.log.Errorln("Target of", f.FullPath(), "is empty")
+		return "", fuse.EIO
+	} else if len(target) > globalMaxSymlinkSize {
+		f.mfs.log.Errorln("Target of", f.FullPath(), "has", len(target), "bytes, at most", globalMaxSymlinkSize, "are allowed")
+		return "", fuse.Errno(syscall.ENAMETOOLONG)
+	}
+	return string(target), nil
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// withTimeout returns the context of an operation of a request, done when
+// ctx is or after timeout. A timeout of 0 doesn't bound the operation.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timedOut returns if the operation context octx, derived from the request
+// context ctx, ran past its timeout, rather than the request being
+// interrupted.
+func timedOut(ctx, octx context.Context) bool {
+	return ctx.Err() == nil && errors.Is(octx.Err(), context.DeadlineExceeded)
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package minfs
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// forceUnmount detaches the mount at dir even while files are open on it.
+func forceUnmount(dir string) error {
+	if out, err := exec.Command("fusermount", "-u", "-z", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("fusermount: %v: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// streamUpload uploads the data written to a handle as a multipart upload,
+// part by part as the parts fill, so only the part being written is staged.
+//
+// The data is staged as usual until threshold bytes were written
+// sequentially, then the multipart upload starts. A write before that
+// which isn't sequential keeps the handle staging, the file is uploaded
+// whole on close. Once streaming, data of uploaded parts can't be written
+// again.
+type streamUpload struct {
+	mu sync.Mutex
+
+	core   minio.Core
+	bucket string
+	object string
+
+	// encrypts the object, every part of an SSE-C object carries the key
+	sse encrypt.ServerSide
+
+	partSize  int64
+	threshold int64
+
+	uploadID string
+	parts    []minio.CompletePart
+
+	// offset in the object of the staged data, all before it is uploaded
+	base int64
+
+	// end of the data written, and if every write so far was at the end
+	end        int64
+	sequential bool
+
+	// the multipart upload was completed
+	done bool
+}
+
+// customerKey returns the encryption sent with the parts and the completion
+// of the upload: a customer key only, S3 and KMS encryption are set when
+// the upload starts and rejected after.
+func (u *streamUpload) customerKey() encrypt.ServerSide {
+	if u.sse != nil && u.sse.Type() == encrypt.SSEC {
+		return u.sse
+	}
+	return nil
+}
+
+// openUpload returns a handle streaming the written data to the object,
+// for files truncated on open.
+func (f *File) openUpload(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (*FileHandle, error) {
+	api, err := f.mfs.getBucketApi(ctx, req.Uid, f.Bucket())
+	if err != nil {
+		return nil, err
+	}
+
+	stagePath, err := f.mfs.NewCachePath()
+	if err != nil {
+		return nil, err
+	}
+
+	fh, err := f.mfs.Acquire(f, stagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fh.cachePath = stagePath
+	fh.uid = req.Uid
+	fh.upload = &streamUpload{
+		core:       minio.Core{Client: api},
+		bucket:     f.Bucket(),
+		object:     f.ObjectPath(),
+		sse:        f.mfs.sse(f.Bucket()),
+		partSize:   f.mfs.config.streamPartSize,
+		threshold:  f.mfs.config.streamThreshold,
+		sequential: true,
+	}
+
+	fh.File, err = f.mfs.openLocal(fh.cachePath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if err != nil {
+		f.mfs.Release(fh)
+		return nil, err
+	}
+
+	// Truncated on open, the object is uploaded empty even without writes.
+	f.Size = 0
+	fh.dirty = true
+	resp.Handle = fuse.HandleID(fh.handle)
+
+	f.mfs.log.Debugln("Serving FH request [", fh.handle, "], streaming upload to: ", f.FullPath(), " staged @", stagePath)
+
+	return fh, nil
+}
+
+// writeUpload writes to the staged part, and uploads the parts filled.
+func (fh *FileHandle) writeUpload(ctx context.Context, req *fuse.WriteRequest) (int, error) {
+	u := fh.upload
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	offset := req.Offset - u.base
+	if u.done {
+		fh.f.mfs.log.Errorln("Write to", fh.f.FullPath(), "after its upload completed")
+		return 0, fuse.Errno(syscall.ENOTSUP)
+	} else if offset < 0 {
+		fh.f.mfs.log.Errorln("Write to", fh.f.FullPath(), "at", req.Offset, "is in an uploaded part")
+		return 0, fuse.Errno(syscall.ENOTSUP)
+	}
+
+	n, err := fh.File.WriteAt(req.Data, offset)
+	if err != nil {
+		return n, err
+	}
+
+	if req.Offset != u.end {
+		u.sequential = false
+	}
+	if end := req.Offset + int64(n); end > u.end {
+		u.end = end
+	}
+
+	if u.uploadID == "" {
+		if !u.sequential || u.end < u.threshold || u.end < u.partSize {
+			return n, nil
+		}
+
+		if u.uploadID, err = u.core.NewMultipartUpload(ctx, u.bucket, u.object, minio.PutObjectOptions{ServerSideEncryption: u.sse}); err != nil {
+			fh.f.mfs.log.Errorln("Unable to start upload of", fh.f.FullPath(), err)
+			return n, fuse.EIO
+		}
+	}
+
+	for u.end-u.base >= u.partSize {
+		if err = fh.uploadPart(ctx, u.partSize); err != nil {
+			fh.f.mfs.log.Errorln("Unable to upload part of", fh.f.FullPath(), err)
+			return n, fuse.EIO
+		}
+	}
+	return n, nil
+}
+
+// uploadPart uploads the first size bytes staged as the next part, and
+// moves the rest to the start of the staging file. Callers hold mu.
+func (fh *FileHandle) uploadPart(ctx context.Context, size int64) error {
+	u := fh.upload
+
+	partID := len(u.parts) + 1
+	part, err := u.core.PutObjectPart(ctx, u.bucket, u.object, u.uploadID, partID, io.NewSectionReader(fh.File, 0, size), size, "", "", u.customerKey())
+	if err != nil {
+		return err
+	}
+	u.parts = append(u.parts, minio.CompletePart{PartNumber: partID, ETag: part.ETag})
+
+	rest := u.end - u.base - size
+	if rest > 0 {
+		buff := make([]byte, rest)
+		if _, err = fh.File.ReadAt(buff, size); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err = fh.File.WriteAt(buff, 0); err != nil {
+			return err
+		}
+	}
+	if err = fh.File.Truncate(rest); err != nil {
+		return err
+	}
+
+	u.base += size
+	return nil
+}
+
+// flushUpload uploads what is staged, completing the multipart upload when
+// it was started.
+func (fh *FileHandle) flushUpload(ctx context.Context) error {
+	u := fh.upload
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.done {
+		return nil
+	} else if u.uploadID == "" {
+		_, err := u.core.Client.FPutObject(ctx, u.bucket, u.object, fh.cachePath, minio.PutObjectOptions{ServerSideEncryption: u.sse})
+		return err
+	}
+
+	if u.end > u.base {
+		if err := fh.uploadPart(ctx, u.end-u.base); err != nil {
+			return err
+		}
+	}
+
+	if _, err := u.core.CompleteMultipartUpload(ctx, u.bucket, u.object, u.uploadID, u.parts, minio.PutObjectOptions{ServerSideEncryption: u.customerKey()}); err != nil {
+		return err
+	}
+
+	u.done = true
+	return nil
+}
+
+// abortUpload drops the parts of an upload that wasn't completed.
+func (fh *FileHandle) abortUpload() {
+	u := fh.upload
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.uploadID == "" || u.done {
+		return
+	}
+
+	if err := u.core.AbortMultipartUpload(context.Background(), u.bucket, u.object, u.uploadID); err != nil {
+		fh.f.mfs.log.Errorln("Unable to abort upload of", fh.f.FullPath(), err)
+	}
+	u.uploadID = ""
+}
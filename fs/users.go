@@ -0,0 +1,49 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// loadUserCredentials reads the credentials of users from the JSON file at
+// path, an object mapping uids to access configs:
+//
+//	{"1000": {"accessKey": "...", "secretKey": "..."}}
+func loadUserCredentials(path string) (map[uint32]AccessConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var byName map[string]AccessConfig
+	if err = json.Unmarshal(data, &byName); err != nil {
+		return nil, err
+	}
+
+	users := make(map[uint32]AccessConfig, len(byName))
+	for name, ac := range byName {
+		uid, err := strconv.ParseUint(name, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a uid", name)
+		}
+		users[uint32(uid)] = ac
+	}
+	return users, nil
+}
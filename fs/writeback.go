@@ -0,0 +1,361 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// writeState is the state of an object open for writing. Every writable
+// handle of the object writes to the same cache file, which is uploaded
+// once when the last handle closes.
+type writeState struct {
+	handles int
+	dirty   bool
+
+	cachePath string
+	uid       uint32
+
+	// the node of a file created through the mount, nil once uploaded
+	created *File
+
+	// the object was removed while open, it isn't uploaded anymore
+	removed bool
+
+	// a failed upload is retried in the background, see uploadLater
+	retrying bool
+}
+
+// addWriter registers a writable handle of the object at fullPath.
+func (mfs *MinFS) addWriter(fullPath, cachePath string, uid uint32) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	ws, ok := mfs.writers[fullPath]
+	if !ok {
+		ws = &writeState{}
+		mfs.writers[fullPath] = ws
+	}
+
+	ws.handles++
+	ws.cachePath = cachePath
+	ws.uid = uid
+}
+
+// removeWriter drops a writable handle of the object at fullPath, returns
+// if it was the last one and the object is still dirty.
+func (mfs *MinFS) removeWriter(fullPath string) (dirty bool) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	ws, ok := mfs.writers[fullPath]
+	if !ok {
+		return false
+	}
+
+	if ws.handles--; ws.handles > 0 {
+		return false
+	}
+
+	if !ws.dirty {
+		delete(mfs.writers, fullPath)
+	}
+	return ws.dirty
+}
+
+// writing returns if writable handles of the object at fullPath are open,
+// or its writes are still to be uploaded.
+func (mfs *MinFS) writing(fullPath string) bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	_, ok := mfs.writers[fullPath]
+	return ok
+}
+
+// createdFiles returns the files created in the directory at parent that
+// weren't uploaded yet, so they are listed before they exist as objects.
+func (mfs *MinFS) createdFiles(parent string) (files []File) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	for fullPath, ws := range mfs.writers {
+		if ws.created != nil && path.Dir(fullPath) == parent {
+			files = append(files, *ws.created)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// createdFile returns the cache file of the file at fullPath, if it was
+// created through the mount and isn't uploaded yet.
+func (mfs *MinFS) createdFile(fullPath string) (string, bool) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	ws, ok := mfs.writers[fullPath]
+	if !ok || ws.created == nil {
+		return "", false
+	}
+	return ws.cachePath, true
+}
+
+// unlinkWriter marks the object at fullPath as removed while open for
+// writing, the handles still open write to a file that's gone and are
+// never uploaded. Returns if the file was created through the mount and
+// not uploaded yet, so there is no object to remove. The file it was
+// staged in is removed then, handles still open keep writing to it until
+// closed, and it is forgotten once closed.
+func (mfs *MinFS) unlinkWriter(fullPath string) (created bool) {
+	mfs.m.Lock()
+	ws, ok := mfs.writers[fullPath]
+	if !ok {
+		mfs.m.Unlock()
+		return false
+	}
+
+	created = ws.created != nil
+	ws.created = nil
+	ws.dirty = false
+	ws.removed = true
+	if ws.handles <= 0 {
+		delete(mfs.writers, fullPath)
+	}
+	stagePath := ws.cachePath
+	mfs.m.Unlock()
+
+	if created {
+		mfs.dropWrites(stagePath, true)
+	}
+	return created
+}
+
+// dropWrites removes the cache file at cachePath holding writes that are
+// never uploaded. A file staging a created file is no cached version,
+// others are forgotten as the version they held.
+func (mfs *MinFS) dropWrites(cachePath string, staged bool) {
+	unlock := mfs.km.Lock(cachePath)
+	defer unlock()
+
+	if err := os.Remove(cachePath); err != nil && !os.IsNotExist(err) {
+		mfs.log.Errorln("Unable to remove cache file", cachePath, err)
+		return
+	}
+	mfs.cacheRemoved(cachePath)
+	if !staged {
+		mfs.forgetCacheBucket(cachePath)
+		mfs.unrecordCache(cachePath)
+	}
+}
+
+// setDirty marks the object at fullPath as changed or uploaded.
+func (mfs *MinFS) setDirty(fullPath string, dirty bool) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	if ws, ok := mfs.writers[fullPath]; ok && !ws.removed {
+		ws.dirty = dirty
+	}
+}
+
+// lastWriter returns if a single writable handle of the object at fullPath
+// is open, its close is the last.
+func (mfs *MinFS) lastWriter(fullPath string) bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	ws, ok := mfs.writers[fullPath]
+	return ok && ws.handles <= 1
+}
+
+// uploadErrno maps the error of an upload to the errno it fails with.
+func uploadErrno(err error) fuse.Errno {
+	switch minio.ToErrorResponse(err).Code {
+	case "AccessDenied":
+		return fuse.Errno(syscall.EACCES)
+	case "NoSuchBucket":
+		return fuse.ENOENT
+	case "EntityTooLarge":
+		return fuse.Errno(syscall.EFBIG)
+	case "XMinioAdminBucketQuotaExceeded", "QuotaExceeded":
+		return fuse.Errno(syscall.ENOSPC)
+	}
+
+	if os.IsNotExist(err) {
+		return fuse.ENOENT
+	}
+	return fuse.EIO
+}
+
+// upload uploads the object of f if it is dirty, from the cache file its
+// writable handles share. Writers opening the object wait for the upload.
+func (f *File) upload() error {
+	unlock := f.mfs.lockObject(f.FullPath())
+	defer unlock()
+
+	return f.uploadLocked()
+}
+
+// uploadLocked is upload, for callers holding the writer lock of f.
+func (f *File) uploadLocked() error {
+	fullPath := f.FullPath()
+
+	f.mfs.m.Lock()
+	ws, ok := f.mfs.writers[fullPath]
+	if !ok || !ws.dirty {
+		f.mfs.m.Unlock()
+		return nil
+	}
+
+	// Writes during the upload dirty the object again. The writes are kept
+	// until uploaded, an upload failing leaves them dirty.
+	ws.dirty = false
+	source, uid := ws.cachePath, ws.uid
+	f.mfs.m.Unlock()
+
+	// Eviction waits for the upload, the cache file is flushed to disk
+	// before it is read.
+	unlockCache := f.mfs.km.Lock(source)
+	err := f.mfs.syncLocal(source)
+	pr := newPutOp(source, fullPath, int64(f.Size), uid)
+	if err == nil {
+		if err = f.mfs.sync(&pr); err == nil {
+			err = <-pr.Error
+		}
+	}
+	unlockCache()
+
+	if err != nil {
+		f.mfs.log.Errorln("Error uploading", fullPath, err)
+
+		// Uploaded again when the last handle closes, or in the background
+		// once it closed, see uploadLater.
+		f.mfs.m.Lock()
+		ws.dirty = !ws.removed
+		f.mfs.m.Unlock()
+		return uploadErrno(err)
+	}
+
+	// The object exists now, it is listed as any other. The last handle
+	// closed, nothing is left to upload.
+	f.mfs.m.Lock()
+	ws.created = nil
+	if ws.handles <= 0 && !ws.dirty && f.mfs.writers[fullPath] == ws {
+		delete(f.mfs.writers, fullPath)
+	}
+	f.mfs.m.Unlock()
+
+	// The cache file holds the new version, opens of it are served from it.
+	f.ETag = pr.ETag
+	f.modified = time.Time{}
+	cachePath := f.mfs.cachePath(f.Bucket(), f.ObjectPath(), pr.ETag)
+	f.mfs.moveCache(source, cachePath)
+
+	// Writes changed the size of the cache file.
+	if info, err := f.mfs.statLocal(cachePath); err == nil {
+		f.mfs.cacheAdded(cachePath, info)
+	}
+
+	// update cache
+	if err := f.mfs.db.Update(func(tx *meta.Tx) error {
+		return f.store(tx)
+	}); err != nil {
+		return err
+	}
+
+	f.objMeta.invalidate()
+	f.mfs.invalidate(fullPath)
+	return nil
+}
+
+// uploadLater uploads in the background the writes an upload failing on the
+// last close left, with a backoff doubling up to the retry backoff, until
+// uploaded or the object is removed. Handles opened meanwhile upload them
+// when the last closes. A shutdown waits for the upload, the writes still
+// not uploaded when unmounted are lost.
+func (f *File) uploadLater() {
+	fullPath := f.FullPath()
+
+	f.mfs.m.Lock()
+	ws, ok := f.mfs.writers[fullPath]
+	if !ok || ws.retrying || !ws.dirty {
+		f.mfs.m.Unlock()
+		return
+	}
+	ws.retrying = true
+	f.mfs.m.Unlock()
+
+	f.mfs.ops.track()
+	go func() {
+		defer f.mfs.ops.end()
+		defer func() {
+			f.mfs.m.Lock()
+			ws.retrying = false
+			f.mfs.m.Unlock()
+		}()
+
+		backoff := globalRetryBackoff
+		if backoff > f.mfs.config.retryBackoff {
+			backoff = f.mfs.config.retryBackoff
+		}
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-f.mfs.listenerDoneCh:
+				f.mfs.log.Errorln("Unmounted before the writes to", fullPath, "were uploaded, dropping them")
+				f.mfs.m.Lock()
+				if f.mfs.writers[fullPath] == ws {
+					delete(f.mfs.writers, fullPath)
+				}
+				source, created := ws.cachePath, ws.created != nil
+				f.mfs.m.Unlock()
+				f.mfs.dropWrites(source, created)
+				return
+			}
+
+			f.mfs.m.Lock()
+			current := f.mfs.writers[fullPath] == ws
+			pending := current && ws.dirty && ws.handles <= 0
+			f.mfs.m.Unlock()
+			if !current {
+				return
+			} else if !pending {
+				continue
+			}
+
+			if err := f.upload(); err == nil {
+				f.mfs.log.Println("Uploaded the writes to", fullPath, "left by a failed upload")
+				if !f.mfs.writing(fullPath) {
+					f.mfs.sealCache(f.mfs.cachePath(f.Bucket(), f.ObjectPath(), f.ETag), f.ObjectPath(), f.ETag)
+				}
+				return
+			}
+
+			if backoff *= 2; backoff > f.mfs.config.retryBackoff {
+				backoff = f.mfs.config.retryBackoff
+			}
+		}
+	}()
+}
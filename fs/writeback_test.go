@@ -0,0 +1,154 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// openTwice creates the file name in bucket and opens it a second time,
+// returning both handles.
+func openTwice(t *testing.T, mfs *MinFS, bucket, name string) (*File, *FileHandle, *FileHandle) {
+	t.Helper()
+
+	ctx := context.Background()
+	node, h, err := mfs.dirAt(bucket).Create(ctx, &fuse.CreateRequest{
+		Name:  name,
+		Flags: fuse.OpenReadWrite | fuse.OpenCreate,
+		Mode:  0644,
+	}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := node.(*File)
+	h2, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, h.(*FileHandle), h2.(*FileHandle)
+}
+
+func write(t *testing.T, fh *FileHandle, offset int64, data string) {
+	t.Helper()
+
+	if err := fh.Write(context.Background(), &fuse.WriteRequest{Offset: offset, Data: []byte(data)}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// closeHandle flushes and releases fh as the kernel does on close.
+func closeHandle(fh *FileHandle) error {
+	ctx := context.Background()
+	if err := fh.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+		fh.Release(ctx, &fuse.ReleaseRequest{})
+		return err
+	}
+	return fh.Release(ctx, &fuse.ReleaseRequest{})
+}
+
+func TestWritersUploadOnce(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	mfs := newTestFS(t, s3)
+
+	_, h1, h2 := openTwice(t, mfs, "bucket", "file")
+	write(t, h1, 0, "hello ")
+	write(t, h2, 6, "world")
+
+	if err := closeHandle(h1); err != nil {
+		t.Fatal(err)
+	}
+	if n := s3.uploads("bucket", "file"); n != 0 {
+		t.Fatalf("uploaded %d times before the last close", n)
+	}
+
+	if err := closeHandle(h2); err != nil {
+		t.Fatal(err)
+	}
+	if n := s3.uploads("bucket", "file"); n != 1 {
+		t.Fatalf("uploaded %d times, expected once", n)
+	}
+	if data, _ := s3.object("bucket", "file"); string(data) != "hello world" {
+		t.Fatalf("uploaded %q, expected the writes of both handles", data)
+	}
+	if len(mfs.writers) != 0 {
+		t.Fatalf("%d writers left after the last close", len(mfs.writers))
+	}
+}
+
+func TestWritersFailedUploadKept(t *testing.T) {
+	s3 := newFakeS3(t, "bucket")
+	var outage int32 = 1
+	s3.fail = func(r *http.Request) int {
+		if r.Method == http.MethodPut && atomic.LoadInt32(&outage) == 1 {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	mfs := newTestFS(t, s3, RetryBackoff(time.Millisecond))
+
+	_, h1, h2 := openTwice(t, mfs, "bucket", "file")
+	write(t, h1, 0, "hello")
+	cachePath := h1.cachePath
+
+	if err := closeHandle(h1); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeHandle(h2); err != fuse.Errno(syscall.EACCES) {
+		t.Fatalf("last close failed with %v, expected the upload error", err)
+	}
+
+	// The writes outlive the failed upload, and aren't evicted.
+	if data, err := ioutil.ReadFile(cachePath); err != nil || string(data) != "hello" {
+		t.Fatalf("cache file holds %q after the upload failed, %v", data, err)
+	}
+	if mfs.DeleteUntilQuota([]CacheItem{{Path: cachePath}}, 1); !fileExists(cachePath) {
+		t.Fatal("writes not uploaded evicted")
+	}
+
+	// Uploaded in the background once the servers take it.
+	atomic.StoreInt32(&outage, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, ok := s3.object("bucket", "file"); ok && string(data) == "hello" {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("writes not uploaded after the outage, the object holds %q", data)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for mfs.writing("bucket/file") {
+		if time.Now().After(deadline) {
+			t.Fatal("writers left once uploaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fileExists returns if a file is at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
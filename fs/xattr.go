@@ -0,0 +1,373 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// xattrInfo is the reserved attribute holding all metadata of an object as json.
+const xattrInfo = "user.s3.info"
+
+// xattrContentType, xattrETag and xattrLastModified are the attributes
+// holding the content type, the etag and the last modification of an
+// object, and xattrMetaPrefix the prefix of the attributes holding each
+// entry of its user metadata, named after the lower cased key.
+const (
+	xattrContentType  = "user.s3.content-type"
+	xattrETag         = "user.s3.etag"
+	xattrLastModified = "user.s3.last-modified"
+	xattrMetaPrefix   = "user.s3.meta."
+)
+
+// xattrTagPrefix is the prefix of the attributes holding each tag of an
+// object, named after its key as is.
+const xattrTagPrefix = "user.s3.tag."
+
+// xattrPresignedURL reads as a presigned url downloading the object.
+const xattrPresignedURL = "user.s3.presigned-url"
+
+// xattrRefresh reads at the root of the mount as the number of buckets,
+// listed anew, so a bucket just made elsewhere shows without waiting for
+// the bucket list ttl.
+const xattrRefresh = "user.minfs.refresh"
+
+// lastModifiedXattr formats the last modification of an object, in UTC so
+// it reads the same whatever the time zone of the reader.
+func lastModifiedXattr(t time.Time) []byte {
+	return []byte(t.UTC().Format(time.RFC3339))
+}
+
+// objectMeta caches the object metadata of a file node, it is shared by
+// the copies of a node and fetched on first use.
+type objectMeta struct {
+	mu sync.Mutex
+
+	info *minio.ObjectInfo
+	tags map[string]string
+
+	// the tags were fetched, they may be empty, and when
+	tagged   bool
+	taggedAt time.Time
+
+	// the object as listed or stat last, and when, reused by opens
+	stat   *minio.ObjectInfo
+	statAt time.Time
+}
+
+// setListed keeps the info of the object as listed, so an open right after
+// doesn't stat it. A listing doesn't hold all metadata, it isn't info.
+func (m *objectMeta) setListed(info minio.ObjectInfo) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stat, m.statAt = &info, time.Now()
+}
+
+// recentStat returns the object as listed or stat less than ttl ago.
+func (m *objectMeta) recentStat(ttl time.Duration) (minio.ObjectInfo, bool) {
+	if m == nil {
+		return minio.ObjectInfo{}, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stat == nil || time.Since(m.statAt) >= ttl {
+		return minio.ObjectInfo{}, false
+	}
+	return *m.stat, true
+}
+
+// setInfo keeps the info of a stat made anyway, so reading the attributes
+// of the file doesn't stat it again.
+func (m *objectMeta) setInfo(info minio.ObjectInfo) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.info = &info
+	m.stat, m.statAt = &info, time.Now()
+}
+
+// invalidate drops the cached metadata, so it is fetched again on next use.
+func (m *objectMeta) invalidate() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.info = nil
+	m.tags = nil
+	m.tagged = false
+	m.stat = nil
+}
+
+// objectInfoXattr is the json presented at xattrInfo.
+type objectInfoXattr struct {
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`
+	ContentType  string            `json:"contentType"`
+	StorageClass string            `json:"storageClass"`
+	LastModified time.Time         `json:"lastModified"`
+	UserMetadata map[string]string `json:"userMetadata"`
+	Tags         map[string]string `json:"tags"`
+}
+
+// objectMeta returns the object info of the file, and its tags when
+// withTags, from the node cache when present. Tags change without the
+// object changing, they are fetched again once older than the tag ttl.
+func (f *File) objectMeta(ctx context.Context, uid uint32, withTags bool) (*minio.ObjectInfo, map[string]string, error) {
+	m := f.objMeta
+	if m == nil {
+		m = &objectMeta{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tagged := m.tagged && time.Since(m.taggedAt) < f.mfs.config.tagCacheTTL
+	if m.info != nil && (tagged || !withTags) {
+		return m.info, m.tags, nil
+	}
+
+	api, err := f.mfs.getBucketApi(ctx, uid, f.Bucket())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if m.info == nil {
+		info, err := api.StatObject(ctx, f.Bucket(), f.ObjectPath(), f.mfs.getOptions(f.Bucket()))
+		if err != nil {
+			return nil, nil, err
+		}
+		m.info = &info
+	}
+
+	if !withTags {
+		return m.info, nil, nil
+	}
+
+	// Not every server supports tagging, the object is presented without
+	// tags then.
+	var objectTags *tags.Tags
+	objectTags, err = api.GetObjectTagging(ctx, f.Bucket(), f.ObjectPath(), minio.GetObjectTaggingOptions{})
+	if err != nil {
+		f.mfs.log.Errorln("Unable to get tags of", f.FullPath(), err)
+		objectTags, _ = tags.NewTags(nil, true)
+	}
+
+	m.tags = objectTags.ToMap()
+	m.tagged, m.taggedAt = true, time.Now()
+	return m.info, m.tags, nil
+}
+
+// Getxattr returns the extended attribute of the file. The etag and last
+// modification come from the listing when it had them.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if req.Name == xattrPin {
+		return f.getPin(ctx, req, resp)
+	} else if req.Name == xattrPresignedURL {
+		return f.getPresignedURL(ctx, req, resp)
+	} else if req.Name == xattrRestore {
+		return f.getRestore(ctx, req, resp)
+	}
+
+	switch {
+	case req.Name == xattrETag && f.ETag != "":
+		resp.Xattr = []byte(f.ETag)
+		return nil
+	case req.Name == xattrLastModified && !f.modified.IsZero():
+		resp.Xattr = lastModifiedXattr(f.modified)
+		return nil
+	case req.Name == xattrInfo, req.Name == xattrContentType, req.Name == xattrETag, req.Name == xattrLastModified:
+	case strings.HasPrefix(req.Name, xattrMetaPrefix), strings.HasPrefix(req.Name, xattrTagPrefix):
+	default:
+		return fuse.ErrNoXattr
+	}
+
+	withTags := req.Name == xattrInfo || strings.HasPrefix(req.Name, xattrTagPrefix)
+	info, objectTags, err := f.objectMeta(ctx, req.Header.Uid, withTags)
+	if err != nil {
+		f.mfs.log.Errorln("Unable to get metadata of", f.FullPath(), err)
+		return fuse.EIO
+	}
+
+	switch req.Name {
+	case xattrContentType:
+		resp.Xattr = []byte(info.ContentType)
+		return nil
+	case xattrETag:
+		resp.Xattr = []byte(info.ETag)
+		return nil
+	case xattrLastModified:
+		resp.Xattr = lastModifiedXattr(info.LastModified)
+		return nil
+	}
+
+	if strings.HasPrefix(req.Name, xattrTagPrefix) {
+		value, ok := objectTags[strings.TrimPrefix(req.Name, xattrTagPrefix)]
+		if !ok {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte(value)
+		return nil
+	}
+
+	if req.Name != xattrInfo {
+		value, ok := userMetadata(info, strings.TrimPrefix(req.Name, xattrMetaPrefix))
+		if !ok {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte(value)
+		return nil
+	}
+
+	resp.Xattr, err = json.Marshal(objectInfoXattr{
+		Size:         info.Size,
+		ETag:         info.ETag,
+		ContentType:  info.ContentType,
+		StorageClass: info.StorageClass,
+		LastModified: info.LastModified,
+		UserMetadata: info.UserMetadata,
+		Tags:         objectTags,
+	})
+	return err
+}
+
+// Listxattr lists the extended attributes of the file, an attribute for
+// every entry of the user metadata and every tag.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	info, objectTags, err := f.objectMeta(ctx, req.Header.Uid, true)
+	if err != nil {
+		f.mfs.log.Errorln("Unable to get metadata of", f.FullPath(), err)
+		return fuse.EIO
+	}
+
+	resp.Append(xattrInfo, xattrContentType, xattrETag, xattrLastModified)
+
+	keys := make([]string, 0, len(info.UserMetadata))
+	for key := range info.UserMetadata {
+		keys = append(keys, xattrMetaPrefix+strings.ToLower(key))
+	}
+	for key := range objectTags {
+		keys = append(keys, xattrTagPrefix+key)
+	}
+	sort.Strings(keys)
+	resp.Append(keys...)
+	return nil
+}
+
+// getPresignedURL reads xattrPresignedURL, a url downloading the object
+// signed with the credentials of the uid, valid for the presign expiry.
+// Signing doesn't ask the server, the url of an object removed meanwhile is
+// denied when used. Objects encrypted with a customer key need the key in
+// the headers of the download, they have no url.
+func (f *File) getPresignedURL(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if sse := f.mfs.sse(f.Bucket()); sse != nil && sse.Type() == encrypt.SSEC {
+		return fuse.ErrNoXattr
+	}
+
+	api, err := f.mfs.getBucketApi(ctx, req.Header.Uid, f.Bucket())
+	if err != nil {
+		return err
+	}
+
+	u, err := api.PresignedGetObject(ctx, f.Bucket(), f.ObjectPath(), f.mfs.config.presignExpiry, url.Values{})
+	if err != nil {
+		f.mfs.log.Errorln("Unable to presign", f.FullPath(), err)
+		return fuse.EIO
+	}
+	resp.Xattr = []byte(u.String())
+	return nil
+}
+
+// userMetadata returns the user metadata of the object under key, matched
+// regardless of case like the headers it is sent as.
+func userMetadata(info *minio.ObjectInfo, key string) (string, bool) {
+	for k, value := range info.UserMetadata {
+		if strings.EqualFold(k, key) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Getxattr returns the etag and last modification of the archive object of
+// the directory, the directories inside the archive have no attributes.
+func (ad *ArchiveDir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if ad.prefix != "" {
+		return fuse.ErrNoXattr
+	}
+
+	switch req.Name {
+	case xattrETag:
+		resp.Xattr = []byte(ad.archive.etag)
+	case xattrLastModified:
+		resp.Xattr = lastModifiedXattr(ad.Mtime)
+	default:
+		return fuse.ErrNoXattr
+	}
+	return nil
+}
+
+// Listxattr lists the attributes of the archive object of the directory.
+func (ad *ArchiveDir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if ad.prefix == "" {
+		resp.Append(xattrETag, xattrLastModified)
+	}
+	return nil
+}
+
+// Getxattr lists the buckets again when reading xattrRefresh at the root of
+// the mount, other directories have no attributes. The buckets are listed
+// for the uid reading it, the listings kept for other uids are dropped all
+// the same.
+func (dir *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if dir.Path != "" || req.Name != xattrRefresh {
+		return fuse.ErrNoXattr
+	}
+
+	dir.mfs.invalidate("")
+
+	fsElements, err := dir.scan(ctx, req.Header.Uid)
+	if err != nil {
+		return err
+	}
+	resp.Xattr = []byte(strconv.Itoa(len(fsElements)))
+	return nil
+}